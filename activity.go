@@ -0,0 +1,86 @@
+package main
+
+// Content-adaptive spread threshold (Encoder.Adaptive).
+//
+// Busy textures mask coding errors while smooth regions show them. The
+// activity of a cell of activityCell x activityCell pixels is its mean
+// absolute luma gradient; the spread threshold of a node is scaled by the
+// square root of its activity relative to the image, clamped to [1/2, 2] and
+// normalised so the scales average to 1 (geometrically) over the image. A
+// node takes the smallest scale of the cells it covers, so a smooth part is
+// not hidden by a busy neighbour.
+
+import "math"
+
+// activityCell is the side of an activity cell in pixels.
+const activityCell = 8
+
+// activityMap holds the log2 spread scale of every cell of the coded area.
+type activityMap struct {
+	w    int // in cells
+	logs []float32
+}
+
+// newActivityMap measures the activity of plane (w x h, the coded area).
+func newActivityMap(plane []uint8, w, h int, buf []float32) activityMap {
+	cw, ch := (w+activityCell-1)/activityCell, (h+activityCell-1)/activityCell
+	if cap(buf) < cw*ch {
+		buf = make([]float32, cw*ch)
+	}
+	m := activityMap{w: cw, logs: buf[:cw*ch]}
+
+	var total float64
+	for cy := range ch {
+		for cx := range cw {
+			x0, y0 := cx*activityCell, cy*activityCell
+			x1, y1 := min(x0+activityCell, w), min(y0+activityCell, h)
+			var sum int
+			for y := y0; y < y1; y++ {
+				row := plane[y*w:]
+				for x := x0; x < x1; x++ {
+					if x+1 < w {
+						sum += absInt(int(row[x+1]) - int(row[x]))
+					}
+					if y+1 < h {
+						sum += absInt(int(row[x+w]) - int(row[x]))
+					}
+				}
+			}
+			a := float64(sum) / float64((x1-x0)*(y1-y0))
+			m.logs[cy*cw+cx] = float32(a)
+			total += a
+		}
+	}
+
+	// Scale by sqrt(activity / mean activity); the offset keeps flat cells
+	// from dominating.
+	const offset = 2
+	mean := total/float64(len(m.logs)) + offset
+	var sumLog float64
+	for i, a := range m.logs {
+		l := 0.5 * math.Log2((float64(a)+offset)/mean)
+		l = min(max(l, -1), 1)
+		m.logs[i] = float32(l)
+		sumLog += l
+	}
+	shift := float32(sumLog / float64(len(m.logs)))
+	for i := range m.logs {
+		m.logs[i] = min(max(m.logs[i]-shift, -1), 1)
+	}
+	return m
+}
+
+// log2Scale returns the log2 spread scale of a bw x bh node at (x, y).
+func (m activityMap) log2Scale(x, y, bw, bh int) float64 {
+	l := float32(1)
+	for cy := y / activityCell; cy <= (y+bh-1)/activityCell; cy++ {
+		for cx := x / activityCell; cx <= (x+bw-1)/activityCell; cx++ {
+			l = min(l, m.logs[cy*m.w+cx])
+		}
+	}
+	return float64(l)
+}
+
+func absInt(v int) int {
+	return max(v, -v)
+}
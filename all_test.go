@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"image/jpeg"
 	_ "image/jpeg"
+	"image/png"
+	"math"
 	"os"
 	"runtime"
 	"testing"
@@ -35,48 +39,1513 @@ func makeTestImage(w, h int) *image.RGBA {
 	return img
 }
 
+// makePhotoImage returns a photo-like image: smooth shading with mild noise
+// and a few flat shapes with hard edges.
+func makePhotoImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	clamp := func(v float64) uint8 { return uint8(max(0, min(255, v))) }
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := 128 + 60*math.Sin(float64(x)/9) + 40*math.Cos(float64(y)/13)
+			n := float64((x*7919+y*104729)%13) - 6
+			c := color.RGBA{clamp(v + n), clamp(v*0.8 + float64(y)/2 + n), clamp(200 - v/2 + n), 255}
+			switch {
+			case (x-w*2/5)*(x-w*2/5)+(y-h*2/5)*(y-h*2/5) < w*h/23:
+				c = color.RGBA{230, 40, 40, 255}
+			case x > w*3/4 && x < w*15/16 && y > h/7 && y < h*5/6:
+				c = color.RGBA{20, 20, 30, 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// rgbSSE returns the squared error of the R, G and B values of b against a.
+func rgbSSE(a, b *image.RGBA) float64 {
+	var sse float64
+	for i := 0; i < len(a.Pix); i += 4 {
+		for c := range 3 {
+			d := float64(a.Pix[i+c]) - float64(b.Pix[i+c])
+			sse += d * d
+		}
+	}
+	return sse
+}
+
 func TestEncodeDecode_RoundTrip(t *testing.T) {
 	src := makeTestImage(64, 48)
 
-	for _, tc := range []struct {
-		name       string
-		quality    int
-		bw         bool
-		postfilter bool
-	}{
-		{name: "color_no_postfilter", quality: 70, bw: false, postfilter: false},
-		{name: "color_postfilter", quality: 70, bw: false, postfilter: true},
-		{name: "color_no_postfilter_q80", quality: 80, bw: false, postfilter: false},
-		{name: "bw_no_postfilter", quality: 70, bw: true, postfilter: false},
-	} {
-		t.Run(tc.name, func(t *testing.T) {
-			comp, err := Encode(src, tc.quality, tc.bw)
+	for _, tc := range []struct {
+		name       string
+		quality    int
+		bw         bool
+		postfilter bool
+	}{
+		{name: "color_no_postfilter", quality: 70, bw: false, postfilter: false},
+		{name: "color_postfilter", quality: 70, bw: false, postfilter: true},
+		{name: "color_no_postfilter_q80", quality: 80, bw: false, postfilter: false},
+		{name: "bw_no_postfilter", quality: 70, bw: true, postfilter: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			comp, err := Encode(src, tc.quality, tc.bw)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if len(comp) == 0 {
+				t.Fatalf("Encode returned empty payload")
+			}
+
+			dec, err := Decode(comp, tc.postfilter)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if dec == nil {
+				t.Fatalf("Decode returned nil image")
+			}
+			if got, want := dec.Bounds(), src.Bounds(); got != want {
+				t.Fatalf("bounds mismatch: got %v want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestEncoder_EffortRoundTrip(t *testing.T) {
+	for _, src := range []*image.RGBA{makeTestImage(64, 48), makeTestImage(97, 71)} {
+		for _, quality := range []int{10, 50, 70, 90} {
+			var size [EffortSlowest + 1]int
+			var sse [EffortSlowest + 1]float64
+			for effort := EffortFastest; effort <= EffortSlowest; effort++ {
+				enc := NewEncoder()
+				enc.Effort = effort
+				comp, err := enc.Encode(src, quality, false)
+				if err != nil {
+					t.Fatalf("effort=%d q=%d: Encode: %v", effort, quality, err)
+				}
+				dec, err := NewDecoder().Decode(comp, false)
+				if err != nil {
+					t.Fatalf("effort=%d q=%d: Decode: %v", effort, quality, err)
+				}
+				if got, want := dec.Bounds(), src.Bounds(); got != want {
+					t.Fatalf("effort=%d q=%d: bounds mismatch: got %v want %v", effort, quality, got, want)
+				}
+				size[effort], sse[effort] = len(comp), rgbSSE(src, dec)
+			}
+			// The zstd level and the parameter trials only ever shrink the
+			// file; a trial winner must not exceed the default error.
+			for effort := effortBestZstd; effort <= effortTrials; effort++ {
+				if size[effort] > size[effort-1] {
+					t.Errorf("%v q=%d: effort %d gives %d bytes, effort %d %d", src.Bounds().Size(), quality, effort, size[effort], effort-1, size[effort-1])
+				}
+			}
+			if sse[effortTrials] > sse[effortBestZstd] {
+				t.Errorf("%v q=%d: trial error %.0f exceeds the default %.0f", src.Bounds().Size(), quality, sse[effortTrials], sse[effortBestZstd])
+			}
+		}
+	}
+
+	// On photo-like content the RD decisions must pay off: files no larger
+	// than the spread heuristic gives, for at most slightly more error. (At
+	// the lowest qualities RD may spend a little more for a lower error.)
+	photo := makePhotoImage(96, 72)
+	for _, quality := range []int{30, 50, 70, 90} {
+		var size [2]int
+		var sse [2]float64
+		for i, effort := range []int{EffortFastest, effortRD} {
+			enc := NewEncoder()
+			enc.Effort = effort
+			comp, err := enc.Encode(photo, quality, false)
+			if err != nil {
+				t.Fatalf("effort=%d q=%d: Encode: %v", effort, quality, err)
+			}
+			dec, err := NewDecoder().Decode(comp, false)
+			if err != nil {
+				t.Fatalf("effort=%d q=%d: Decode: %v", effort, quality, err)
+			}
+			size[i], sse[i] = len(comp), rgbSSE(photo, dec)
+		}
+		if size[1] > size[0] {
+			t.Errorf("q=%d: RD size %d, want <= %d", quality, size[1], size[0])
+		}
+		if sse[1] > sse[0]*1.1 {
+			t.Errorf("q=%d: RD error %.0f, want <= %.0f", quality, sse[1], sse[0]*1.1)
+		}
+	}
+}
+
+func TestEncoder_QuadtreeRoundTrip(t *testing.T) {
+	// Odd sizes make root blocks cross the coded area and split implicitly.
+	src := makeTestImage(67, 45)
+
+	for _, root := range []int{4, 32} {
+		for _, effort := range []int{EffortFastest, effortThresholds} {
+			for _, quality := range []int{10, 70, 90} {
+				enc := NewEncoder()
+				enc.Effort = effort
+				enc.RootBlock = root
+				comp, err := enc.Encode(src, quality, false)
+				if err != nil {
+					t.Fatalf("root=%d effort=%d q=%d: Encode: %v", root, effort, quality, err)
+				}
+				dec, err := Decode(comp, false)
+				if err != nil {
+					t.Fatalf("root=%d effort=%d q=%d: Decode: %v", root, effort, quality, err)
+				}
+				if got, want := dec.Bounds(), src.Bounds(); got != want {
+					t.Fatalf("root=%d effort=%d q=%d: bounds mismatch: got %v want %v", root, effort, quality, got, want)
+				}
+			}
+		}
+	}
+
+	// Flat 16x16 tiles are coded exactly by mid-size leaves and beat the
+	// two-level layout.
+	flat := image.NewGray(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			flat.Pix[y*flat.Stride+x] = uint8((x/16)*40 + (y/16)*20)
+		}
+	}
+	enc := NewEncoder()
+	legacy, err := enc.Encode(flat, 90, true)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	legacySize := len(legacy)
+	enc.RootBlock = 32
+	comp, err := enc.Encode(flat, 90, true)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if len(comp) >= legacySize {
+		t.Errorf("quadtree size %d, want < %d", len(comp), legacySize)
+	}
+	dec, err := NewDecoder().Decode(comp, false)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			if got, want := dec.Pix[y*dec.Stride+x*4], flat.Pix[y*flat.Stride+x]; got != want {
+				t.Fatalf("pixel (%d,%d) = %d, want %d", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestEncoder_RectBlocks(t *testing.T) {
+	src := makeTestImage(67, 45)
+	for _, effort := range []int{EffortFastest, effortThresholds} {
+		for _, quality := range []int{10, 70, 90} {
+			enc := NewEncoder()
+			enc.Effort = effort
+			enc.RectBlocks = true
+			comp, err := enc.Encode(src, quality, false)
+			if err != nil {
+				t.Fatalf("effort=%d q=%d: Encode: %v", effort, quality, err)
+			}
+			if _, err := Decode(comp, false); err != nil {
+				t.Fatalf("effort=%d q=%d: Decode: %v", effort, quality, err)
+			}
+		}
+	}
+
+	// One-pixel horizontal stripes: row-shaped leaves code them exactly,
+	// while square blocks have to go down to single pixels.
+	stripes := image.NewGray(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			stripes.Pix[y*stripes.Stride+x] = uint8(y * 4)
+		}
+	}
+	enc := NewEncoder()
+	enc.Effort = effortRD
+	enc.RootBlock = 32
+	comp, err := enc.Encode(stripes, 90, true)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	squareSize := len(comp)
+	enc.RectBlocks = true
+	comp, err = enc.Encode(stripes, 90, true)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if len(comp) >= squareSize {
+		t.Errorf("rectangular size %d, want < %d", len(comp), squareSize)
+	}
+	dec, err := NewDecoder().Decode(comp, false)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	for y := 0; y < 64; y++ {
+		if got, want := dec.Pix[y*dec.Stride], stripes.Pix[y*stripes.Stride]; got != want {
+			t.Fatalf("row %d = %d, want %d", y, got, want)
+		}
+	}
+}
+
+func TestFitBlockMethods(t *testing.T) {
+	// Skewed bimodal block: the mean threshold lands inside the large mode.
+	vals := []uint8{10, 12, 14, 16, 18, 20, 22, 24, 26, 28, 30, 32, 200, 210, 220, 230}
+
+	ambtc := fitBlockAMBTC(vals)
+	for name, f := range map[string]blockFit{
+		"otsu":    fitBlockOtsu(vals),
+		"2means":  fitBlock2Means(vals),
+		"best":    fitBlockBest(vals, 0),
+		"default": fitBlockSearch(vals, 0),
+	} {
+		if got, limit := f.sse(vals), ambtc.sse(vals); got > limit {
+			t.Errorf("%s: sse %.0f exceeds AMBTC %.0f", name, got, limit)
+		}
+	}
+
+	// Moment preserving keeps the block mean (up to level rounding).
+	m := fitBlockMoment(vals)
+	var sum, rec float64
+	for _, v := range vals {
+		sum += float64(v)
+		if v >= m.thr {
+			rec += float64(m.fg)
+		} else {
+			rec += float64(m.bg)
+		}
+	}
+	if d := math.Abs(sum-rec) / float64(len(vals)); d > 0.5 {
+		t.Errorf("moment preserving mean drift %.2f", d)
+	}
+
+	src := makeTestImage(64, 48)
+	for method := BlockMethodDefault; method <= BlockMethodBest; method++ {
+		enc := NewEncoder()
+		enc.BlockMethod = method
+		comp, err := enc.Encode(src, 50, false)
+		if err != nil {
+			t.Fatalf("method=%d: Encode: %v", method, err)
+		}
+		if _, err := Decode(comp, false); err != nil {
+			t.Fatalf("method=%d: Decode: %v", method, err)
+		}
+	}
+}
+
+func TestEncoder_Palette(t *testing.T) {
+	src := makeTestImage(67, 45)
+	for _, size := range []int{1, 16, 256} {
+		for _, bw := range []bool{false, true} {
+			enc := NewEncoder()
+			enc.PaletteSize = size
+			comp, err := enc.Encode(src, 70, bw)
+			if err != nil {
+				t.Fatalf("size=%d bw=%v: Encode: %v", size, bw, err)
+			}
+			if _, err := Decode(comp, false); err != nil {
+				t.Fatalf("size=%d bw=%v: Decode: %v", size, bw, err)
+			}
+		}
+	}
+
+	// A flat-shaded UI-like image has few tones: the palette keeps them
+	// exactly and shrinks the file.
+	ui := image.NewRGBA(image.Rect(0, 0, 96, 64))
+	colors := []color.RGBA{{240, 240, 240, 255}, {30, 120, 200, 255}, {200, 40, 40, 255}, {20, 20, 20, 255}}
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 96; x++ {
+			ui.SetRGBA(x, y, colors[((x/12)+(y/16)*3)%len(colors)])
+		}
+	}
+	enc := NewEncoder()
+	enc.RootBlock = 16
+	comp, err := enc.Encode(ui, 90, false)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	plainSize := len(comp)
+	want, err := NewDecoder().Decode(comp, false)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	wantPix := append([]byte(nil), want.Pix...)
+
+	enc.PaletteSize = 256
+	comp, err = enc.Encode(ui, 90, false)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if len(comp) >= plainSize {
+		t.Errorf("palette size %d, want < %d", len(comp), plainSize)
+	}
+	got, err := NewDecoder().Decode(comp, false)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !bytes.Equal(got.Pix, wantPix) {
+		t.Errorf("palette decode differs from per-channel decode")
+	}
+}
+
+func TestEncoder_Joint(t *testing.T) {
+	src := makeTestImage(67, 45)
+	for _, effort := range []int{EffortFastest, effortThresholds} {
+		for _, bw := range []bool{false, true} {
+			enc := NewEncoder()
+			enc.Joint = true
+			enc.Effort = effort
+			comp, err := enc.Encode(src, 70, bw)
+			if err != nil {
+				t.Fatalf("effort=%d bw=%v: Encode: %v", effort, bw, err)
+			}
+			if _, err := Decode(comp, false); err != nil {
+				t.Fatalf("effort=%d bw=%v: Decode: %v", effort, bw, err)
+			}
+		}
+	}
+
+	// Two-colour detail: every channel shares the same pattern, so the joint
+	// layout stores it once instead of three times.
+	img := image.NewRGBA(image.Rect(0, 0, 96, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 96; x++ {
+			c := color.RGBA{250, 230, 60, 255}
+			if (x*7+y*13)%11 < 5 {
+				c = color.RGBA{20, 40, 160, 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	enc := NewEncoder()
+	enc.RootBlock = 16
+	comp, err := enc.Encode(img, 90, false)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	plainSize := len(comp)
+	want, err := NewDecoder().Decode(comp, false)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	wantPix := append([]byte(nil), want.Pix...)
+
+	enc.Joint = true
+	comp, err = enc.Encode(img, 90, false)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if len(comp) >= plainSize {
+		t.Errorf("joint size %d, want < %d", len(comp), plainSize)
+	}
+	got, err := NewDecoder().Decode(comp, false)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !bytes.Equal(got.Pix, wantPix) {
+		t.Errorf("joint decode differs from per-channel decode")
+	}
+}
+
+func TestEncoder_Predict(t *testing.T) {
+	// A smooth 2D gradient: neighbouring blocks predict each other well,
+	// while the coding order jumps between rows of blocks.
+	img := image.NewRGBA(image.Rect(0, 0, 131, 77))
+	for y := 0; y < 77; y++ {
+		for x := 0; x < 131; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x + y), uint8(2 * y), uint8(255 - x), 255})
+		}
+	}
+	for _, joint := range []bool{false, true} {
+		enc := NewEncoder()
+		enc.RootBlock = 16
+		enc.Joint = joint
+		comp, err := enc.Encode(img, 90, false)
+		if err != nil {
+			t.Fatalf("joint=%v: Encode: %v", joint, err)
+		}
+		plainSize := len(comp)
+		want, err := NewDecoder().Decode(comp, false)
+		if err != nil {
+			t.Fatalf("joint=%v: Decode: %v", joint, err)
+		}
+		wantPix := append([]byte(nil), want.Pix...)
+
+		enc.Predict = true
+		comp, err = enc.Encode(img, 90, false)
+		if err != nil {
+			t.Fatalf("joint=%v: Encode: %v", joint, err)
+		}
+		if len(comp) >= plainSize {
+			t.Errorf("joint=%v: predicted size %d, want < %d", joint, len(comp), plainSize)
+		}
+		got, err := NewDecoder().Decode(comp, false)
+		if err != nil {
+			t.Fatalf("joint=%v: Decode: %v", joint, err)
+		}
+		if !bytes.Equal(got.Pix, wantPix) {
+			t.Errorf("joint=%v: predicted decode differs", joint)
+		}
+	}
+}
+
+func TestEncoder_Lossless(t *testing.T) {
+	const w, h = 45, 29
+	rgba := makeTestImage(w, h)
+	nrgba := image.NewNRGBA(rgba.Bounds())
+	gray := image.NewGray(rgba.Bounds())
+	ycc := image.NewYCbCr(rgba.Bounds(), image.YCbCrSubsampleRatio420)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := rgba.RGBAAt(x, y)
+			nrgba.SetNRGBA(x, y, color.NRGBA{c.R, c.G, c.B, 255})
+			gray.SetGray(x, y, color.Gray{c.G})
+		}
+	}
+	for i := range ycc.Y {
+		ycc.Y[i] = uint8(i * 7)
+	}
+	for i := range ycc.Cb {
+		ycc.Cb[i] = uint8(i * 3)
+		ycc.Cr[i] = uint8(255 - i*5)
+	}
+
+	images := map[string]image.Image{"RGBA": rgba, "NRGBA": nrgba, "Gray": gray, "YCbCr": ycc}
+	for name, src := range images {
+		for _, effort := range []int{EffortFastest, effortThresholds} {
+			enc := NewEncoder()
+			enc.Lossless = true
+			enc.Effort = effort
+			comp, err := enc.Encode(src, 10, false)
+			if err != nil {
+				t.Fatalf("%s effort=%d: Encode: %v", name, effort, err)
+			}
+			got, err := NewDecoder().Decode(comp, false)
+			if err != nil {
+				t.Fatalf("%s effort=%d: Decode: %v", name, effort, err)
+			}
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					want := color.RGBAModel.Convert(src.At(x, y)).(color.RGBA)
+					if c := got.RGBAAt(x, y); c != want {
+						t.Fatalf("%s effort=%d: pixel (%d,%d) = %v, want %v", name, effort, x, y, c, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncoder_MaxError(t *testing.T) {
+	src := makeTestImage(53, 37)
+	enc := NewEncoder()
+	enc.Lossless = true
+	comp, err := enc.Encode(src, 70, false)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	losslessSize := len(comp)
+
+	for _, maxErr := range []int{1, 4, 16} {
+		for _, effort := range []int{EffortFastest, effortThresholds} {
+			enc := NewEncoder()
+			enc.MaxError = maxErr
+			enc.Effort = effort
+			comp, err := enc.Encode(src, 70, false)
+			if err != nil {
+				t.Fatalf("max=%d effort=%d: Encode: %v", maxErr, effort, err)
+			}
+			if maxErr == 16 && len(comp) >= losslessSize {
+				t.Errorf("max=%d effort=%d: size %d, want < lossless %d", maxErr, effort, len(comp), losslessSize)
+			}
+			got, err := NewDecoder().Decode(comp, false)
+			if err != nil {
+				t.Fatalf("max=%d effort=%d: Decode: %v", maxErr, effort, err)
+			}
+			worst := 0
+			for i := 0; i < len(src.Pix); i += 4 {
+				for c := range 3 {
+					d := int(src.Pix[i+c]) - int(got.Pix[i+c])
+					worst = max(worst, d, -d)
+				}
+			}
+			if worst > maxErr {
+				t.Errorf("max=%d effort=%d: pixel error %d", maxErr, effort, worst)
+			}
+		}
+	}
+}
+
+func TestEncoder_Residual(t *testing.T) {
+	src := makeTestImage(53, 37)
+	for _, bw := range []bool{false, true} {
+		enc := NewEncoder()
+		comp, err := enc.Encode(src, 30, bw)
+		if err != nil {
+			t.Fatalf("bw=%v: Encode: %v", bw, err)
+		}
+		base, err := NewDecoder().Decode(comp, false)
+		if err != nil {
+			t.Fatalf("bw=%v: Decode: %v", bw, err)
+		}
+		basePix := append([]byte(nil), base.Pix...)
+
+		for _, step := range []int{1, 8} {
+			enc.ResidualStep = step
+			comp, err := enc.Encode(src, 30, bw)
+			if err != nil {
+				t.Fatalf("bw=%v step=%d: Encode: %v", bw, step, err)
+			}
+			dec := NewDecoder()
+			dec.SkipResidual = true
+			got, err := dec.Decode(comp, false)
+			if err != nil {
+				t.Fatalf("bw=%v step=%d: Decode base: %v", bw, step, err)
+			}
+			if !bytes.Equal(got.Pix, basePix) {
+				t.Errorf("bw=%v step=%d: base layer differs from a plain encode", bw, step)
+			}
+
+			got, err = NewDecoder().Decode(comp, false)
+			if err != nil {
+				t.Fatalf("bw=%v step=%d: Decode: %v", bw, step, err)
+			}
+			if bw {
+				continue
+			}
+			worst := 0
+			for i := 0; i < len(src.Pix); i += 4 {
+				for c := range 3 {
+					d := int(src.Pix[i+c]) - int(got.Pix[i+c])
+					worst = max(worst, d, -d)
+				}
+			}
+			if worst > step/2 {
+				t.Errorf("step=%d: pixel error %d, want <= %d", step, worst, step/2)
+			}
+		}
+	}
+}
+
+func TestEncoder_Gradients(t *testing.T) {
+	// A smooth ramp bands with flat blocks; gradient blocks follow it.
+	img := image.NewRGBA(image.Rect(0, 0, 128, 96))
+	for y := 0; y < 96; y++ {
+		for x := 0; x < 128; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(60 + x), uint8(100 + y/2), uint8(200 - x/2 - y/3), 255})
+		}
+	}
+	sse := func(dec *image.RGBA) float64 {
+		var sum float64
+		for i := 0; i < len(img.Pix); i += 4 {
+			for c := range 3 {
+				d := float64(img.Pix[i+c]) - float64(dec.Pix[i+c])
+				sum += d * d
+			}
+		}
+		return sum
+	}
+	for _, effort := range []int{EffortFastest, effortThresholds} {
+		for _, predict := range []bool{false, true} {
+			var sizes [2]int
+			var errs [2]float64
+			for i, gradients := range []bool{false, true} {
+				enc := NewEncoder()
+				enc.RootBlock = 16
+				enc.Effort = effort
+				enc.Predict = predict
+				enc.Gradients = gradients
+				comp, err := enc.Encode(img, 10, false)
+				if err != nil {
+					t.Fatalf("effort=%d: Encode: %v", effort, err)
+				}
+				dec, err := NewDecoder().Decode(comp, false)
+				if err != nil {
+					t.Fatalf("effort=%d: Decode: %v", effort, err)
+				}
+				sizes[i], errs[i] = len(comp), sse(dec)
+			}
+			if errs[1] >= errs[0] {
+				t.Errorf("effort=%d predict=%v: gradient error %.0f, want < %.0f", effort, predict, errs[1], errs[0])
+			}
+			if effort == EffortFastest && sizes[1] >= sizes[0] {
+				t.Errorf("predict=%v: gradient size %d, want < %d", predict, sizes[1], sizes[0])
+			}
+		}
+	}
+}
+
+func TestEncoder_MultiLevel(t *testing.T) {
+	// A texture of four levels needs four tones per block.
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	levels := [4]uint8{20, 90, 160, 230}
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			v := levels[(x*7+y*13+x*y)%4]
+			img.SetRGBA(x, y, color.RGBA{v, v, 255 - v, 255})
+		}
+	}
+	check := func(name string, enc *Encoder, maxErr int) (int, int) {
+		t.Helper()
+		comp, err := enc.Encode(img, 70, false)
+		if err != nil {
+			t.Fatalf("%s: Encode: %v", name, err)
+		}
+		dec, err := NewDecoder().Decode(comp, false)
+		if err != nil {
+			t.Fatalf("%s: Decode: %v", name, err)
+		}
+		worst := 0
+		for i := 0; i < len(img.Pix); i += 4 {
+			for c := range 3 {
+				d := int(img.Pix[i+c]) - int(dec.Pix[i+c])
+				worst = max(worst, d, -d)
+			}
+		}
+		if maxErr >= 0 && worst > maxErr {
+			t.Errorf("%s: max error %d, want <= %d", name, worst, maxErr)
+		}
+		return len(comp), worst
+	}
+
+	for _, predict := range []bool{false, true} {
+		for _, gradients := range []bool{false, true} {
+			var sizes, errs [2]int
+			for i, multi := range []bool{false, true} {
+				enc := NewEncoder()
+				enc.Effort = effortRD
+				enc.RootBlock = 16
+				enc.Predict = predict
+				enc.Gradients = gradients
+				enc.MultiLevel = multi
+				name := fmt.Sprintf("predict=%v gradients=%v multi=%v", predict, gradients, multi)
+				sizes[i], errs[i] = check(name, enc, -1)
+			}
+			if sizes[1] >= sizes[0] || errs[1] > errs[0] {
+				t.Errorf("predict=%v gradients=%v: multi-level gave %d bytes, max error %d; without %d bytes, %d",
+					predict, gradients, sizes[1], errs[1], sizes[0], errs[0])
+			}
+		}
+	}
+
+	enc := NewEncoder()
+	enc.Effort = effortRD
+	enc.MaxError = 4
+	enc.MultiLevel = true
+	check("maxerr", enc, 4)
+}
+
+func TestEncoder_BlockCopy(t *testing.T) {
+	// Lines of repeated glyphs at a pitch that does not match the blocks.
+	img := image.NewRGBA(image.Rect(0, 0, 160, 96))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	glyphs := [4][5]uint8{
+		{0x0e, 0x11, 0x1f, 0x11, 0x11},
+		{0x1e, 0x11, 0x1e, 0x11, 0x1e},
+		{0x0f, 0x10, 0x10, 0x10, 0x0f},
+		{0x11, 0x1b, 0x15, 0x11, 0x11},
+	}
+	for line := 0; line < 10; line++ {
+		for k := 0; k < 25; k++ {
+			g := glyphs[(k*k+line)%4]
+			for y, bits := range g {
+				for x := 0; x < 5; x++ {
+					if bits&(0x10>>x) != 0 {
+						img.SetRGBA(3+k*6+x, 2+line*9+y, color.RGBA{20, 40, 160, 255})
+					}
+				}
+			}
+		}
+	}
+
+	for _, lossless := range []bool{false, true} {
+		for _, predict := range []bool{false, true} {
+			var sizes [2]int
+			for i, blockCopy := range []bool{false, true} {
+				enc := NewEncoder()
+				enc.Effort = effortRD
+				enc.RootBlock = 16
+				enc.Lossless = lossless
+				enc.Predict = predict
+				enc.BlockCopy = blockCopy
+				comp, err := enc.Encode(img, 90, false)
+				if err != nil {
+					t.Fatalf("Encode: %v", err)
+				}
+				dec, err := NewDecoder().Decode(comp, false)
+				if err != nil {
+					t.Fatalf("lossless=%v predict=%v copy=%v: Decode: %v", lossless, predict, blockCopy, err)
+				}
+				if lossless && !bytes.Equal(dec.Pix, img.Pix) {
+					t.Errorf("predict=%v copy=%v: lossless round trip differs", predict, blockCopy)
+				}
+				sizes[i] = len(comp)
+			}
+			if sizes[1] >= sizes[0] {
+				t.Errorf("lossless=%v predict=%v: %d bytes with block copy, want < %d", lossless, predict, sizes[1], sizes[0])
+			}
+		}
+	}
+
+	// Malformed copy streams: displacements that point outside the coded
+	// area, including ones whose source coordinates would overflow.
+	g := treeGeom{small: 1, root: 16, w: 32, h: 32}
+	for _, tc := range []struct {
+		x, y   int
+		dx, dy int
+	}{
+		{0, 0, -(math.MaxInt - 6), 0},
+		{0, 16, -(math.MaxInt - 6), 0},
+		{0, 16, 0, -(math.MaxInt - 6)},
+		{16, 16, 20, 0},
+		{16, 16, 0, -8},
+		{0, 16, 0, 0},
+	} {
+		d := &channelLeafDecoder{
+			pix:         make([]byte, 32*32*4),
+			strideBytes: 32 * 4,
+			g:           g,
+			copies:      binary.AppendUvarint(binary.AppendUvarint(nil, zigzag(tc.dx)), zigzag(tc.dy)),
+		}
+		if err := d.copyLeaf(tc.x, tc.y, 8, 8); err == nil {
+			t.Errorf("copy of (%d,%d) by (%d,%d): no error", tc.x, tc.y, tc.dx, tc.dy)
+		}
+	}
+}
+
+func TestEncoder_ROI(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 128, 96))
+	for y := 0; y < 96; y++ {
+		for x := 0; x < 128; x++ {
+			v := uint8(x*3 + y*2 + (x*y)%29*4)
+			img.SetRGBA(x, y, color.RGBA{v, 255 - v, uint8(x + y), 255})
+		}
+	}
+	// Left half important, right half not.
+	roi := image.NewGray(image.Rect(0, 0, 2, 1))
+	roi.Pix[0] = 255
+	sse := func(dec *image.RGBA, x0, x1 int) float64 {
+		var sum float64
+		for y := 0; y < 96; y++ {
+			for x := x0; x < x1; x++ {
+				i := img.PixOffset(x, y)
+				for c := range 3 {
+					d := float64(img.Pix[i+c]) - float64(dec.Pix[i+c])
+					sum += d * d
+				}
+			}
+		}
+		return sum
+	}
+	for _, effort := range []int{EffortFastest, effortRD} {
+		var left, right [2]float64
+		for i, withROI := range []bool{false, true} {
+			enc := NewEncoder()
+			enc.Effort = effort
+			enc.RootBlock = 16
+			if withROI {
+				enc.ROI = roi
+			}
+			comp, err := enc.Encode(img, 70, false)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			dec, err := NewDecoder().Decode(comp, false)
+			if err != nil {
+				t.Fatalf("effort=%d roi=%v: Decode: %v", effort, withROI, err)
+			}
+			left[i], right[i] = sse(dec, 0, 64), sse(dec, 64, 128)
+		}
+		if left[1] >= left[0] || right[1] <= right[0] {
+			t.Errorf("effort=%d: error left %.0f -> %.0f, right %.0f -> %.0f; want left lower and right higher",
+				effort, left[0], left[1], right[0], right[1])
+		}
+	}
+}
+
+func TestEncoder_Adaptive(t *testing.T) {
+	// Left half a gentle ramp, right half busy texture.
+	img := image.NewRGBA(image.Rect(0, 0, 128, 96))
+	for y := 0; y < 96; y++ {
+		for x := 0; x < 128; x++ {
+			v := uint8(40 + x + y/2)
+			if x >= 64 {
+				v = uint8((x*37 + y*91 + x*y*13) % 251)
+			}
+			img.SetRGBA(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	smoothErr := func(dec *image.RGBA) float64 {
+		var sum float64
+		for y := 0; y < 96; y++ {
+			for x := 0; x < 64; x++ {
+				d := float64(img.Pix[img.PixOffset(x, y)]) - float64(dec.Pix[dec.PixOffset(x, y)])
+				sum += d * d
+			}
+		}
+		return sum
+	}
+	for _, effort := range []int{EffortFastest, effortRD} {
+		var errs [2]float64
+		for i, adaptive := range []bool{false, true} {
+			enc := NewEncoder()
+			enc.Effort = effort
+			enc.RootBlock = 16
+			enc.Adaptive = adaptive
+			comp, err := enc.Encode(img, 70, false)
 			if err != nil {
 				t.Fatalf("Encode: %v", err)
 			}
-			if len(comp) == 0 {
-				t.Fatalf("Encode returned empty payload")
+			dec, err := NewDecoder().Decode(comp, false)
+			if err != nil {
+				t.Fatalf("effort=%d adaptive=%v: Decode: %v", effort, adaptive, err)
 			}
+			errs[i] = smoothErr(dec)
+		}
+		if errs[1] >= errs[0] {
+			t.Errorf("effort=%d: smooth-region error %.0f with Adaptive, want < %.0f", effort, errs[1], errs[0])
+		}
+	}
+}
 
-			dec, err := Decode(comp, tc.postfilter)
+func TestEncoder_ChannelQuality(t *testing.T) {
+	// Odd size: the coded area must cover the small blocks of every channel.
+	img := image.NewRGBA(image.Rect(0, 0, 97, 71))
+	for y := 0; y < 71; y++ {
+		for x := 0; x < 97; x++ {
+			v := uint8(x*3 + y*2 + (x*y)%29*4)
+			img.SetRGBA(x, y, color.RGBA{v, uint8(x*2 + y), uint8(200 - y), 255})
+		}
+	}
+	var sizes [2]int
+	var luma [2][]byte
+	// Both encodings use the block tree so their luma can be compared.
+	_, root := blocksForQuality(70)
+	for i, cq := range []int{0, 20} {
+		enc := NewEncoder()
+		enc.Effort = effortRD
+		enc.RootBlock = root
+		enc.ChannelQuality = [3]int{0, cq, cq}
+		comp, err := enc.Encode(img, 70, false)
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		if got := enc.hdr.features&featChannelGeom != 0; got != (cq > 0) {
+			t.Fatalf("chroma quality %d: featChannelGeom=%v", cq, got)
+		}
+		dec, err := NewDecoder().Decode(comp, false)
+		if err != nil {
+			t.Fatalf("chroma quality %d: Decode: %v", cq, err)
+		}
+		if dec.Bounds() != img.Bounds() {
+			t.Fatalf("chroma quality %d: bounds %v", cq, dec.Bounds())
+		}
+		ycc, err := NewDecoder().DecodeYCbCr(comp)
+		if err != nil {
+			t.Fatalf("chroma quality %d: DecodeYCbCr: %v", cq, err)
+		}
+		luma[i] = ycc.Y
+		// The coarser chroma must still follow the source colours.
+		var sum, n int
+		for y := 0; y < 71; y++ {
+			for x := 0; x < 97; x++ {
+				c := img.RGBAAt(x, y)
+				_, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+				ci := ycc.COffset(x, y)
+				sum += absInt(int(ycc.Cb[ci])-int(cb)) + absInt(int(ycc.Cr[ci])-int(cr))
+				n += 2
+			}
+		}
+		if mean := float64(sum) / float64(n); mean > 8 {
+			t.Errorf("chroma quality %d: mean chroma error %.2f, want <= 8", cq, mean)
+		}
+		sizes[i] = len(comp)
+	}
+	if sizes[1] >= sizes[0] {
+		t.Errorf("%d bytes with chroma quality 20, want < %d", sizes[1], sizes[0])
+	}
+	if !bytes.Equal(luma[0], luma[1]) {
+		t.Error("chroma quality changed the decoded luma")
+	}
+}
+
+func TestEncoder_ChromaFromLuma(t *testing.T) {
+	// Coloured discs: every chroma edge is a luma edge.
+	img := image.NewRGBA(image.Rect(0, 0, 128, 96))
+	colors := []color.RGBA{{200, 40, 40, 255}, {40, 160, 60, 255}, {50, 60, 210, 255}, {230, 200, 40, 255}}
+	for y := 0; y < 96; y++ {
+		for x := 0; x < 128; x++ {
+			c := color.RGBA{240, 240, 235, 255}
+			for i := range 12 {
+				cx, cy := 10+i*37%118, 8+i*53%88
+				if (x-cx)*(x-cx)+(y-cy)*(y-cy) < 90 {
+					c = colors[i%len(colors)]
+				}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	for _, lossless := range []bool{false, true} {
+		var sizes [2]int
+		for i, cfl := range []bool{false, true} {
+			enc := NewEncoder()
+			enc.Effort = effortRD
+			enc.RootBlock = 16
+			enc.Lossless = lossless
+			enc.ChromaFromLuma = cfl
+			comp, err := enc.Encode(img, 70, false)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			dec, err := NewDecoder().Decode(comp, false)
+			if err != nil {
+				t.Fatalf("lossless=%v cfl=%v: Decode: %v", lossless, cfl, err)
+			}
+			if lossless && !bytes.Equal(dec.Pix, img.Pix) {
+				t.Errorf("cfl=%v: lossless round trip differs", cfl)
+			}
+			sizes[i] = len(comp)
+		}
+		if sizes[1] >= sizes[0] {
+			t.Errorf("lossless=%v: %d bytes with chroma from luma, want < %d", lossless, sizes[1], sizes[0])
+		}
+	}
+}
+
+func TestColorSpace_RoundTrip(t *testing.T) {
+	for cs, m := range colorMatrices {
+		bound := 1
+		if cs&ColorLimited != 0 {
+			bound = 2
+		}
+		worst := 0
+		for r := 0; r < 256; r += 5 {
+			for g := 0; g < 256; g += 5 {
+				for b := 0; b < 256; b += 5 {
+					r2, g2, b2 := m.toRGB(m.fromRGB(uint8(r), uint8(g), uint8(b)))
+					worst = max(worst, absInt(r-int(r2)), absInt(g-int(g2)), absInt(b-int(b2)))
+				}
+			}
+		}
+		if worst > bound {
+			t.Errorf("colour space %#x: round-trip error %d, want <= %d", cs, worst, bound)
+		}
+		for v := range 256 {
+			y, c1, c2 := m.fromRGB(uint8(v), uint8(v), uint8(v))
+			if c1 != 128 || c2 != 128 {
+				t.Fatalf("colour space %#x: gray %d has chroma %d,%d", cs, v, c1, c2)
+			}
+			if r, g, b := m.toRGB(y, 128, 128); cs&ColorLimited == 0 && (r != uint8(v) || g != r || b != r) {
+				t.Fatalf("colour space %#x: gray %d decodes to %d,%d,%d", cs, v, r, g, b)
+			}
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 48, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 48; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 5), uint8(y * 7), uint8(255 - x*3), 255})
+		}
+	}
+	for _, cs := range []int{ColorBT601, ColorBT709 | ColorLimited, ColorBT2020, ColorYCoCg, ColorYCoCgR, ColorRGB} {
+		enc := NewEncoder()
+		enc.ColorSpace = cs
+		comp, err := enc.Encode(img, 100, false)
+		if err != nil {
+			t.Fatalf("colour space %#x: Encode: %v", cs, err)
+		}
+		dec, err := NewDecoder().Decode(comp, false)
+		if err != nil {
+			t.Fatalf("colour space %#x: Decode: %v", cs, err)
+		}
+		worst := 0
+		for i := 0; i < len(img.Pix); i += 4 {
+			for c := range 3 {
+				worst = max(worst, absInt(int(img.Pix[i+c])-int(dec.Pix[i+c])))
+			}
+		}
+		if worst > 8 {
+			t.Errorf("colour space %#x: max error %d at quality 100", cs, worst)
+		}
+	}
+	enc := NewEncoder()
+	enc.ColorSpace = ColorRGB | ColorLimited
+	if _, err := enc.Encode(img, 70, false); err == nil {
+		t.Errorf("Encode accepted colour space %#x", enc.ColorSpace)
+	}
+}
+
+func TestEncoder_LinearLight(t *testing.T) {
+	for _, lut := range []*transferLUT{srgbFull, srgbLimited} {
+		for v := range 256 {
+			if got := lut.fromLinear(lut.lin[v]); got != uint8(v) {
+				t.Fatalf("fromLinear(lin[%d]) = %d", v, got)
+			}
+		}
+	}
+	// Thin antialiased strokes on white: coarse blocks average them, and plain
+	// means of gamma-encoded values come out too dark.
+	img := image.NewGray(image.Rect(0, 0, 128, 96))
+	for y := 0; y < 96; y++ {
+		for x := 0; x < 128; x++ {
+			v := uint8(235)
+			switch (x + y/3) % 4 {
+			case 0:
+				v = 30
+			case 1:
+				v = 130 // antialiasing
+			}
+			img.SetGray(x, y, color.Gray{v})
+		}
+	}
+	var src float64
+	for _, v := range img.Pix {
+		src += float64(srgbFull.lin[v])
+	}
+	src /= float64(len(img.Pix))
+
+	for _, root := range []int{0, 16} {
+		var errs [2]float64
+		for i, lin := range []bool{false, true} {
+			enc := NewEncoder()
+			enc.RootBlock = root
+			enc.LinearLight = lin
+			comp, err := enc.Encode(img, 10, false)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			dec, err := NewDecoder().Decode(comp, false)
 			if err != nil {
 				t.Fatalf("Decode: %v", err)
 			}
-			if dec == nil {
-				t.Fatalf("Decode returned nil image")
+			var got float64
+			for p := 0; p < len(dec.Pix); p += 4 {
+				got += float64(srgbFull.lin[dec.Pix[p]])
 			}
-			if got, want := dec.Bounds(), src.Bounds(); got != want {
-				t.Fatalf("bounds mismatch: got %v want %v", got, want)
+			got /= float64(len(dec.Pix) / 4)
+			errs[i] = math.Abs(got - src)
+		}
+		if errs[1] >= errs[0] || errs[1] > 0.001*65535 {
+			t.Errorf("root %d: mean linear-light error %.0f with LinearLight, %.0f without", root, errs[1], errs[0])
+		}
+	}
+}
+
+// testICCProfile builds a matrix/TRC profile with the given colorants (as
+// columns; nil for a gray profile) and the sRGB tone curve.
+func testICCProfile(colorants *[3][3]float64) []byte {
+	fixed := func(b []byte, v float64) []byte {
+		return binary.BigEndian.AppendUint32(b, uint32(int32(math.Round(v*65536))))
+	}
+	trc := []byte("para\x00\x00\x00\x00\x00\x03\x00\x00")
+	for _, v := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		trc = fixed(trc, v)
+	}
+	type tag struct {
+		sig  string
+		data []byte
+	}
+	tags := []tag{{"kTRC", trc}}
+	cs := "GRAY"
+	if colorants != nil {
+		cs = "RGB "
+		tags = []tag{{"rTRC", trc}, {"gTRC", trc}, {"bTRC", trc}}
+		for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+			xyz := []byte("XYZ \x00\x00\x00\x00")
+			for j := range 3 {
+				xyz = fixed(xyz, colorants[j][i])
 			}
-		})
+			tags = append(tags, tag{sig, xyz})
+		}
+	}
+
+	p := make([]byte, iccHeaderSize)
+	copy(p[12:], "mntr"+cs+"XYZ ")
+	copy(p[36:], "acsp")
+	p = binary.BigEndian.AppendUint32(p, uint32(len(tags)))
+	off := len(p) + 12*len(tags)
+	var body []byte
+	for _, t := range tags {
+		p = append(p, t.sig...)
+		p = binary.BigEndian.AppendUint32(p, uint32(off+len(body)))
+		p = binary.BigEndian.AppendUint32(p, uint32(len(t.data)))
+		body = append(body, t.data...)
+	}
+	p = append(p, body...)
+	binary.BigEndian.PutUint32(p, uint32(len(p)))
+	return p
+}
+
+func TestICC_ToSRGB(t *testing.T) {
+	displayP3 := [3][3]float64{
+		{0.515121, 0.291977, 0.157104},
+		{0.241196, 0.692245, 0.066574},
+		{-0.001053, 0.041885, 0.784073},
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), uint8(255 - x*2), 255})
+		}
+	}
+	convert := func(profile []byte, src *image.RGBA) *image.RGBA {
+		p, err := ParseICC(profile)
+		if err != nil {
+			t.Fatalf("ParseICC: %v", err)
+		}
+		dst := image.NewRGBA(src.Bounds())
+		copy(dst.Pix, src.Pix)
+		p.ToSRGB(dst)
+		return dst
+	}
+
+	// An sRGB or gray profile leaves sRGB values alone.
+	srgb := convert(testICCProfile(&srgbToXYZ), img)
+	if d := maxPixDiff(srgb.Pix, img.Pix); d > 1 {
+		t.Errorf("sRGB profile: max change %d, want <= 1", d)
+	}
+	gray := image.NewRGBA(image.Rect(0, 0, 256, 1))
+	for x := range 256 {
+		gray.SetRGBA(x, 0, color.RGBA{uint8(x), uint8(x), uint8(x), 255})
+	}
+	if d := maxPixDiff(convert(testICCProfile(nil), gray).Pix, gray.Pix); d > 1 {
+		t.Errorf("gray profile: max change %d, want <= 1", d)
+	}
+
+	// Display P3 keeps white and grays, and its saturated red lies outside
+	// sRGB.
+	p3 := testICCProfile(&displayP3)
+	if d := maxPixDiff(convert(p3, gray).Pix, gray.Pix); d > 2 {
+		t.Errorf("Display P3 grays: max change %d, want <= 2", d)
+	}
+	red := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	red.SetRGBA(0, 0, color.RGBA{255, 0, 0, 255})
+	if c := convert(p3, red).RGBAAt(0, 0); c.R != 255 || c.G > 0 || c.B > 0 {
+		t.Errorf("Display P3 red: got %v, want clipped sRGB red", c)
+	}
+
+	// The profile travels through the stream; ToSRGB converts on decode.
+	enc := NewEncoder()
+	enc.Profile = p3
+	comp, err := enc.Encode(img, 100, false)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	dec := NewDecoder()
+	base, err := dec.Decode(comp, false)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !bytes.Equal(dec.Profile(), p3) {
+		t.Errorf("Profile: stream does not carry the source profile")
+	}
+	want := convert(p3, base)
+	dec.ToSRGB = true
+	got, err := dec.Decode(comp, false)
+	if err != nil {
+		t.Fatalf("Decode with ToSRGB: %v", err)
+	}
+	if !bytes.Equal(got.Pix, want.Pix) {
+		t.Errorf("ToSRGB: decoded pixels differ from converting the stored ones")
+	}
+
+	// Profiles embedded in PNG and JPEG files.
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	file, err := embedPNGICC(buf.Bytes(), p3)
+	if err != nil {
+		t.Fatalf("embedPNGICC: %v", err)
+	}
+	if _, err := png.Decode(bytes.NewReader(file)); err != nil {
+		t.Fatalf("PNG with iCCP: %v", err)
+	}
+	jpg := []byte{0xFF, 0xD8}
+	for i, part := range [][]byte{p3[:100], p3[100:]} {
+		seg := append([]byte("ICC_PROFILE\x00"), byte(i+1), 2)
+		seg = append(seg, part...)
+		jpg = append(jpg, 0xFF, 0xE2)
+		jpg = binary.BigEndian.AppendUint16(jpg, uint16(len(seg)+2))
+		jpg = append(jpg, seg...)
+	}
+	jpg = append(jpg, 0xFF, 0xD9)
+	for name, f := range map[string][]byte{"PNG": file, "JPEG": jpg} {
+		got, err := ExtractICC(f)
+		if err != nil || !bytes.Equal(got, p3) {
+			t.Errorf("ExtractICC(%s): %d bytes, %v", name, len(got), err)
+		}
+	}
+}
+
+func maxPixDiff(a, b []byte) int {
+	worst := 0
+	for i := range a {
+		worst = max(worst, absInt(int(a[i])-int(b[i])))
+	}
+	return worst
+}
+
+func TestDecoder_NativeTypes(t *testing.T) {
+	img := makeTestImage(70, 45)
+	for _, cs := range []int{ColorBT601, ColorBT709 | ColorLimited} {
+		enc := NewEncoder()
+		enc.ColorSpace = cs
+		for _, bw := range []bool{false, true} {
+			comp, err := enc.Encode(img, 80, bw)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			rgba, err := NewDecoder().Decode(comp, false)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+
+			out, err := NewDecoder().DecodeImage(comp, false)
+			if err != nil {
+				t.Fatalf("DecodeImage: %v", err)
+			}
+			switch out := out.(type) {
+			case *image.Gray:
+				if !bw {
+					t.Fatalf("colour space %#x: DecodeImage returned *image.Gray for a colour stream", cs)
+				}
+				for i, v := range out.Pix {
+					if v != rgba.Pix[i*4] {
+						t.Fatalf("colour space %#x: gray pixel %d = %d, want %d", cs, i, v, rgba.Pix[i*4])
+					}
+				}
+			case *image.RGBA:
+				if bw {
+					t.Fatalf("colour space %#x: DecodeImage returned *image.RGBA for a luma-only stream", cs)
+				}
+				if !bytes.Equal(out.Pix, rgba.Pix) {
+					t.Errorf("colour space %#x: DecodeImage differs from Decode", cs)
+				}
+			default:
+				t.Fatalf("DecodeImage returned %T", out)
+			}
+
+			ycc, err := NewDecoder().DecodeYCbCr(comp)
+			if err != nil {
+				t.Fatalf("DecodeYCbCr: %v", err)
+			}
+			if ycc.SubsampleRatio != image.YCbCrSubsampleRatio444 || ycc.Rect != rgba.Rect {
+				t.Fatalf("DecodeYCbCr: %v %v", ycc.SubsampleRatio, ycc.Rect)
+			}
+			worst := 0
+			for y := range 45 {
+				for x := range 70 {
+					c := ycc.YCbCrAt(x, y)
+					r, g, b := color.YCbCrToRGB(c.Y, c.Cb, c.Cr)
+					p := rgba.RGBAAt(x, y)
+					worst = max(worst, absInt(int(r)-int(p.R)), absInt(int(g)-int(p.G)), absInt(int(b)-int(p.B)))
+				}
+			}
+			if worst > 2 {
+				t.Errorf("colour space %#x bw=%v: DecodeYCbCr differs from Decode by %d", cs, bw, worst)
+			}
+		}
+	}
+}
+
+func TestDecoder_DecodeInto(t *testing.T) {
+	img := makeTestImage(61, 37)
+	for _, cfg := range []func(*Encoder){
+		func(*Encoder) {},
+		func(e *Encoder) { e.RootBlock = 16; e.Predict = true },
+		func(e *Encoder) { e.PaletteSize = 32 },
+		func(e *Encoder) { e.ResidualStep = 4 },
+	} {
+		enc := NewEncoder()
+		cfg(enc)
+		comp, err := enc.Encode(img, 70, false)
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		want, err := NewDecoder().Decode(comp, false)
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+
+		canvas := image.NewRGBA(image.Rect(-10, -5, 90, 60))
+		for i := range canvas.Pix {
+			canvas.Pix[i] = 7
+		}
+		at := image.Pt(20, 11)
+		d := NewDecoder()
+		d.Parallel = false
+		if err := d.DecodeInto(canvas, at, comp); err != nil {
+			t.Fatalf("DecodeInto: %v", err)
+		}
+		r := want.Rect.Add(at)
+		for y := canvas.Rect.Min.Y; y < canvas.Rect.Max.Y; y++ {
+			for x := canvas.Rect.Min.X; x < canvas.Rect.Max.X; x++ {
+				got := canvas.RGBAAt(x, y)
+				if image.Pt(x, y).In(r) {
+					if w := want.RGBAAt(x-at.X, y-at.Y); got != w {
+						t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got, w)
+					}
+				} else if got != (color.RGBA{7, 7, 7, 7}) {
+					t.Fatalf("pixel (%d,%d) outside the image changed to %v", x, y, got)
+				}
+			}
+		}
+
+		if n := testing.AllocsPerRun(5, func() {
+			if err := d.DecodeInto(canvas, at, comp); err != nil {
+				t.Fatalf("DecodeInto: %v", err)
+			}
+		}); n != 0 {
+			t.Errorf("DecodeInto: %v allocations, want 0", n)
+		}
+
+		for _, off := range []image.Point{{-11, 0}, {30, 0}, {0, 24}} {
+			if err := d.DecodeInto(canvas, off, comp); err == nil {
+				t.Errorf("DecodeInto at %v: no error for an image outside the canvas", off)
+			}
+		}
+	}
+
+	// A 0x0 header far outside the canvas.
+	var raw bytes.Buffer
+	bw := bufio.NewWriter(&raw)
+	hdr := streamHeader{small: 2, macro: 8, channels: channelFlagY}
+	if err := hdr.write(bw); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	bw.Flush()
+	empty, err := compressZstd(raw.Bytes())
+	if err != nil {
+		t.Fatalf("compressZstd: %v", err)
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	if err := NewDecoder().DecodeInto(canvas, image.Pt(100, 100), empty); err == nil {
+		t.Error("DecodeInto: no error for an empty image")
+	}
+}
+
+func TestDecoder_DecodeScaled(t *testing.T) {
+	// boxDown averages factor x factor squares of img, as DecodeScaled does.
+	boxDown := func(img *image.RGBA, factor int) *image.RGBA {
+		w, h := img.Rect.Dx(), img.Rect.Dy()
+		out := image.NewRGBA(image.Rect(0, 0, (w+factor-1)/factor, (h+factor-1)/factor))
+		for i := range out.Pix {
+			x, y, c := i%out.Stride/4, i/out.Stride, i%4
+			sum, n := 0, 0
+			for yy := y * factor; yy < min(y*factor+factor, h); yy++ {
+				for xx := x * factor; xx < min(x*factor+factor, w); xx++ {
+					sum += int(img.Pix[yy*img.Stride+xx*4+c])
+					n++
+				}
+			}
+			out.Pix[i] = uint8((sum + n/2) / n)
+		}
+		return out
+	}
+
+	// Noise with a flat band and a hard edge, for large and pattern blocks.
+	img := makeTestImage(203, 117)
+	for y := 20; y < 70; y++ {
+		for x := range 203 {
+			v := uint8(40)
+			if x > 101 {
+				v = 220
+			}
+			img.SetRGBA(x, y, color.RGBA{v, v, 90, 255})
+		}
+	}
+	for i, cfg := range []func(*Encoder){
+		func(*Encoder) {},
+		func(e *Encoder) { e.RootBlock = 16; e.Predict = true },
+		func(e *Encoder) { e.RootBlock = 16; e.RectBlocks = true; e.Gradients = true; e.MultiLevel = true },
+		func(e *Encoder) { e.PaletteSize = 32 },
+		// Decoded in full and filtered.
+		func(e *Encoder) { e.RootBlock = 16; e.BlockCopy = true },
+		func(e *Encoder) { e.ResidualStep = 4 },
+	} {
+		// Every preset of the fixed macro/small layout.
+		for _, q := range []int{10, 30, 50, 70, 90} {
+			bw := q == 70
+			enc := NewEncoder()
+			cfg(enc)
+			comp, err := enc.Encode(img, q, bw)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			full, err := NewDecoder().Decode(comp, false)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			d := NewDecoder()
+			for _, factor := range []int{2, 4, 8} {
+				got, err := d.DecodeScaled(comp, factor)
+				if err != nil {
+					t.Fatalf("config %d q%d: DecodeScaled(%d): %v", i, q, factor, err)
+				}
+				want := boxDown(full, factor)
+				if got.Rect != want.Rect {
+					t.Fatalf("config %d: DecodeScaled(%d) is %v, want %v", i, factor, got.Rect, want.Rect)
+				}
+				// Averaging before the colour conversion only differs by
+				// rounding, and by clipping where colours leave the gamut.
+				sum := 0
+				for k := range got.Pix {
+					sum += absInt(int(got.Pix[k]) - int(want.Pix[k]))
+				}
+				mean := float64(sum) / float64(len(got.Pix))
+				worst := maxPixDiff(got.Pix, want.Pix)
+				if mean > 0.5 || bw && worst > 1 || i >= 4 && worst > 0 {
+					t.Errorf("config %d q%d: DecodeScaled(%d) differs from a box filter by %.2f on average, %d at most", i, q, factor, mean, worst)
+				}
+			}
+		}
+	}
+
+	comp, err := Encode(img, 70, false)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	for _, factor := range []int{0, 1, 3, 16} {
+		if _, err := NewDecoder().DecodeScaled(comp, factor); err == nil {
+			t.Errorf("DecodeScaled(%d): no error", factor)
+		}
 	}
 }
 
-func TestEncode_ImageTooSmall(t *testing.T) {
-	// At quality=0, smallBlock becomes 4, so a 1x1 image cannot be encoded.
-	img := makeTestImage(1, 1)
-	if _, err := Encode(img, 0, false); err == nil {
-		t.Fatalf("expected error for too-small image, got nil")
+func TestEncode_EdgeBlocks(t *testing.T) {
+	// Sizes that are not multiples of the block size, down to one pixel,
+	// are coded in full: the edge rows and columns must not come back black.
+	for _, size := range []image.Point{{1, 1}, {3, 2}, {67, 45}} {
+		src := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+		for i := range src.Pix {
+			src.Pix[i] = 200
+		}
+		for _, quality := range []int{0, 70} {
+			comp, err := Encode(src, quality, false)
+			if err != nil {
+				t.Fatalf("%v q=%d: Encode: %v", size, quality, err)
+			}
+			for _, tree := range []bool{false, true} {
+				if tree {
+					enc := NewEncoder()
+					enc.RootBlock = 16
+					if comp, err = enc.Encode(src, quality, false); err != nil {
+						t.Fatalf("%v q=%d: Encode: %v", size, quality, err)
+					}
+				}
+				img, err := Decode(comp, false)
+				if err != nil {
+					t.Fatalf("%v q=%d tree=%v: Decode: %v", size, quality, tree, err)
+				}
+				if got := img.Bounds().Size(); got != size {
+					t.Fatalf("%v q=%d tree=%v: decoded size %v", size, quality, tree, got)
+				}
+				r, _, _, _ := img.At(size.X-1, size.Y-1).RGBA()
+				if r>>8 < 190 {
+					t.Errorf("%v q=%d tree=%v: corner pixel red=%d, want ~200", size, quality, tree, r>>8)
+				}
+			}
+		}
 	}
 }
 
@@ -129,6 +1598,38 @@ func benchmarkEncodeDecode(b *testing.B, encode func() ([]byte, error), decode f
 	}
 }
 
+// BenchmarkDecodeScaled compares DecodeScaled with a full serial Decode of
+// the same stream, at the presets of several qualities.
+func BenchmarkDecodeScaled(b *testing.B) {
+	img := makePhotoImage(1024, 768)
+	for _, quality := range []int{30, 50, 70, 90} {
+		comp, err := NewEncoder().Encode(img, quality, false)
+		if err != nil {
+			b.Fatalf("encode failed: %v", err)
+		}
+		comp = append([]byte(nil), comp...)
+		dec := NewDecoder()
+		dec.Parallel = false
+
+		b.Run(fmt.Sprintf("q%d/Decode", quality), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := dec.Decode(comp, false); err != nil {
+					b.Fatalf("decode failed: %v", err)
+				}
+			}
+		})
+		for _, factor := range []int{2, 4, 8} {
+			b.Run(fmt.Sprintf("q%d/Scaled%d", quality, factor), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := dec.DecodeScaled(comp, factor); err != nil {
+						b.Fatalf("decode failed: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
+
 // BenchmarkCodecs is the "fair" comparative benchmark:
 // - identical loop shape per codec: encode(); decode()
 // - warm-up before timing
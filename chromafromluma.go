@@ -0,0 +1,105 @@
+package main
+
+// Chroma from luma (featChromaFromLuma).
+//
+// Chroma edges usually follow luma edges, so a chroma leaf may reuse the
+// pattern of the decoded luma instead of storing its own: a pixel takes the
+// FG level where the decoded Y of the block reaches the midpoint of its
+// range, and the BG level elsewhere. Only the two levels are stored, in the
+// FG and BG streams as for a pattern leaf. The kind exists where the decoded
+// luma of the block is not flat; there the type code of a non-solid chroma
+// leaf starts with a bit that selects it (see writeLeafType). Luma is
+// decoded before chroma.
+
+import "math"
+
+// lumaPatternBits estimates the coded size of a luma-pattern leaf.
+const lumaPatternBits = 2 + 2*rdLevelBits
+
+// lumaThreshold returns the pattern threshold of the bw x bh block at off
+// in a luma plane with the given row stride and pixel step, and ok=false
+// when the block is flat.
+func lumaThreshold(luma []uint8, off, stride, step, bw, bh int) (uint8, bool) {
+	lo, hi := uint8(255), uint8(0)
+	for j := range bh {
+		row := off + j*stride
+		for i := range bw {
+			v := luma[row+i*step]
+			lo = min(lo, v)
+			hi = max(hi, v)
+		}
+	}
+	return uint8((int(lo) + int(hi) + 1) / 2), lo < hi
+}
+
+// lumaThreshold returns the luma-pattern threshold of the leaf at (x, y),
+// and ok=false when the kind is not available there.
+func (c *channelLeafCoder) lumaThreshold(x, y, bw, bh int) (uint8, bool) {
+	if c.luma == nil || bw*bh == 1 {
+		return 0, false
+	}
+	return lumaThreshold(c.luma, y*c.stride+x, c.stride, 1, bw, bh)
+}
+
+// lumaModel fits the levels of a luma-pattern leaf to vals.
+func (c *channelLeafCoder) lumaModel(x, y, bw, bh int, thr uint8, vals []uint8) leafModel {
+	var sum [2]int
+	var count [2]int
+	lo, hi := [2]uint8{255, 255}, [2]uint8{}
+	for j := range bh {
+		row := c.luma[(y+j)*c.stride+x:]
+		for i, v := range vals[j*bw : (j+1)*bw] {
+			k := 0
+			if row[i] >= thr {
+				k = 1
+			}
+			sum[k] += int(v)
+			count[k]++
+			lo[k] = min(lo[k], v)
+			hi[k] = max(hi[k], v)
+		}
+	}
+	var levels [2]uint8
+	for k := range levels {
+		if c.e.maxErr >= 0 {
+			if int(hi[k])-int(lo[k]) > 2*c.e.maxErr {
+				return leafModel{kind: leafLuma, cost: math.Inf(1)}
+			}
+			levels[k] = uint8((int(lo[k]) + int(hi[k])) / 2)
+			continue
+		}
+		levels[k] = uint8((sum[k] + count[k]/2) / count[k])
+		if c.levelStep > 1 {
+			levels[k] = roundLevel(levels[k], c.levelStep)
+		}
+	}
+	m := leafModel{kind: leafLuma, fit: blockFit{thr: thr, fg: levels[1], bg: levels[0], pattern: true}}
+	var sse float64
+	for j := range bh {
+		row := c.luma[(y+j)*c.stride+x:]
+		for i, v := range vals[j*bw : (j+1)*bw] {
+			d := float64(int(v) - int(m.fit.bg))
+			if row[i] >= thr {
+				d = float64(int(v) - int(m.fit.fg))
+			}
+			sse += d * d
+		}
+	}
+	m.cost = sse + c.lambda*lumaPatternBits
+	return m
+}
+
+// drawLumaPatternPix writes a luma-pattern leaf into one channel of pix,
+// taking the pattern from the decoded luma at channel offset 0.
+func drawLumaPatternPix(pix []byte, strideBytes int, x0, y0, bw, bh int, thr, fg, bg uint8, channelOffset int) {
+	for j := range bh {
+		row := (y0+j)*strideBytes + x0*4
+		for i := 0; i < bw*4; i += 4 {
+			v := bg
+			if pix[row+i] >= thr {
+				v = fg
+			}
+			pix[row+i+channelOffset] = v
+		}
+	}
+}
@@ -11,7 +11,10 @@ import (
 	"encoding/binary"
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
 	"io"
+	"math"
 	"runtime"
 	"sync"
 
@@ -38,8 +41,440 @@ const (
 	channelFlagY  = 1 << 0
 	channelFlagCb = 1 << 1
 	channelFlagCr = 1 << 2
+
+	// channelFlagExt marks an extended header: a feature word and the
+	// parameters of the enabled features follow the image size.
+	channelFlagExt = 1 << 7
+)
+
+// Extended header features. Their parameters are stored in bit order.
+const (
+	// featTree selects the recursive block layout (see tree.go).
+	// Parameter: u8 tree depth.
+	featTree = 1 << 0
+	// featRect lets tree nodes split into two halves (rectangular blocks).
+	// Requires featTree; no parameter.
+	featRect = 1 << 1
+	// featJoint codes all channels in one segment with a shared block tree
+	// and pattern (see joint.go). Requires featTree; no parameter.
+	featJoint = 1 << 2
+	// featPalette stores joint tones as indices into a global palette
+	// (see palette.go). Requires featJoint.
+	// Parameter: u16 entry count, then the entries, one level per channel.
+	featPalette = 1 << 3
+	// featPredict stores FG/BG levels as residuals from a spatial MED
+	// prediction (see predict.go). Requires featTree; excludes featPalette.
+	featPredict = 1 << 4
+	// featPadded rounds the coded area up to a multiple of the small block
+	// (of every channel, see blockAlign); the encoder fills the padding by
+	// replicating the last column and row. No parameter.
+	featPadded = 1 << 5
+	// featColor records the colour transform of the stored planes
+	// (ColorBT709, ColorYCoCgR, ColorRGB, ...; see colorspace.go).
+	// Parameter: u8 transform.
+	featColor = 1 << 6
+	// featResidual appends a residual enhancement layer after the channel
+	// segments (see residual.go). Parameter: u8 quantization step.
+	featResidual = 1 << 7
+	// featGradient adds the gradient block type to channel segments of the
+	// tree layout (see gradient.go). Requires featTree, excludes featJoint;
+	// no parameter.
+	featGradient = 1 << 8
+	// featMultiLevel adds the 3- and 4-level block type to channel segments
+	// of the tree layout (see multilevel.go). Requires featTree, excludes
+	// featJoint; no parameter.
+	featMultiLevel = 1 << 9
+	// featCopy adds copy leaves and a copy stream to channel segments of the
+	// tree layout (see copy.go). Requires featTree, excludes featJoint; no
+	// parameter.
+	featCopy = 1 << 10
+	// featChannelGeom gives the chroma channel segments of the tree layout
+	// their own small block and tree depth; the header fields describe Y.
+	// Requires featTree, excludes featJoint. Parameter: for each stored
+	// chroma channel, u8 small block and u8 tree depth.
+	featChannelGeom = 1 << 11
+	// featChromaFromLuma adds the luma-pattern block type to the chroma
+	// channel segments of the tree layout (see chromafromluma.go). Requires
+	// featTree, excludes featJoint; no parameter.
+	featChromaFromLuma = 1 << 12
+	// featICC carries the ICC profile of the colour space the planes were
+	// taken in (see icc.go). Parameter: u32 size, then the profile.
+	featICC = 1 << 13
+
+	featKnown = featTree | featRect | featJoint | featPalette | featPredict | featPadded | featColor | featResidual | featGradient | featMultiLevel | featCopy | featChannelGeom | featChromaFromLuma | featICC
+)
+
+// maxTreeDepth bounds the root block size to smallBlock<<maxTreeDepth.
+const maxTreeDepth = 6
+
+// maxChannelSmall bounds the chroma small blocks of featChannelGeom to the
+// largest blocksForQuality gives, and maxBlockAlign the coded-area unit of
+// such streams (the least common multiple of blocks up to that size).
+const (
+	maxChannelSmall = 4
+	maxBlockAlign   = 12
 )
 
+// boundedRootBlock is the default root block of the error-bounded modes,
+// which code single-pixel small blocks.
+const boundedRootBlock = 16
+
+// streamHeader holds the fields of the BABE header.
+type streamHeader struct {
+	small    int
+	macro    int
+	channels byte
+	w, h     int
+
+	features  uint32
+	treeDepth int
+	palette   []uint8 // entries of featPalette, one level per channel
+	color     uint8   // colour transform of featColor
+
+	residualStep uint8 // quantization step of featResidual
+
+	// small block and tree depth of featChannelGeom, by channel ID; only
+	// the stored chroma entries are set (see channelGeom)
+	chanSmall [3]int
+	chanDepth [3]int
+
+	icc []byte // ICC profile of featICC
+}
+
+// channelCount returns the number of stored channels.
+func (hdr *streamHeader) channelCount() int {
+	n := 0
+	for _, f := range [...]byte{channelFlagY, channelFlagCb, channelFlagCr} {
+		if hdr.channels&f != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// channelGeom returns the small block and tree depth of channel ch.
+func (hdr *streamHeader) channelGeom(ch int) (small, depth int) {
+	if ch == chY || hdr.features&featChannelGeom == 0 {
+		return hdr.small, hdr.treeDepth
+	}
+	return hdr.chanSmall[ch], hdr.chanDepth[ch]
+}
+
+// blockAlign returns the unit of the coded area: the least common multiple
+// of the small blocks of the stored channels.
+func (hdr *streamHeader) blockAlign() int {
+	a := hdr.small
+	for _, s := range hdr.chanSmall {
+		if s > 0 {
+			a = lcm(a, s)
+		}
+	}
+	return a
+}
+
+// lcm returns the least common multiple of a and b.
+func lcm(a, b int) int {
+	x, y := a, b
+	for y != 0 {
+		x, y = y, x%y
+	}
+	return a / x * b
+}
+
+// codedSize returns the size of the area covered by blocks: the image size
+// rounded up to blockAlign with featPadded, truncated to it otherwise.
+func (hdr *streamHeader) codedSize() (int, int) {
+	a := hdr.blockAlign()
+	if hdr.features&featPadded != 0 {
+		return paddedSize(hdr.w, a), paddedSize(hdr.h, a)
+	}
+	return hdr.w / a * a, hdr.h / a * a
+}
+
+// paddedSize rounds n up to a multiple of small.
+func paddedSize(n, small int) int {
+	return (n + small - 1) / small * small
+}
+
+// padPlane moves a w×h plane stored with stride w at the start of plane to
+// stride wp, then fills columns w..wp-1 and rows h..hp-1 by replicating the
+// last column and row. plane must hold wp*hp values.
+func padPlane(plane []uint8, w, h, wp, hp int) {
+	for y := h - 1; y >= 0; y-- {
+		row := plane[y*wp : y*wp+wp]
+		copy(row, plane[y*w:y*w+w])
+		for x := w; x < wp; x++ {
+			row[x] = row[w-1]
+		}
+	}
+	last := plane[(h-1)*wp : h*wp]
+	for y := h; y < hp; y++ {
+		copy(plane[y*wp:y*wp+wp], last)
+	}
+}
+
+// write emits the header. The extension fields are only written when some
+// feature is enabled, so plain streams keep the original layout.
+func (hdr *streamHeader) write(w *bufio.Writer) error {
+	if _, err := w.WriteString(codec); err != nil {
+		return err
+	}
+	if err := writeU16BE(w, uint16(hdr.small)); err != nil {
+		return err
+	}
+	if err := writeU16BE(w, uint16(hdr.macro)); err != nil {
+		return err
+	}
+	// channels mask: which Y/Cb/Cr planes are stored.
+	mask := hdr.channels &^ channelFlagExt
+	if hdr.features != 0 {
+		mask |= channelFlagExt
+	}
+	if err := w.WriteByte(mask); err != nil {
+		return err
+	}
+	if err := writeU32BE(w, uint32(hdr.w)); err != nil {
+		return err
+	}
+	if err := writeU32BE(w, uint32(hdr.h)); err != nil {
+		return err
+	}
+	if hdr.features == 0 {
+		return nil
+	}
+
+	if err := writeU32BE(w, hdr.features); err != nil {
+		return err
+	}
+	if hdr.features&featTree != 0 {
+		if err := w.WriteByte(uint8(hdr.treeDepth)); err != nil {
+			return err
+		}
+	}
+	if hdr.features&featPalette != 0 {
+		if err := writeU16BE(w, uint16(len(hdr.palette)/hdr.channelCount())); err != nil {
+			return err
+		}
+		if _, err := w.Write(hdr.palette); err != nil {
+			return err
+		}
+	}
+	if hdr.features&featColor != 0 {
+		if err := w.WriteByte(hdr.color); err != nil {
+			return err
+		}
+	}
+	if hdr.features&featResidual != 0 {
+		if err := w.WriteByte(hdr.residualStep); err != nil {
+			return err
+		}
+	}
+	if hdr.features&featChannelGeom != 0 {
+		for _, ch := range hdr.chromaChannels() {
+			if _, err := w.Write([]byte{uint8(hdr.chanSmall[ch]), uint8(hdr.chanDepth[ch])}); err != nil {
+				return err
+			}
+		}
+	}
+	if hdr.features&featICC != 0 {
+		if err := writeU32BE(w, uint32(len(hdr.icc))); err != nil {
+			return err
+		}
+		if _, err := w.Write(hdr.icc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chromaChannels returns the IDs of the stored chroma channels.
+func (hdr *streamHeader) chromaChannels() []int {
+	var chs []int
+	if hdr.channels&channelFlagCb != 0 {
+		chs = append(chs, chCb)
+	}
+	if hdr.channels&channelFlagCr != 0 {
+		chs = append(chs, chCr)
+	}
+	return chs
+}
+
+// parseHeader reads the header at *pos and advances *pos past it.
+func parseHeader(payload []byte, pos *int) (streamHeader, error) {
+	var hdr streamHeader
+
+	if len(payload)-*pos < len(codec) {
+		return hdr, fmt.Errorf("read header: short magic")
+	}
+	// magic
+	if string(payload[*pos:*pos+len(codec)]) != codec {
+		return hdr, fmt.Errorf("bad magic: %q", string(payload[*pos:*pos+len(codec)]))
+	}
+	*pos += len(codec)
+
+	readU8 := func(label string) (uint8, error) {
+		if len(payload)-*pos < 1 {
+			return 0, fmt.Errorf("decode: truncated while reading %s", label)
+		}
+		v := payload[*pos]
+		*pos++
+		return v, nil
+	}
+	readU16 := func(label string) (uint16, error) {
+		if len(payload)-*pos < 2 {
+			return 0, fmt.Errorf("decode: truncated while reading %s", label)
+		}
+		v := binary.BigEndian.Uint16(payload[*pos : *pos+2])
+		*pos += 2
+		return v, nil
+	}
+	readU32 := func(label string) (uint32, error) {
+		if len(payload)-*pos < 4 {
+			return 0, fmt.Errorf("decode: truncated while reading %s", label)
+		}
+		v := binary.BigEndian.Uint32(payload[*pos : *pos+4])
+		*pos += 4
+		return v, nil
+	}
+
+	bwSize, err := readU16("block width")
+	if err != nil {
+		return hdr, err
+	}
+	bhSize, err := readU16("block height")
+	if err != nil {
+		return hdr, err
+	}
+	if bwSize == 0 || bhSize == 0 {
+		return hdr, fmt.Errorf("invalid block sizes in header: %dx%d", bwSize, bhSize)
+	}
+	hdr.small = int(bwSize)
+	hdr.macro = int(bhSize)
+
+	// channels mask: which Y/Cb/Cr planes are stored.
+	mask, err := readU8("channels mask")
+	if err != nil {
+		return hdr, err
+	}
+	if mask&channelFlagY == 0 {
+		return hdr, fmt.Errorf("decode: Y channel missing in header")
+	}
+	hdr.channels = mask &^ channelFlagExt
+
+	imgW32, err := readU32("image width")
+	if err != nil {
+		return hdr, err
+	}
+	imgH32, err := readU32("image height")
+	if err != nil {
+		return hdr, err
+	}
+	hdr.w = int(imgW32)
+	hdr.h = int(imgH32)
+	if hdr.w == 0 || hdr.h == 0 {
+		return hdr, fmt.Errorf("decode: empty image: %dx%d", hdr.w, hdr.h)
+	}
+
+	if hdr.macro < hdr.small || hdr.macro%hdr.small != 0 {
+		return hdr, fmt.Errorf("macroBlock (%d) must be >= smallBlock (%d) and a multiple of it",
+			hdr.macro, hdr.small)
+	}
+	if mask&channelFlagExt == 0 {
+		return hdr, nil
+	}
+
+	if hdr.features, err = readU32("feature flags"); err != nil {
+		return hdr, err
+	}
+	if unknown := hdr.features &^ featKnown; unknown != 0 {
+		return hdr, fmt.Errorf("decode: unsupported features %#x", unknown)
+	}
+	if hdr.features&featTree != 0 {
+		depth, err := readU8("tree depth")
+		if err != nil {
+			return hdr, err
+		}
+		if depth > maxTreeDepth {
+			return hdr, fmt.Errorf("decode: tree depth %d exceeds %d", depth, maxTreeDepth)
+		}
+		hdr.treeDepth = int(depth)
+	}
+	if hdr.features&featPalette != 0 {
+		n, err := readU16("palette size")
+		if err != nil {
+			return hdr, err
+		}
+		if n == 0 || n > maxPaletteSize {
+			return hdr, fmt.Errorf("decode: invalid palette size %d", n)
+		}
+		size := int(n) * hdr.channelCount()
+		if len(payload)-*pos < size {
+			return hdr, fmt.Errorf("decode: truncated while reading palette")
+		}
+		hdr.palette = payload[*pos : *pos+size]
+		*pos += size
+	}
+	if hdr.features&featColor != 0 {
+		if hdr.color, err = readU8("colour transform"); err != nil {
+			return hdr, err
+		}
+		if !validColor(hdr.color) {
+			return hdr, fmt.Errorf("decode: unsupported colour transform %d", hdr.color)
+		}
+	}
+	if hdr.features&featResidual != 0 {
+		if hdr.residualStep, err = readU8("residual step"); err != nil {
+			return hdr, err
+		}
+		if hdr.residualStep == 0 {
+			return hdr, fmt.Errorf("decode: invalid residual step 0")
+		}
+	}
+	if hdr.features&featChannelGeom != 0 {
+		for _, ch := range hdr.chromaChannels() {
+			small, err := readU8("channel block size")
+			if err != nil {
+				return hdr, err
+			}
+			depth, err := readU8("channel tree depth")
+			if err != nil {
+				return hdr, err
+			}
+			if small == 0 || small > maxChannelSmall || depth > maxTreeDepth {
+				return hdr, fmt.Errorf("decode: invalid geometry %d/%d for channel %d", small, depth, ch)
+			}
+			hdr.chanSmall[ch], hdr.chanDepth[ch] = int(small), int(depth)
+		}
+		if a := hdr.blockAlign(); a > maxBlockAlign {
+			return hdr, fmt.Errorf("decode: channel block sizes need a %d-pixel coded area unit", a)
+		}
+	}
+	if hdr.features&featICC != 0 {
+		n, err := readU32("ICC profile size")
+		if err != nil {
+			return hdr, err
+		}
+		if n > maxICCSize || int64(n) > int64(len(payload)-*pos) {
+			return hdr, fmt.Errorf("decode: invalid ICC profile size %d", n)
+		}
+		hdr.icc = payload[*pos : *pos+int(n)]
+		*pos += int(n)
+	}
+	if hdr.features&(featRect|featJoint|featPredict|featGradient|featMultiLevel|featCopy|featChannelGeom|featChromaFromLuma) != 0 && hdr.features&featTree == 0 {
+		return hdr, fmt.Errorf("decode: features %#x require the tree layout", hdr.features)
+	}
+	if hdr.features&featPalette != 0 && hdr.features&featJoint == 0 {
+		return hdr, fmt.Errorf("decode: palette requires the joint layout")
+	}
+	if hdr.features&featPalette != 0 && hdr.features&featPredict != 0 {
+		return hdr, fmt.Errorf("decode: palette indices cannot be predicted")
+	}
+	if hdr.features&featJoint != 0 && hdr.features&(featGradient|featMultiLevel|featCopy|featChannelGeom|featChromaFromLuma) != 0 {
+		return hdr, fmt.Errorf("decode: block types and channel geometry of channel segments require per-channel segments")
+	}
+	return hdr, nil
+}
+
 // encodeBW toggles grayscale mode; when true, only the Y channel is stored.
 var encodeBW bool
 
@@ -52,37 +487,30 @@ var encodeBW bool
 // It uses a small set of discrete presets to keep the behavior stable and predictable.
 func setBlocksForQuality(quality int) error {
 	// clamp quality to [0..100]
-	if quality < 0 {
-		quality = 0
-	}
-	if quality > 100 {
-		quality = 100
-	}
+	quality = min(max(quality, 0), 100)
 
 	// remember quality globally so heuristics (macro vs small) can use it directly
 	encQuality = quality
+	smallBlock, macroBlock = blocksForQuality(quality)
+	return nil
+}
 
+// blocksForQuality returns the smallBlock/macroBlock preset of a quality in [0..100].
+func blocksForQuality(quality int) (small, macro int) {
 	switch {
 	case quality >= 80:
 		// highest quality: smallest macro-blocks
-		smallBlock = 1
-		macroBlock = 2
+		return 1, 2
 	case quality >= 60:
-		smallBlock = 1
-		macroBlock = 3
+		return 1, 3
 	case quality >= 40:
-		smallBlock = 2
-		macroBlock = 4
+		return 2, 4
 	case quality >= 20:
-		smallBlock = 3
-		macroBlock = 6
+		return 3, 6
 	default:
 		// lowest quality / highest compression
-		smallBlock = 4
-		macroBlock = 8
+		return 4, 8
 	}
-
-	return nil
 }
 
 // bitWriter writes bits to a bytes.Buffer (msb-first in each byte).
@@ -192,6 +620,33 @@ func (br *bitReader) readBitFast() bool {
 	return isSet
 }
 
+// readWideFast reads n bits (0..64) and returns them in the low n bits of
+// the result, msb-first like readBits. The caller must ensure there are at
+// least n bits left.
+func (br *bitReader) readWideFast(n int) uint64 {
+	var out uint64
+	for n > 0 {
+		k := min(n, 56)
+		var w uint64
+		if br.idx+8 <= len(br.data) {
+			w = binary.BigEndian.Uint64(br.data[br.idx:])
+		} else {
+			for i := range 8 {
+				w <<= 8
+				if br.idx+i < len(br.data) {
+					w |= uint64(br.data[br.idx+i])
+				}
+			}
+		}
+		out = out<<k | w<<br.bit>>(64-k)
+		pos := int(br.bit) + k
+		br.idx += pos >> 3
+		br.bit = uint8(pos & 7)
+		n -= k
+	}
+	return out
+}
+
 // readBits reads n bits (1..8) and returns them in the low n bits of the result,
 // msb-first within the n bits. For example, if the next bits are 1,0,1,1 and n=4,
 // this returns 0b1011.
@@ -271,12 +726,12 @@ const (
 	chCr = 2
 )
 
-// extractYCbCrPlanes converts an image.Image into three planar Y, Cb, Cr slices.
-// Each plane has size w*h and is indexed as plane[y*w + x] with 0 <= x < w and 0 <= y < h.
+// extractYCbCrPlanes converts an image.Image into three planar Y, Cb, Cr slices
+// with the colour matrix m (see colorspace.go). Each plane has size w*h and is indexed as plane[y*w + x] with 0 <= x < w and 0 <= y < h.
 //
 // For common concrete types (RGBA/NRGBA) we bypass img.At/RGBA() and read pixels
 // directly from the backing Pix slice to reduce allocations and overhead.
-func extractYCbCrPlanes(img image.Image) ([]uint8, []uint8, []uint8, int, int) {
+func extractYCbCrPlanes(m *colorMatrix, img image.Image) ([]uint8, []uint8, []uint8, int, int) {
 	b := img.Bounds()
 	w := b.Dx()
 	h := b.Dy()
@@ -285,24 +740,24 @@ func extractYCbCrPlanes(img image.Image) ([]uint8, []uint8, []uint8, int, int) {
 	cbPlane := make([]uint8, w*h)
 	crPlane := make([]uint8, w*h)
 
-	extractYCbCrPlanesInto(img, yPlane, cbPlane, crPlane)
+	extractYCbCrPlanesInto(m, img, yPlane, cbPlane, crPlane)
 	return yPlane, cbPlane, crPlane, w, h
 }
 
-func extractYCbCrPlanesInto(img image.Image, yPlane, cbPlane, crPlane []uint8) {
+func extractYCbCrPlanesInto(m *colorMatrix, img image.Image, yPlane, cbPlane, crPlane []uint8) {
 	b := img.Bounds()
 	w := b.Dx()
 	h := b.Dy()
 
 	switch src := img.(type) {
 	case *image.RGBA:
-		extractYCbCrFromRGBA(src, yPlane, cbPlane, crPlane, w, h)
+		extractYCbCrFromRGBA(m, src, yPlane, cbPlane, crPlane, w, h)
 	case *image.NRGBA:
-		extractYCbCrFromNRGBA(src, yPlane, cbPlane, crPlane, w, h)
+		extractYCbCrFromNRGBA(m, src, yPlane, cbPlane, crPlane, w, h)
 	case *image.YCbCr:
-		extractYCbCrFromYCbCr(src, yPlane, cbPlane, crPlane, w, h)
+		extractYCbCrFromYCbCr(m, src, yPlane, cbPlane, crPlane, w, h)
 	case *image.Gray:
-		extractYCbCrFromGray(src, yPlane, cbPlane, crPlane, w, h)
+		extractYCbCrFromGray(m, src, yPlane, cbPlane, crPlane, w, h)
 	default:
 		// Fallback: generic path using img.At. Still parallelised by rows.
 		workers := min(runtime.NumCPU(), h)
@@ -324,13 +779,13 @@ func extractYCbCrPlanesInto(img image.Image, yPlane, cbPlane, crPlane []uint8) {
 			}
 
 			wg.Add(1)
-			go extractYCbCrFromImageStripe(img, b, w, yPlane, cbPlane, crPlane, y0, y1, &wg)
+			go extractYCbCrFromImageStripe(m, img, b, w, yPlane, cbPlane, crPlane, y0, y1, &wg)
 		}
 		wg.Wait()
 	}
 }
 
-func extractYCbCrFromImageStripe(img image.Image, b image.Rectangle, w int, yPlane, cbPlane, crPlane []uint8, yStart, yEnd int, wg *sync.WaitGroup) {
+func extractYCbCrFromImageStripe(m *colorMatrix, img image.Image, b image.Rectangle, w int, yPlane, cbPlane, crPlane []uint8, yStart, yEnd int, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for y := yStart; y < yEnd; y++ {
 		baseIdx := y * w
@@ -340,29 +795,26 @@ func extractYCbCrFromImageStripe(img image.Image, b image.Rectangle, w int, yPla
 			r8 := uint8(r16 >> 8)
 			g8 := uint8(g16 >> 8)
 			b8 := uint8(b16 >> 8)
-			ycc := rgbToYCbCr(r8, g8, b8)
 			idx := baseIdx + x
-			yPlane[idx] = uint8(ycc.Y)
-			cbPlane[idx] = uint8(ycc.Cb)
-			crPlane[idx] = uint8(ycc.Cr)
+			yPlane[idx], cbPlane[idx], crPlane[idx] = m.fromRGB(r8, g8, b8)
 		}
 	}
 }
 
-func extractYCbCrPlanesIntoSerial(img image.Image, yPlane, cbPlane, crPlane []uint8) {
+func extractYCbCrPlanesIntoSerial(m *colorMatrix, img image.Image, yPlane, cbPlane, crPlane []uint8) {
 	b := img.Bounds()
 	w := b.Dx()
 	h := b.Dy()
 
 	switch src := img.(type) {
 	case *image.RGBA:
-		extractYCbCrFromRGBASequential(src, yPlane, cbPlane, crPlane, w, h)
+		extractYCbCrFromRGBASequential(m, src, yPlane, cbPlane, crPlane, w, h)
 	case *image.NRGBA:
-		extractYCbCrFromNRGBASequential(src, yPlane, cbPlane, crPlane, w, h)
+		extractYCbCrFromNRGBASequential(m, src, yPlane, cbPlane, crPlane, w, h)
 	case *image.YCbCr:
-		extractYCbCrFromYCbCrSequential(src, yPlane, cbPlane, crPlane, w, h)
+		extractYCbCrFromYCbCrSequential(m, src, yPlane, cbPlane, crPlane, w, h)
 	case *image.Gray:
-		extractYCbCrFromGraySequential(src, yPlane, cbPlane, crPlane, w, h)
+		extractYCbCrFromGraySequential(m, src, yPlane, cbPlane, crPlane, w, h)
 	default:
 		for y := 0; y < h; y++ {
 			baseIdx := y * w
@@ -372,11 +824,8 @@ func extractYCbCrPlanesIntoSerial(img image.Image, yPlane, cbPlane, crPlane []ui
 				r8 := uint8(r16 >> 8)
 				g8 := uint8(g16 >> 8)
 				b8 := uint8(b16 >> 8)
-				ycc := rgbToYCbCr(r8, g8, b8)
 				idx := baseIdx + x
-				yPlane[idx] = uint8(ycc.Y)
-				cbPlane[idx] = uint8(ycc.Cb)
-				crPlane[idx] = uint8(ycc.Cr)
+				yPlane[idx], cbPlane[idx], crPlane[idx] = m.fromRGB(r8, g8, b8)
 			}
 		}
 	}
@@ -384,7 +833,7 @@ func extractYCbCrPlanesIntoSerial(img image.Image, yPlane, cbPlane, crPlane []ui
 
 // extractYCbCrFromRGBA converts an *image.RGBA into planar Y, Cb, Cr slices.
 // It assumes dst planes are sized to w*h, where w/h come from src.Bounds().Dx/Dy.
-func extractYCbCrFromRGBA(src *image.RGBA, yPlane, cbPlane, crPlane []uint8, w, h int) {
+func extractYCbCrFromRGBA(m *colorMatrix, src *image.RGBA, yPlane, cbPlane, crPlane []uint8, w, h int) {
 	stride := src.Stride
 	pix := src.Pix
 
@@ -410,12 +859,12 @@ func extractYCbCrFromRGBA(src *image.RGBA, yPlane, cbPlane, crPlane []uint8, w,
 		}
 
 		wg.Add(1)
-		go extractYCbCrFromRGBAStripe(pix, stride, w, yPlane, cbPlane, crPlane, y0, y1, &wg)
+		go extractYCbCrFromRGBAStripe(m, pix, stride, w, yPlane, cbPlane, crPlane, y0, y1, &wg)
 	}
 	wg.Wait()
 }
 
-func extractYCbCrFromRGBAStripe(pix []byte, stride, w int, yPlane, cbPlane, crPlane []uint8, yStart, yEnd int, wg *sync.WaitGroup) {
+func extractYCbCrFromRGBAStripe(m *colorMatrix, pix []byte, stride, w int, yPlane, cbPlane, crPlane []uint8, yStart, yEnd int, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for y := yStart; y < yEnd; y++ {
 		baseIdx := y * w
@@ -426,15 +875,12 @@ func extractYCbCrFromRGBAStripe(pix []byte, stride, w int, yPlane, cbPlane, crPl
 			g8 := pix[p+1]
 			b8 := pix[p+2]
 			idx := baseIdx + x
-			rr, gg, bb := int32(r8), int32(g8), int32(b8)
-			yPlane[idx] = uint8((77*rr + 150*gg + 29*bb) >> 8)
-			cbPlane[idx] = uint8(((-43*rr - 85*gg + 128*bb) >> 8) + 128)
-			crPlane[idx] = uint8(((128*rr - 107*gg - 21*bb) >> 8) + 128)
+			yPlane[idx], cbPlane[idx], crPlane[idx] = m.fromRGB(r8, g8, b8)
 		}
 	}
 }
 
-func extractYCbCrFromRGBASequential(src *image.RGBA, yPlane, cbPlane, crPlane []uint8, w, h int) {
+func extractYCbCrFromRGBASequential(m *colorMatrix, src *image.RGBA, yPlane, cbPlane, crPlane []uint8, w, h int) {
 	stride := src.Stride
 	pix := src.Pix
 
@@ -447,17 +893,14 @@ func extractYCbCrFromRGBASequential(src *image.RGBA, yPlane, cbPlane, crPlane []
 			g8 := pix[p+1]
 			b8 := pix[p+2]
 			idx := baseIdx + x
-			rr, gg, bb := int32(r8), int32(g8), int32(b8)
-			yPlane[idx] = uint8((77*rr + 150*gg + 29*bb) >> 8)
-			cbPlane[idx] = uint8(((-43*rr - 85*gg + 128*bb) >> 8) + 128)
-			crPlane[idx] = uint8(((128*rr - 107*gg - 21*bb) >> 8) + 128)
+			yPlane[idx], cbPlane[idx], crPlane[idx] = m.fromRGB(r8, g8, b8)
 		}
 	}
 }
 
 // extractYCbCrFromNRGBA converts an *image.NRGBA into planar Y, Cb, Cr slices.
 // It reads RGB directly from Pix; for primarily opaque images this matches the old At/RGBA path well enough.
-func extractYCbCrFromNRGBA(src *image.NRGBA, yPlane, cbPlane, crPlane []uint8, w, h int) {
+func extractYCbCrFromNRGBA(m *colorMatrix, src *image.NRGBA, yPlane, cbPlane, crPlane []uint8, w, h int) {
 	stride := src.Stride
 	pix := src.Pix
 
@@ -483,12 +926,12 @@ func extractYCbCrFromNRGBA(src *image.NRGBA, yPlane, cbPlane, crPlane []uint8, w
 		}
 
 		wg.Add(1)
-		go extractYCbCrFromNRGBAStripe(pix, stride, w, yPlane, cbPlane, crPlane, y0, y1, &wg)
+		go extractYCbCrFromNRGBAStripe(m, pix, stride, w, yPlane, cbPlane, crPlane, y0, y1, &wg)
 	}
 	wg.Wait()
 }
 
-func extractYCbCrFromNRGBAStripe(pix []byte, stride, w int, yPlane, cbPlane, crPlane []uint8, yStart, yEnd int, wg *sync.WaitGroup) {
+func extractYCbCrFromNRGBAStripe(m *colorMatrix, pix []byte, stride, w int, yPlane, cbPlane, crPlane []uint8, yStart, yEnd int, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for y := yStart; y < yEnd; y++ {
 		baseIdx := y * w
@@ -499,15 +942,12 @@ func extractYCbCrFromNRGBAStripe(pix []byte, stride, w int, yPlane, cbPlane, crP
 			g8 := pix[p+1]
 			b8 := pix[p+2]
 			idx := baseIdx + x
-			rr, gg, bb := int32(r8), int32(g8), int32(b8)
-			yPlane[idx] = uint8((77*rr + 150*gg + 29*bb) >> 8)
-			cbPlane[idx] = uint8(((-43*rr - 85*gg + 128*bb) >> 8) + 128)
-			crPlane[idx] = uint8(((128*rr - 107*gg - 21*bb) >> 8) + 128)
+			yPlane[idx], cbPlane[idx], crPlane[idx] = m.fromRGB(r8, g8, b8)
 		}
 	}
 }
 
-func extractYCbCrFromNRGBASequential(src *image.NRGBA, yPlane, cbPlane, crPlane []uint8, w, h int) {
+func extractYCbCrFromNRGBASequential(m *colorMatrix, src *image.NRGBA, yPlane, cbPlane, crPlane []uint8, w, h int) {
 	stride := src.Stride
 	pix := src.Pix
 
@@ -520,15 +960,12 @@ func extractYCbCrFromNRGBASequential(src *image.NRGBA, yPlane, cbPlane, crPlane
 			g8 := pix[p+1]
 			b8 := pix[p+2]
 			idx := baseIdx + x
-			rr, gg, bb := int32(r8), int32(g8), int32(b8)
-			yPlane[idx] = uint8((77*rr + 150*gg + 29*bb) >> 8)
-			cbPlane[idx] = uint8(((-43*rr - 85*gg + 128*bb) >> 8) + 128)
-			crPlane[idx] = uint8(((128*rr - 107*gg - 21*bb) >> 8) + 128)
+			yPlane[idx], cbPlane[idx], crPlane[idx] = m.fromRGB(r8, g8, b8)
 		}
 	}
 }
 
-func extractYCbCrFromYCbCr(src *image.YCbCr, yPlane, cbPlane, crPlane []uint8, w, h int) {
+func extractYCbCrFromYCbCr(m *colorMatrix, src *image.YCbCr, yPlane, cbPlane, crPlane []uint8, w, h int) {
 	b := src.Bounds()
 	minX, minY := b.Min.X, b.Min.Y
 
@@ -553,18 +990,20 @@ func extractYCbCrFromYCbCr(src *image.YCbCr, yPlane, cbPlane, crPlane []uint8, w
 		}
 
 		wg.Add(1)
-		go extractYCbCrFromYCbCrStripe(src, minX, minY, w, yPlane, cbPlane, crPlane, y0, y1, &wg)
+		go extractYCbCrFromYCbCrStripe(m, src, minX, minY, w, yPlane, cbPlane, crPlane, y0, y1, &wg)
 	}
 	wg.Wait()
 }
 
-func extractYCbCrFromYCbCrStripe(src *image.YCbCr, minX, minY, w int, yPlane, cbPlane, crPlane []uint8, yStart, yEnd int, wg *sync.WaitGroup) {
+func extractYCbCrFromYCbCrStripe(m *colorMatrix, src *image.YCbCr, minX, minY, w int, yPlane, cbPlane, crPlane []uint8, yStart, yEnd int, wg *sync.WaitGroup) {
 	defer wg.Done()
 	rectMinX, rectMinY := src.Rect.Min.X, src.Rect.Min.Y
 	yStride := src.YStride
 	yPix := src.Y
 	cbPix := src.Cb
 	crPix := src.Cr
+	// The source is JFIF (BT.601 full range) YCbCr.
+	direct := m == colorMatrixFor(ColorBT601)
 
 	for y := yStart; y < yEnd; y++ {
 		yAbs := minY + y
@@ -572,15 +1011,17 @@ func extractYCbCrFromYCbCrStripe(src *image.YCbCr, minX, minY, w int, yPlane, cb
 		yRow := (yAbs - rectMinY) * yStride
 		for x := 0; x < w; x++ {
 			xAbs := minX + x
-			yPlane[baseIdx+x] = yPix[yRow+(xAbs-rectMinX)]
 			ci := src.COffset(xAbs, yAbs)
-			cbPlane[baseIdx+x] = cbPix[ci]
-			crPlane[baseIdx+x] = crPix[ci]
+			yv, cb, cr := yPix[yRow+(xAbs-rectMinX)], cbPix[ci], crPix[ci]
+			if !direct {
+				yv, cb, cr = m.fromRGB(color.YCbCrToRGB(yv, cb, cr))
+			}
+			yPlane[baseIdx+x], cbPlane[baseIdx+x], crPlane[baseIdx+x] = yv, cb, cr
 		}
 	}
 }
 
-func extractYCbCrFromYCbCrSequential(src *image.YCbCr, yPlane, cbPlane, crPlane []uint8, w, h int) {
+func extractYCbCrFromYCbCrSequential(m *colorMatrix, src *image.YCbCr, yPlane, cbPlane, crPlane []uint8, w, h int) {
 	b := src.Bounds()
 	minX, minY := b.Min.X, b.Min.Y
 	rectMinX, rectMinY := src.Rect.Min.X, src.Rect.Min.Y
@@ -589,6 +1030,8 @@ func extractYCbCrFromYCbCrSequential(src *image.YCbCr, yPlane, cbPlane, crPlane
 	yPix := src.Y
 	cbPix := src.Cb
 	crPix := src.Cr
+	// The source is JFIF (BT.601 full range) YCbCr.
+	direct := m == colorMatrixFor(ColorBT601)
 
 	for y := 0; y < h; y++ {
 		yAbs := minY + y
@@ -596,15 +1039,17 @@ func extractYCbCrFromYCbCrSequential(src *image.YCbCr, yPlane, cbPlane, crPlane
 		yRow := (yAbs - rectMinY) * yStride
 		for x := 0; x < w; x++ {
 			xAbs := minX + x
-			yPlane[baseIdx+x] = yPix[yRow+(xAbs-rectMinX)]
 			ci := src.COffset(xAbs, yAbs)
-			cbPlane[baseIdx+x] = cbPix[ci]
-			crPlane[baseIdx+x] = crPix[ci]
+			yv, cb, cr := yPix[yRow+(xAbs-rectMinX)], cbPix[ci], crPix[ci]
+			if !direct {
+				yv, cb, cr = m.fromRGB(color.YCbCrToRGB(yv, cb, cr))
+			}
+			yPlane[baseIdx+x], cbPlane[baseIdx+x], crPlane[baseIdx+x] = yv, cb, cr
 		}
 	}
 }
 
-func extractYCbCrFromGray(src *image.Gray, yPlane, cbPlane, crPlane []uint8, w, h int) {
+func extractYCbCrFromGray(m *colorMatrix, src *image.Gray, yPlane, cbPlane, crPlane []uint8, w, h int) {
 	b := src.Bounds()
 	minX, minY := b.Min.X, b.Min.Y
 	rectMinX, rectMinY := src.Rect.Min.X, src.Rect.Min.Y
@@ -632,12 +1077,12 @@ func extractYCbCrFromGray(src *image.Gray, yPlane, cbPlane, crPlane []uint8, w,
 		}
 
 		wg.Add(1)
-		go extractYCbCrFromGrayStripe(pix, stride, minX, minY, rectMinX, rectMinY, w, yPlane, cbPlane, crPlane, y0, y1, &wg)
+		go extractYCbCrFromGrayStripe(m, pix, stride, minX, minY, rectMinX, rectMinY, w, yPlane, cbPlane, crPlane, y0, y1, &wg)
 	}
 	wg.Wait()
 }
 
-func extractYCbCrFromGrayStripe(pix []byte, stride, minX, minY, rectMinX, rectMinY, w int, yPlane, cbPlane, crPlane []uint8, yStart, yEnd int, wg *sync.WaitGroup) {
+func extractYCbCrFromGrayStripe(m *colorMatrix, pix []byte, stride, minX, minY, rectMinX, rectMinY, w int, yPlane, cbPlane, crPlane []uint8, yStart, yEnd int, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for y := yStart; y < yEnd; y++ {
 		yAbs := minY + y
@@ -646,14 +1091,12 @@ func extractYCbCrFromGrayStripe(pix []byte, stride, minX, minY, rectMinX, rectMi
 		for x := 0; x < w; x++ {
 			xAbs := minX + x
 			v := pix[pixRow+(xAbs-rectMinX)]
-			yPlane[baseIdx+x] = v
-			cbPlane[baseIdx+x] = 128
-			crPlane[baseIdx+x] = 128
+			yPlane[baseIdx+x], cbPlane[baseIdx+x], crPlane[baseIdx+x] = m.fromRGB(v, v, v)
 		}
 	}
 }
 
-func extractYCbCrFromGraySequential(src *image.Gray, yPlane, cbPlane, crPlane []uint8, w, h int) {
+func extractYCbCrFromGraySequential(m *colorMatrix, src *image.Gray, yPlane, cbPlane, crPlane []uint8, w, h int) {
 	b := src.Bounds()
 	minX, minY := b.Min.X, b.Min.Y
 	rectMinX, rectMinY := src.Rect.Min.X, src.Rect.Min.Y
@@ -667,9 +1110,7 @@ func extractYCbCrFromGraySequential(src *image.Gray, yPlane, cbPlane, crPlane []
 		for x := 0; x < w; x++ {
 			xAbs := minX + x
 			v := pix[pixRow+(xAbs-rectMinX)]
-			yPlane[baseIdx+x] = v
-			cbPlane[baseIdx+x] = 128
-			crPlane[baseIdx+x] = 128
+			yPlane[baseIdx+x], cbPlane[baseIdx+x], crPlane[baseIdx+x] = m.fromRGB(v, v, v)
 		}
 	}
 }
@@ -786,6 +1227,472 @@ func canUseBigBlockChannel(plane []uint8, stride, height, x0, y0 int, spread int
 	return int32(maxV)-int32(minV) < spread
 }
 
+// Encoder effort levels. Each level enables everything below it:
+//
+//	0 (EffortFastest): spread heuristic for macro/small decisions, mean-threshold blocks
+//	1: rate-distortion optimised macro/small decisions
+//	2: several threshold candidates per block, keeping the lowest error
+//	3: strongest zstd level for the final stage
+//	4 (EffortSlowest): whole-image parameter trials, keeping the best RD result
+const (
+	EffortFastest = 0
+	EffortSlowest = 4
+
+	effortRD         = 1
+	effortThresholds = 2
+	effortBestZstd   = 3
+	effortTrials     = 4
+)
+
+// Rate-distortion cost model used by the RD block decisions.
+// Levels are delta-coded and then passed through zstd, so they cost noticeably
+// less than 8 bits each; rdLevelBits is a rough average for that stage.
+const rdLevelBits = 6.0
+
+// rdLambdaForSpread derives the Lagrange multiplier from the quality-dependent
+// spread threshold, so that RD decisions operate around the same quality point
+// as the spread heuristic: a block is merged when its extra squared error is
+// worth fewer bits than a split would cost. Smaller small blocks reproduce the
+// source more exactly, so the multiplier shrinks with the small block to keep
+// the resulting quality in line with the heuristic.
+func rdLambdaForSpread(spread int32, small int) float64 {
+	s := float64(spread)
+	return s * s * float64(small) / 192
+}
+
+// blockFit is a bi-level model of one block: pixels >= thr take fg, the rest bg.
+// When pattern is false the block is solid and only fg is meaningful.
+type blockFit struct {
+	thr     uint8
+	fg      uint8
+	bg      uint8
+	pattern bool
+}
+
+// readBlockValues copies a bw x bh block of plane into dst (row-major) and
+// returns the filled prefix of dst.
+func readBlockValues(plane []uint8, stride, x0, y0, bw, bh int, dst []uint8) []uint8 {
+	vals := dst[:bw*bh]
+	i := 0
+	for yy := 0; yy < bh; yy++ {
+		row := (y0+yy)*stride + x0
+		i += copy(vals[i:i+bw], plane[row:row+bw])
+	}
+	return vals
+}
+
+// fitBlockMean reproduces encodeBlockPlane: mean threshold and truncated class means.
+func fitBlockMean(vals []uint8) blockFit {
+	var sum uint64
+	for _, v := range vals {
+		sum += uint64(v)
+	}
+	avg := uint8(sum / uint64(len(vals)))
+	if len(vals) == 1 {
+		return blockFit{thr: avg, fg: avg, bg: avg}
+	}
+
+	var fgSum, bgSum, fgCnt, bgCnt uint64
+	for _, v := range vals {
+		if v >= avg {
+			fgSum += uint64(v)
+			fgCnt++
+		} else {
+			bgSum += uint64(v)
+			bgCnt++
+		}
+	}
+	if fgCnt == 0 || bgCnt == 0 {
+		return blockFit{thr: avg, fg: avg, bg: avg}
+	}
+	fg := uint8(fgSum / fgCnt)
+	bg := uint8(bgSum / bgCnt)
+	return blockFit{thr: avg, fg: fg, bg: bg, pattern: fg != bg}
+}
+
+// fitBlockThreshold splits vals at thr and uses the rounded class means as levels.
+func fitBlockThreshold(vals []uint8, thr uint8) blockFit {
+	var fgSum, bgSum, fgCnt, bgCnt uint64
+	for _, v := range vals {
+		if v >= thr {
+			fgSum += uint64(v)
+			fgCnt++
+		} else {
+			bgSum += uint64(v)
+			bgCnt++
+		}
+	}
+	if fgCnt == 0 || bgCnt == 0 {
+		n := fgCnt + bgCnt
+		avg := uint8((fgSum + bgSum + n/2) / n)
+		return blockFit{thr: thr, fg: avg, bg: avg}
+	}
+	fg := uint8((fgSum + fgCnt/2) / fgCnt)
+	bg := uint8((bgSum + bgCnt/2) / bgCnt)
+	return blockFit{thr: thr, fg: fg, bg: bg, pattern: fg != bg}
+}
+
+// fitBlockSearch tries several thresholds (mean, mid-range and a few Lloyd
+// refinements of the mean split) plus a solid block, and keeps the fit with
+// the lowest RD cost sse + lambda*bits.
+func fitBlockSearch(vals []uint8, lambda float64) blockFit {
+	if len(vals) == 1 {
+		return blockFit{thr: vals[0], fg: vals[0], bg: vals[0]}
+	}
+
+	var sum uint64
+	minV, maxV := vals[0], vals[0]
+	for _, v := range vals {
+		sum += uint64(v)
+		minV = min(minV, v)
+		maxV = max(maxV, v)
+	}
+	if minV == maxV {
+		return blockFit{thr: minV, fg: minV, bg: minV}
+	}
+
+	n := uint64(len(vals))
+	avg := uint8((sum + n/2) / n)
+	best := blockFit{thr: avg, fg: avg, bg: avg}
+	bestCost := best.sse(vals) + lambda*best.bits(len(vals))
+	try := func(thr uint8) blockFit {
+		f := fitBlockThreshold(vals, thr)
+		if c := f.sse(vals) + lambda*f.bits(len(vals)); c < bestCost {
+			best, bestCost = f, c
+		}
+		return f
+	}
+
+	f := try(uint8(sum / n))
+	try(uint8((uint16(minV) + uint16(maxV) + 1) / 2))
+	for range 4 {
+		if !f.pattern {
+			break
+		}
+		next := uint8((uint16(f.fg) + uint16(f.bg) + 1) / 2)
+		if next == f.thr {
+			break
+		}
+		f = try(next)
+	}
+	return best
+}
+
+// Block modelling methods for Encoder.BlockMethod. They only change how the
+// encoder picks the threshold and the two levels, so every method produces
+// the same format and decodes with any decoder.
+const (
+	// BlockMethodDefault thresholds at the block mean with class-mean levels;
+	// from effort level 2 on it searches several thresholds per block.
+	BlockMethodDefault = iota
+	// BlockMethodAMBTC is absolute-moment BTC: mean threshold, rounded
+	// class means as levels.
+	BlockMethodAMBTC
+	// BlockMethodMoment is moment-preserving BTC: mean threshold, levels that
+	// keep the block mean and variance.
+	BlockMethodMoment
+	// BlockMethodOtsu uses the threshold with the largest between-class
+	// variance and class-mean levels.
+	BlockMethodOtsu
+	// BlockMethod2Means iterates threshold and class means to convergence.
+	BlockMethod2Means
+	// BlockMethodBest tries every method (and a solid block) per block and
+	// keeps the one with the lowest RD cost.
+	BlockMethodBest
+)
+
+// fitBlockAMBTC is fitBlockThreshold at the (truncated) block mean.
+func fitBlockAMBTC(vals []uint8) blockFit {
+	var sum uint64
+	for _, v := range vals {
+		sum += uint64(v)
+	}
+	return fitBlockThreshold(vals, uint8(sum/uint64(len(vals))))
+}
+
+// fitBlockMoment returns the moment-preserving BTC fit: pixels at or above
+// the mean take mean + sigma*sqrt(p/q), the rest mean - sigma*sqrt(q/p),
+// where q pixels are at or above the mean and p below it.
+func fitBlockMoment(vals []uint8) blockFit {
+	var sum, sum2 float64
+	for _, v := range vals {
+		f := float64(v)
+		sum += f
+		sum2 += f * f
+	}
+	n := float64(len(vals))
+	mean := sum / n
+	sigma := math.Sqrt(max(sum2/n-mean*mean, 0))
+	thr := uint8(math.Ceil(mean))
+
+	var q float64
+	for _, v := range vals {
+		if v >= thr {
+			q++
+		}
+	}
+	p := n - q
+	if q == 0 || p == 0 {
+		avg := clampLevel(mean)
+		return blockFit{thr: thr, fg: avg, bg: avg}
+	}
+	fg := clampLevel(mean + sigma*math.Sqrt(p/q))
+	bg := clampLevel(mean - sigma*math.Sqrt(q/p))
+	return blockFit{thr: thr, fg: fg, bg: bg, pattern: fg != bg}
+}
+
+// fitBlockOtsu picks the threshold maximising the between-class variance
+// w0*w1*(m0-m1)^2 and uses the rounded class means as levels.
+func fitBlockOtsu(vals []uint8) blockFit {
+	var hist [256]uint32
+	var total uint64
+	for _, v := range vals {
+		hist[v]++
+		total += uint64(v)
+	}
+	n := uint64(len(vals))
+
+	bestThr := -1
+	bestScore := -1.0
+	var cnt0, sum0 uint64
+	for t := 1; t < 256; t++ {
+		// class 0 is [0, t), class 1 is [t, 255]
+		cnt0 += uint64(hist[t-1])
+		sum0 += uint64(hist[t-1]) * uint64(t-1)
+		if hist[t] == 0 || cnt0 == 0 {
+			continue
+		}
+		if cnt0 == n {
+			break
+		}
+		cnt1 := n - cnt0
+		d := float64(sum0)/float64(cnt0) - float64(total-sum0)/float64(cnt1)
+		if score := float64(cnt0) * float64(cnt1) * d * d; score > bestScore {
+			bestThr, bestScore = t, score
+		}
+	}
+	if bestThr < 0 {
+		return fitBlockAMBTC(vals)
+	}
+	return fitBlockThreshold(vals, uint8(bestThr))
+}
+
+// fitBlock2Means runs Lloyd iterations from the mean split until the
+// threshold (the midpoint of the two levels) no longer moves.
+func fitBlock2Means(vals []uint8) blockFit {
+	f := fitBlockAMBTC(vals)
+	for range 16 {
+		if !f.pattern {
+			break
+		}
+		next := uint8((uint16(f.fg) + uint16(f.bg) + 1) / 2)
+		if next == f.thr {
+			break
+		}
+		f = fitBlockThreshold(vals, next)
+	}
+	return f
+}
+
+// fitBlockBest runs every method plus the threshold search and keeps the fit
+// with the lowest RD cost sse + lambda*bits.
+func fitBlockBest(vals []uint8, lambda float64) blockFit {
+	best := fitBlockSearch(vals, lambda)
+	if len(vals) == 1 {
+		return best
+	}
+	bestCost := best.sse(vals) + lambda*best.bits(len(vals))
+	for _, f := range [...]blockFit{
+		fitBlockAMBTC(vals),
+		fitBlockMoment(vals),
+		fitBlockOtsu(vals),
+		fitBlock2Means(vals),
+	} {
+		if c := f.sse(vals) + lambda*f.bits(len(vals)); c < bestCost {
+			best, bestCost = f, c
+		}
+	}
+	return best
+}
+
+// fitBlockBounded returns a fit whose per-pixel error is at most bound, and
+// whether one exists: the values must form at most two groups, each within
+// 2*bound levels, around the minimum and the maximum.
+func fitBlockBounded(vals []uint8, bound int) (blockFit, bool) {
+	lo, hi := int(vals[0]), int(vals[0])
+	for _, v := range vals[1:] {
+		lo = min(lo, int(v))
+		hi = max(hi, int(v))
+	}
+	if hi-lo <= 2*bound {
+		m := uint8((lo + hi) / 2)
+		return blockFit{thr: m, fg: m, bg: m}, true
+	}
+
+	// thr is the smallest value outside the low group, maxLow the largest
+	// inside it.
+	thr, maxLow := hi, lo
+	for _, v := range vals {
+		if x := int(v); x > lo+2*bound {
+			thr = min(thr, x)
+		} else {
+			maxLow = max(maxLow, x)
+		}
+	}
+	if thr < hi-2*bound {
+		return blockFit{}, false
+	}
+	return blockFit{
+		thr:     uint8(thr),
+		fg:      uint8((thr + hi) / 2),
+		bg:      uint8((lo + maxLow) / 2),
+		pattern: true,
+	}, true
+}
+
+// clampLevel rounds v to the nearest level in [0, 255].
+func clampLevel(v float64) uint8 {
+	return uint8(min(max(math.Round(v), 0), 255))
+}
+
+// sse returns the squared error of the fit over vals.
+func (f blockFit) sse(vals []uint8) float64 {
+	var sse float64
+	for _, v := range vals {
+		ref := f.fg
+		if f.pattern && v < f.thr {
+			ref = f.bg
+		}
+		d := float64(int32(v) - int32(ref))
+		sse += d * d
+	}
+	return sse
+}
+
+// bits estimates the coded size of the fit for a block of n pixels.
+func (f blockFit) bits(n int) float64 {
+	bits := 1 + rdLevelBits
+	if f.pattern {
+		bits += rdLevelBits + float64(n)
+	}
+	return bits
+}
+
+// lambda returns the RD multiplier for a spread threshold and small block,
+// including the scale varied by parameter trials.
+func (e *Encoder) lambda(spread int32, small int) float64 {
+	scale := e.lambdaScale
+	if scale <= 0 {
+		scale = 1
+	}
+	return scale * rdLambdaForSpread(spread, small)
+}
+
+// fitBlock picks the block model for the encoder's method and effort level.
+func (e *Encoder) fitBlock(vals []uint8, lambda float64) blockFit {
+	if len(vals) == 1 {
+		return blockFit{thr: vals[0], fg: vals[0], bg: vals[0]}
+	}
+	if e.maxErr >= 0 {
+		f, _ := fitBlockBounded(vals, e.maxErr)
+		return f
+	}
+	switch e.BlockMethod {
+	case BlockMethodAMBTC:
+		return fitBlockAMBTC(vals)
+	case BlockMethodMoment:
+		return fitBlockMoment(vals)
+	case BlockMethodOtsu:
+		return fitBlockOtsu(vals)
+	case BlockMethod2Means:
+		return fitBlock2Means(vals)
+	case BlockMethodBest:
+		return fitBlockBest(vals, lambda)
+	}
+	if e.Effort >= effortThresholds {
+		return fitBlockSearch(vals, lambda)
+	}
+	return fitBlockMean(vals)
+}
+
+// blockCost returns the squared error and estimated bits of coding one block.
+func (e *Encoder) blockCost(plane []uint8, stride, x0, y0, bw, bh int, lambda float64) (float64, float64) {
+	var buf [64]uint8
+	vals := readBlockValues(plane, stride, x0, y0, bw, bh, buf[:])
+	if len(vals) == 1 {
+		return 0, 1 + rdLevelBits
+	}
+	f := e.fitBlock(vals, lambda)
+	return f.sse(vals), f.bits(len(vals))
+}
+
+// rdUseBigBlockChannel is the rate-distortion counterpart of canUseBigBlockChannel.
+// It compares the cost D + lambda*R of coding the macroBlock region as one block
+// against splitting it into a grid of small blocks.
+func (e *Encoder) rdUseBigBlockChannel(plane []uint8, stride, height, x0, y0 int, lambda float64) bool {
+	if stride <= 0 || height <= 0 || x0 < 0 || y0 < 0 || macroBlock <= 0 || smallBlock <= 0 {
+		return false
+	}
+	if x0+macroBlock > stride || y0+macroBlock > height {
+		return false
+	}
+
+	dBig, rBig := e.blockCost(plane, stride, x0, y0, macroBlock, macroBlock, lambda)
+	costBig := dBig + lambda*rBig
+
+	var costSmall float64
+	for by := 0; by < macroBlock; by += smallBlock {
+		for bx := 0; bx < macroBlock; bx += smallBlock {
+			d, r := e.blockCost(plane, stride, x0+bx, y0+by, smallBlock, smallBlock, lambda)
+			costSmall += d + lambda*r
+			if costSmall > costBig {
+				return true
+			}
+		}
+	}
+	return costBig <= costSmall
+}
+
+// useBigBlock picks the macro/small decision strategy for the encoder's effort level.
+func (e *Encoder) useBigBlock(plane []uint8, stride, height, x0, y0 int, spread int32) bool {
+	if e.Effort >= effortRD {
+		return e.rdUseBigBlockChannel(plane, stride, height, x0, y0, e.lambda(spread, smallBlock))
+	}
+	return canUseBigBlockChannel(plane, stride, height, x0, y0, spread)
+}
+
+// encodeBlock encodes one block like encodeBlockPlane, using the encoder's
+// block method; by default from effortThresholds on it searches several
+// thresholds and keeps the fit with the lowest RD cost. With lin the levels
+// are linear-light means.
+func (e *Encoder) encodeBlock(plane []uint8, stride, height, x0, y0, bw, bh int, spread int32, lin *transferLUT, pw *bitWriter) (uint8, uint8, bool, error) {
+	if (e.Effort < effortThresholds && e.BlockMethod == BlockMethodDefault && lin == nil) || bw*bh == 1 {
+		return encodeBlockPlane(plane, stride, height, x0, y0, bw, bh, pw)
+	}
+	if x0 < 0 || y0 < 0 || bw <= 0 || bh <= 0 || x0+bw > stride || y0+bh > height {
+		return 0, 0, false, fmt.Errorf("encodeBlock: index out of range")
+	}
+
+	var buf [64]uint8
+	if bw*bh > len(buf) {
+		return 0, 0, false, fmt.Errorf("encodeBlock: block too large")
+	}
+	vals := readBlockValues(plane, stride, x0, y0, bw, bh, buf[:])
+	f := e.fitBlock(vals, e.lambda(spread, smallBlock))
+	if lin != nil {
+		f = lin.levels(f, vals)
+	}
+	if !f.pattern {
+		return f.fg, f.fg, false, nil
+	}
+	if pw != nil {
+		for _, v := range vals {
+			pw.writeBit(v >= f.thr)
+		}
+	}
+	return f.fg, f.bg, true, nil
+}
+
 // encodeBlockPlane encodes a single block for one planar channel:
 // - computes a mean-based threshold
 // - computes FG/BG levels
@@ -1115,6 +2022,13 @@ type encoderChannelScratch struct {
 	patternBuf bytes.Buffer
 	fgVals     []uint8
 	bgVals     []uint8
+	blockVals  []uint8
+
+	// featCopy
+	copyVals []byte
+	copyHead []int32
+	copyPrev []int32
+	recon    []uint8
 }
 
 type encodeChannelSpec struct {
@@ -1129,21 +2043,76 @@ type encodeChannelResult struct {
 	patternBytes []byte
 	fgVals       []uint8
 	bgVals       []uint8
+	copyBytes    []byte // featCopy, nil otherwise
 	err          error
+
+	// tonesCoded marks fgVals/bgVals as final payloads that are written
+	// as-is rather than delta-packed.
+	tonesCoded bool
+}
+
+// writeChannelResult writes one channel segment (see readChannelSegment).
+func writeChannelResult(w *bufio.Writer, res *encodeChannelResult) error {
+	if err := writeU32BE(w, res.blockCount); err != nil {
+		return err
+	}
+	for _, stream := range [...][]byte{res.sizeBytes, res.typeBytes, res.patternBytes} {
+		if err := writeU32BE(w, uint32(len(stream))); err != nil {
+			return err
+		}
+		if _, err := w.Write(stream); err != nil {
+			return err
+		}
+	}
+	for _, vals := range [...][]uint8{res.fgVals, res.bgVals} {
+		if err := writeU32BE(w, uint32(len(vals))); err != nil {
+			return err
+		}
+		if res.tonesCoded {
+			if _, err := w.Write(vals); err != nil {
+				return err
+			}
+		} else if err := writeDeltaPackedBytes(w, vals); err != nil {
+			return err
+		}
+	}
+	if res.copyBytes != nil {
+		if err := writeU32BE(w, uint32(len(res.copyBytes))); err != nil {
+			return err
+		}
+		if _, err := w.Write(res.copyBytes); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func encodeChannelWorker(e *Encoder, dst *encodeChannelResult, plane []uint8, stride, w4, h4, fullW, fullH int, useMacro bool, scratch *encoderChannelScratch, wg *sync.WaitGroup) {
+func encodeChannelWorker(e *Encoder, dst *encodeChannelResult, ch int, plane []uint8, stride, w4, h4, fullW, fullH int, useMacro bool, scratch *encoderChannelScratch, wg *sync.WaitGroup) {
 	defer wg.Done()
-	blockCount, sizeBytes, typeBytes, patternBytes, fgVals, bgVals, err := e.encodeChannelReuse(plane, stride, w4, h4, fullW, fullH, useMacro, scratch)
+	blockCount, sizeBytes, typeBytes, patternBytes, fgVals, bgVals, err := e.encodeChannelReuse(ch, plane, stride, w4, h4, fullW, fullH, useMacro, scratch)
 	dst.blockCount = blockCount
 	dst.sizeBytes = sizeBytes
 	dst.typeBytes = typeBytes
 	dst.patternBytes = patternBytes
 	dst.fgVals = fgVals
 	dst.bgVals = bgVals
+	dst.tonesCoded = e.hdr.features&featPredict != 0
+	dst.copyBytes = e.copyStream(scratch)
 	dst.err = err
 }
 
+// copyStream returns the copy stream of a channel coded with scratch, or nil
+// without featCopy.
+func (e *Encoder) copyStream(scratch *encoderChannelScratch) []byte {
+	if e.hdr.features&featCopy == 0 {
+		return nil
+	}
+	if scratch.copyVals == nil {
+		scratch.copyVals = []byte{}
+	}
+	return scratch.copyVals
+}
+
 // Encoder reuses large scratch buffers across Encode calls to reduce allocations.
 // It is not safe for concurrent use. The returned []byte is reused and will be
 // overwritten on the next Encode call.
@@ -1152,22 +2121,187 @@ type Encoder struct {
 	// Set to false to reduce goroutine overhead and allocations.
 	Parallel bool
 
+	// Effort trades encode speed for compression, from EffortFastest (the
+	// fast heuristics) to EffortSlowest. Higher levels enable RD block
+	// decisions, threshold search, stronger zstd and parameter trials; they
+	// are slower but usually produce smaller files at the same quality.
+	Effort int
+
+	// RootBlock enables the quadtree layout when > 0: the image is tiled with
+	// root blocks of about RootBlock pixels that split recursively down to
+	// the small block size. 0 keeps the two-level macro/small layout.
+	RootBlock int
+
+	// RectBlocks lets blocks split into two halves as well as quadrants, so
+	// the encoder can pick rectangular shapes such as 2x1, 1x2, 4x2 or 2x4
+	// where they fit the content better. It implies the quadtree layout,
+	// with root blocks of macroBlock size unless RootBlock is set.
+	RectBlocks bool
+
+	// Joint codes the channels together: one block tree per image and one
+	// pattern per block, clustered in colour, with two YCbCr tones per block
+	// instead of a pattern per channel. It implies the quadtree layout.
+	Joint bool
+
+	// Predict stores block levels as residuals from a prediction out of the
+	// neighbouring blocks instead of deltas in coding order, which suits
+	// gradients and flat areas. It implies the quadtree layout and is ignored
+	// with a palette.
+	Predict bool
+
+	// Gradients adds a block type that reproduces a bilinear ramp between
+	// four corner levels, chosen where it costs less than a flat or
+	// two-tone block; it removes banding in smooth regions. It implies the
+	// quadtree layout and is not used with Joint or PaletteSize.
+	Gradients bool
+
+	// MultiLevel adds a block type with three or four levels and a 2-bit
+	// index per pixel, chosen where it costs less than a two-tone block or a
+	// split; it keeps antialiased edges and fine texture in larger blocks.
+	// It implies the quadtree layout and is not used with Joint or
+	// PaletteSize.
+	MultiLevel bool
+
+	// BlockCopy lets a block repeat an earlier identical or near-identical
+	// part of the image, given by a displacement, instead of coding its own
+	// pattern and levels; it suits screenshots, documents and pixel art. It
+	// implies the quadtree layout and is not used with Joint or PaletteSize.
+	BlockCopy bool
+
+	// PaletteSize enables the palette stage when > 0: block tones are
+	// clustered into a global palette of at most PaletteSize (up to 256)
+	// YCbCr colours, and blocks store palette indices. Palette mode codes
+	// the channels jointly, with one block tree and one pattern per block,
+	// on the quadtree layout.
+	PaletteSize int
+
+	// BlockMethod selects how block thresholds and levels are chosen
+	// (BlockMethodDefault, BlockMethodAMBTC, ...). All methods produce the
+	// same stream format.
+	BlockMethod int
+
+	// ColorSpace selects the colour transform of the stored planes and is
+	// recorded in the header: ColorBT601 (the default), ColorBT709,
+	// ColorBT2020 or ColorYCoCg, optionally with ColorLimited for studio
+	// range, or ColorRGB. ColorYCoCgR is only exact without loss, so lossy
+	// streams get ColorYCoCg instead; Lossless always uses ColorYCoCgR and
+	// MaxError ColorRGB.
+	ColorSpace int
+
+	// Profile is the ICC profile of the source image's colour space, nil
+	// for sRGB. It is stored in the stream unchanged, and the planes keep
+	// the source values, so wide-gamut images keep their gamut; decoders
+	// return it (Decoder.Profile) or convert to sRGB (Decoder.ToSRGB).
+	// ExtractICC reads it from PNG and JPEG files.
+	Profile []byte
+
+	// Lossless makes the stream reproduce the RGB values of the source
+	// exactly: planes use the reversible YCoCg-R transform and blocks
+	// split down to single pixels until every block is exact. The quality
+	// argument is ignored; Joint and PaletteSize are not used.
+	Lossless bool
+
+	// MaxError, when > 0, selects near-lossless coding: no decoded R, G or
+	// B value differs from the source by more than MaxError levels (Y in
+	// grayscale mode; the decoder postfilter is not covered). Planes hold
+	// RGB and blocks split down to single pixels where needed. The quality
+	// argument is ignored; Joint and PaletteSize are not used. Lossless
+	// takes precedence.
+	MaxError int
+
+	// ResidualStep, when > 0, appends a residual layer: the difference
+	// between the source and the decoded dual-tone image, quantized with
+	// this step (1 restores the source exactly, up to 255). Decoders can
+	// skip it (Decoder.SkipResidual) for a faster preview of the base.
+	ResidualStep int
+
+	// ROI is an optional importance map: 255 marks regions such as faces,
+	// logos and text that deserve more bits, 0 backgrounds that can do with
+	// fewer, and 128 is neutral. It is stretched over the image, so a map
+	// with one pixel per macro block works as well as a full-size mask. The
+	// encoder lowers the spread threshold and RD multiplier where the map is
+	// bright and raises them, and rounds levels more coarsely, where it is
+	// dark. It implies the quadtree layout and is ignored with an error
+	// bound (Lossless, MaxError).
+	ROI *image.Gray
+
+	// Adaptive scales the spread threshold of every block by the local
+	// activity (luma gradient energy): busy textures that mask errors get
+	// a larger threshold, smooth regions where errors show a smaller one.
+	// Smooth regions gain quality and files usually get smaller, so compare
+	// against a higher quality setting without it. It implies the quadtree
+	// layout and is ignored with an error bound.
+	Adaptive bool
+
+	// ChannelQuality overrides the quality argument for the Y, Cb and Cr
+	// channels (indexed by chY, chCb, chCr) where > 0. Each channel gets
+	// the small block, root block and spread threshold of its quality, so
+	// chroma can be simplified much more than luma, which the eye barely
+	// notices. It implies the quadtree layout and is ignored with Joint,
+	// PaletteSize and an error bound.
+	ChannelQuality [3]int
+
+	// ChromaFromLuma adds a chroma block type that reuses the pattern of the
+	// decoded luma and stores only its two levels, which saves the pattern
+	// bits of chroma edges that follow luma edges. Luma is then coded and
+	// decoded before chroma. It implies the quadtree layout and is not used
+	// with Joint or PaletteSize.
+	ChromaFromLuma bool
+
+	// LinearLight sets solid and two-tone levels to the mean of their
+	// pixels in linear light (sRGB transfer function) instead of the mean of
+	// the gamma-encoded values, so fine high-contrast detail such as thin
+	// text keeps its brightness. It applies to luma, and to every plane with
+	// ColorRGB; the decoder needs nothing extra. It is ignored with an error
+	// bound, Joint and PaletteSize.
+	LinearLight bool
+
+	// maxErr bounds the per-pixel error of every block in the stored
+	// planes; -1 leaves blocks to the quality heuristics.
+	maxErr int
+
+	// quality is the quality of each channel of the image being encoded.
+	quality [3]int
+
+	// lambdaScale multiplies the RD lambda; parameter trials vary it.
+	lambdaScale float64
+
+	// linear holds the transfer table of each channel with LinearLight,
+	// nil where levels are plain means.
+	linear [3]*transferLUT
+
+	// roi and activity are the ROI map and the activity map (Adaptive) of
+	// the image being encoded, empty when not in use.
+	roi      roiMap
+	activity activityMap
+
+	// hdr is the header of the stream being encoded.
+	hdr streamHeader
+
 	yPlane  []uint8
 	cbPlane []uint8
 	crPlane []uint8
 
-	raw  bytes.Buffer
-	bw   *bufio.Writer
-	comp []byte
+	residual []uint8
+
+	raw      bytes.Buffer
+	bw       *bufio.Writer
+	comp     []byte
+	compBest []byte
 
 	ch [3]encoderChannelScratch
 
-	zenc *zstd.Encoder
+	zenc     *zstd.Encoder
+	zencBest *zstd.Encoder
+
+	trialDec *Decoder
 }
 
 func NewEncoder() *Encoder {
 	e := &Encoder{}
 	e.Parallel = true
+	e.maxErr = -1
+	e.lambdaScale = 1
 	e.bw = bufio.NewWriter(&e.raw)
 	e.zenc = mustNewZstdEncoder()
 	return e
@@ -1186,7 +2320,12 @@ func (e *Encoder) ensurePlanes(w, h int) {
 	e.crPlane = e.crPlane[:n]
 }
 
-func (e *Encoder) encodeChannelReuse(plane []uint8, stride, w4, h4, fullW, fullH int, useMacro bool, scratch *encoderChannelScratch) (uint32, []byte, []byte, []byte, []uint8, []uint8, error) {
+func (e *Encoder) encodeChannelReuse(ch int, plane []uint8, stride, w4, h4, fullW, fullH int, useMacro bool, scratch *encoderChannelScratch) (uint32, []byte, []byte, []byte, []uint8, []uint8, error) {
+	if e.hdr.features&featTree != 0 {
+		return e.encodeChannelTree(ch, plane, stride, w4, h4, scratch)
+	}
+	lin := e.linear[ch]
+
 	// macro-block decision bits (only for main fullW x fullH area)
 	// Precompute an upper bound on the total block count so we can
 	// preallocate FG/BG slices and avoid repeated growth.
@@ -1268,7 +2407,7 @@ func (e *Encoder) encodeChannelReuse(plane []uint8, stride, w4, h4, fullW, fullH
 	height := h4
 	spread := allowedMacroSpreadForQuality(encQuality)
 
-	if useMacro && smallBlock == 1 && macroBlock == 2 {
+	if useMacro && smallBlock == 1 && macroBlock == 2 && e.Effort < effortRD && e.BlockMethod == BlockMethodDefault {
 		// Specialized hot path for the most common setting (quality >= 80):
 		// - macro blocks are 2x2
 		// - small blocks are 1x1 (always solid, no pattern bits)
@@ -1415,10 +2554,10 @@ func (e *Encoder) encodeChannelReuse(plane []uint8, stride, w4, h4, fullW, fullH
 	// main macroBlock x macroBlock area
 	for my := 0; my < fullH; my += macroBlock {
 		for mx := 0; mx < fullW; mx += macroBlock {
-			useBig := useMacro && canUseBigBlockChannel(plane, stride, height, mx, my, spread)
+			useBig := useMacro && e.useBigBlock(plane, stride, height, mx, my, spread)
 			sizeW.writeBit(useBig)
 			if useBig {
-				fg, bg, isPattern, err := encodeBlockPlane(plane, stride, height, mx, my, macroBlock, macroBlock, &patternW)
+				fg, bg, isPattern, err := e.encodeBlock(plane, stride, height, mx, my, macroBlock, macroBlock, spread, lin, &patternW)
 				if err != nil {
 					return 0, nil, nil, nil, nil, nil, err
 				}
@@ -1438,7 +2577,7 @@ func (e *Encoder) encodeChannelReuse(plane []uint8, stride, w4, h4, fullW, fullH
 						if smallBlock > 1 {
 							pw = &patternW
 						}
-						fg, bg, isPattern, err := encodeBlockPlane(plane, stride, height, xx, yy, smallBlock, smallBlock, pw)
+						fg, bg, isPattern, err := e.encodeBlock(plane, stride, height, xx, yy, smallBlock, smallBlock, spread, lin, pw)
 						if err != nil {
 							return 0, nil, nil, nil, nil, nil, err
 						}
@@ -1461,7 +2600,7 @@ func (e *Encoder) encodeChannelReuse(plane []uint8, stride, w4, h4, fullW, fullH
 			if smallBlock > 1 {
 				pw = &patternW
 			}
-			fg, bg, isPattern, err := encodeBlockPlane(plane, stride, height, mx, my, smallBlock, smallBlock, pw)
+			fg, bg, isPattern, err := e.encodeBlock(plane, stride, height, mx, my, smallBlock, smallBlock, spread, lin, pw)
 			if err != nil {
 				return 0, nil, nil, nil, nil, nil, err
 			}
@@ -1480,7 +2619,7 @@ func (e *Encoder) encodeChannelReuse(plane []uint8, stride, w4, h4, fullW, fullH
 			if smallBlock > 1 {
 				pw = &patternW
 			}
-			fg, bg, isPattern, err := encodeBlockPlane(plane, stride, height, mx, my, smallBlock, smallBlock, pw)
+			fg, bg, isPattern, err := e.encodeBlock(plane, stride, height, mx, my, smallBlock, smallBlock, spread, lin, pw)
 			if err != nil {
 				return 0, nil, nil, nil, nil, nil, err
 			}
@@ -1501,8 +2640,99 @@ func (e *Encoder) encodeChannelReuse(plane []uint8, stride, w4, h4, fullW, fullH
 }
 
 func (e *Encoder) Encode(img image.Image, quality int, bwmode bool) ([]byte, error) {
+	if e.Effort >= effortTrials {
+		return e.encodeTrials(img, quality, bwmode)
+	}
+	return e.encode(img, quality, bwmode)
+}
+
+// trialLambdaScales are the RD lambda multipliers tried at effortTrials.
+// The default scale comes first: it sets the error budget for the others.
+var trialLambdaScales = [...]float64{1, 0.5, 2}
+
+// encodeTrials encodes the image once per parameter candidate and keeps the
+// smallest result whose squared RGB error does not exceed that of the default
+// parameters, i.e. the smallest file at the same (or better) quality.
+func (e *Encoder) encodeTrials(img image.Image, quality int, bwmode bool) ([]byte, error) {
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	if e.trialDec == nil {
+		e.trialDec = NewDecoder()
+	}
+	defer func() { e.lambdaScale = 1 }()
+
+	var best []byte
+	baseErr := math.Inf(1)
+	for _, scale := range trialLambdaScales {
+		e.lambdaScale = scale
+		comp, err := e.encode(src, quality, bwmode)
+		if err != nil {
+			return nil, err
+		}
+		dec, err := e.trialDec.Decode(comp, false)
+		if err != nil {
+			return nil, err
+		}
+
+		var sse float64
+		for i := 0; i < len(src.Pix); i += 4 {
+			for c := range 3 {
+				d := float64(src.Pix[i+c]) - float64(dec.Pix[i+c])
+				sse += d * d
+			}
+		}
+		if scale == 1 {
+			baseErr = sse
+		}
+		if best == nil || (sse <= baseErr && len(comp) < len(best)) {
+			best = append(best[:0], comp...)
+		}
+	}
+
+	e.comp = append(e.comp[:0], best...)
+	return e.comp, nil
+}
+
+func (e *Encoder) encode(img image.Image, quality int, bwmode bool) ([]byte, error) {
 	encodeBW = bwmode
 
+	e.maxErr = -1
+	switch {
+	case e.Lossless:
+		e.maxErr = 0
+	case e.MaxError > 0:
+		e.maxErr = e.MaxError
+	}
+	if e.maxErr >= 0 {
+		quality = 100
+	}
+	// Per-channel qualities; the error bound and the joint layout use one
+	// quality for every channel.
+	perChannel := e.ChannelQuality != [3]int{} && e.maxErr < 0 && !e.Joint && e.PaletteSize <= 0
+	e.quality = [3]int{quality, quality, quality}
+	if perChannel {
+		for ch, q := range e.ChannelQuality {
+			if q > 0 {
+				e.quality[ch] = min(q, 100)
+			}
+		}
+		quality = e.quality[chY]
+	}
+	// The colour transform of the stored planes.
+	xform := uint8(e.ColorSpace)
+	switch {
+	case e.Lossless:
+		xform = ColorYCoCgR
+	case e.maxErr > 0 && !bwmode:
+		xform = ColorRGB
+	case xform == ColorYCoCgR:
+		xform = ColorYCoCg
+	}
+	if e.ColorSpace < 0 || e.ColorSpace > 255 || !validColor(xform) {
+		return nil, fmt.Errorf("unsupported colour space %#x", e.ColorSpace)
+	}
 	if err := setBlocksForQuality(quality); err != nil {
 		return nil, err
 	}
@@ -1513,29 +2743,72 @@ func (e *Encoder) Encode(img image.Image, quality int, bwmode bool) ([]byte, err
 	b := img.Bounds()
 	w := b.Dx()
 	h := b.Dy()
+	if w == 0 || h == 0 {
+		return nil, fmt.Errorf("empty image: %dx%d", w, h)
+	}
 
-	e.ensurePlanes(w, h)
-	if e.Parallel {
-		extractYCbCrPlanesInto(img, e.yPlane, e.cbPlane, e.crPlane)
-	} else {
-		extractYCbCrPlanesIntoSerial(img, e.yPlane, e.cbPlane, e.crPlane)
+	// Decide which channels will be stored. Y is always present; Cb/Cr
+	// may be omitted in grayscale mode.
+	channelsMask := byte(channelFlagY)
+	if !encodeBW {
+		channelsMask |= channelFlagCb | channelFlagCr
+	}
+	e.hdr = streamHeader{small: smallBlock, macro: macroBlock, channels: channelsMask, w: w, h: h}
+	bounded := e.maxErr >= 0
+	if e.RootBlock > 0 || e.RectBlocks || e.Joint || e.Predict || e.Gradients || e.MultiLevel || e.BlockCopy || e.ChromaFromLuma || e.ROI != nil || e.Adaptive || perChannel || e.PaletteSize > 0 || bounded {
+		e.hdr.features |= featTree
+		e.hdr.treeDepth = e.treeDepth(smallBlock, macroBlock)
+	}
+	if perChannel {
+		for _, ch := range e.hdr.chromaChannels() {
+			small, macro := blocksForQuality(e.quality[ch])
+			e.hdr.chanSmall[ch], e.hdr.chanDepth[ch] = small, e.treeDepth(small, macro)
+			if small != e.hdr.small || e.hdr.chanDepth[ch] != e.hdr.treeDepth {
+				e.hdr.features |= featChannelGeom
+			}
+		}
+		if e.hdr.features&featChannelGeom == 0 {
+			e.hdr.chanSmall = [3]int{}
+		}
+	}
+
+	// Planes cover whole blocks; partial edge blocks are padded with
+	// replicated edge pixels and clipped again by the decoder.
+	w4 := paddedSize(w, e.hdr.blockAlign())
+	h4 := paddedSize(h, e.hdr.blockAlign())
+	e.ensurePlanes(w4, h4)
+	m := colorMatrixFor(xform)
+	switch {
+	case xform == ColorYCoCgR:
+		extractRGBPlanesInto(img, e.yPlane[:w*h], e.cbPlane[:w*h], e.crPlane[:w*h], rgbToYCoCgR)
+	case xform == ColorRGB:
+		extractRGBPlanesInto(img, e.yPlane[:w*h], e.cbPlane[:w*h], e.crPlane[:w*h], rgbIdentity)
+	case e.Parallel:
+		extractYCbCrPlanesInto(m, img, e.yPlane[:w*h], e.cbPlane[:w*h], e.crPlane[:w*h])
+	default:
+		extractYCbCrPlanesIntoSerial(m, img, e.yPlane[:w*h], e.cbPlane[:w*h], e.crPlane[:w*h])
+	}
+	padded := w4 != w || h4 != h
+	if padded {
+		for _, p := range [...][]uint8{e.yPlane, e.cbPlane, e.crPlane} {
+			padPlane(p, w, h, w4, h4)
+		}
 	}
-
-	// Decide which channels will be stored. Y is always present; Cb/Cr
-	// may be omitted in grayscale mode.
-	channelsMask := byte(channelFlagY)
-	if !encodeBW {
-		channelsMask |= channelFlagCb | channelFlagCr
+	e.roi.sum = e.roi.sum[:0]
+	if e.ROI != nil && e.maxErr < 0 {
+		if e.ROI.Bounds().Empty() {
+			return nil, fmt.Errorf("empty ROI map")
+		}
+		e.roi = newROIMap(e.ROI, w, h, w4, h4, e.roi.sum)
+	}
+	e.activity.logs = e.activity.logs[:0]
+	if e.Adaptive && e.maxErr < 0 {
+		e.activity = newActivityMap(e.yPlane, w4, h4, e.activity.logs)
 	}
 
 	e.raw.Reset()
 	e.bw.Reset(&e.raw)
 
-	w4 := (w / smallBlock) * smallBlock
-	h4 := (h / smallBlock) * smallBlock
-	if w4 == 0 || h4 == 0 {
-		return nil, fmt.Errorf("image too small for %dx%d blocks: %dx%d", smallBlock, smallBlock, w, h)
-	}
 	fullW := (w4 / macroBlock) * macroBlock
 	fullH := (h4 / macroBlock) * macroBlock
 
@@ -1546,23 +2819,86 @@ func (e *Encoder) Encode(img image.Image, quality int, bwmode bool) ([]byte, err
 	useMacro := macroBlock > smallBlock
 
 	// --- Write header ---
-	if _, err := e.bw.WriteString(codec); err != nil {
-		return nil, err
+	if padded {
+		e.hdr.features |= featPadded
 	}
-	if err := writeU16BE(e.bw, uint16(smallBlock)); err != nil {
-		return nil, err
+	if xform != ColorBT601 {
+		e.hdr.features |= featColor
+		e.hdr.color = uint8(xform)
 	}
-	if err := writeU16BE(e.bw, uint16(macroBlock)); err != nil {
-		return nil, err
+	if e.Profile != nil {
+		if err := checkICCHeader(e.Profile); err != nil {
+			return nil, err
+		}
+		if len(e.Profile) > maxICCSize {
+			return nil, fmt.Errorf("icc: profile too large")
+		}
+		e.hdr.features |= featICC
+		e.hdr.icc = e.Profile
 	}
-	// channels mask: which Y/Cb/Cr planes are stored.
-	if err := e.bw.WriteByte(channelsMask); err != nil {
-		return nil, err
+	if e.RectBlocks {
+		e.hdr.features |= featRect
 	}
-	if err := writeU32BE(e.bw, uint32(w)); err != nil {
-		return nil, err
+	// Joint tones are not fitted against an error bound.
+	if e.Joint && !bounded {
+		e.hdr.features |= featJoint
+	}
+	if e.PaletteSize > 0 && !bounded {
+		e.hdr.features |= featJoint | featPalette
+	} else if e.Predict {
+		e.hdr.features |= featPredict
+	}
+
+	if e.Gradients && e.hdr.features&featJoint == 0 {
+		e.hdr.features |= featGradient
+	}
+	if e.MultiLevel && e.hdr.features&featJoint == 0 {
+		e.hdr.features |= featMultiLevel
+	}
+	if e.BlockCopy && e.hdr.features&featJoint == 0 {
+		e.hdr.features |= featCopy
+	}
+	if e.ChromaFromLuma && e.hdr.features&featJoint == 0 && !encodeBW {
+		e.hdr.features |= featChromaFromLuma
+	}
+	// Linear-light levels for the planes that hold sRGB-encoded intensities.
+	e.linear = [3]*transferLUT{}
+	if e.LinearLight && !bounded && e.hdr.features&featJoint == 0 {
+		lut := srgbFull
+		if xform&ColorLimited != 0 {
+			lut = srgbLimited
+		}
+		e.linear[chY] = lut
+		if xform == ColorRGB {
+			e.linear[chCb], e.linear[chCr] = lut, lut
+		}
+	}
+	if e.ResidualStep > 0 {
+		e.hdr.features |= featResidual
+		e.hdr.residualStep = uint8(min(e.ResidualStep, 255))
+	}
+
+	if e.hdr.features&featJoint != 0 {
+		// The joint segment completes the header (palette), so it is
+		// encoded before the header is written.
+		planes := [][]uint8{e.yPlane}
+		if !encodeBW {
+			planes = append(planes, e.cbPlane, e.crPlane)
+		}
+		res := e.encodeJoint(planes, w4, w4, h4)
+		if err := e.hdr.write(e.bw); err != nil {
+			return nil, err
+		}
+		if err := writeChannelResult(e.bw, &res); err != nil {
+			return nil, err
+		}
+		if err := e.writeResidual(img, e.yPlane, w4); err != nil {
+			return nil, err
+		}
+		return e.finish()
 	}
-	if err := writeU32BE(e.bw, uint32(h)); err != nil {
+
+	if err := e.hdr.write(e.bw); err != nil {
 		return nil, err
 	}
 
@@ -1582,53 +2918,20 @@ func (e *Encoder) Encode(img image.Image, quality int, bwmode bool) ([]byte, err
 		for i := 0; i < chCount; i++ {
 			wg.Add(1)
 			ch := channels[i]
-			go encodeChannelWorker(e, &results[i], ch.plane, w, w4, h4, fullW, fullH, useMacro, &e.ch[ch.id], &wg)
+			go encodeChannelWorker(e, &results[i], ch.id, ch.plane, w4, w4, h4, fullW, fullH, useMacro, &e.ch[ch.id], &wg)
+			if ch.id == chY && e.hdr.features&featChromaFromLuma != 0 {
+				// Chroma leaves read the decoded luma.
+				wg.Wait()
+			}
 		}
 		wg.Wait()
 
 		for i := 0; i < chCount; i++ {
-			res := results[i]
+			res := &results[i]
 			if res.err != nil {
 				return nil, res.err
 			}
-
-			// number of blocks for this channel
-			if err := writeU32BE(e.bw, res.blockCount); err != nil {
-				return nil, err
-			}
-			// write size stream for this channel
-			if err := writeU32BE(e.bw, uint32(len(res.sizeBytes))); err != nil {
-				return nil, err
-			}
-			if _, err := e.bw.Write(res.sizeBytes); err != nil {
-				return nil, err
-			}
-			// write type stream for this channel
-			if err := writeU32BE(e.bw, uint32(len(res.typeBytes))); err != nil {
-				return nil, err
-			}
-			if _, err := e.bw.Write(res.typeBytes); err != nil {
-				return nil, err
-			}
-			// write pattern stream for this channel
-			if err := writeU32BE(e.bw, uint32(len(res.patternBytes))); err != nil {
-				return nil, err
-			}
-			if _, err := e.bw.Write(res.patternBytes); err != nil {
-				return nil, err
-			}
-
-			if err := writeU32BE(e.bw, uint32(len(res.fgVals))); err != nil {
-				return nil, err
-			}
-			if err := writeDeltaPackedBytes(e.bw, res.fgVals); err != nil {
-				return nil, err
-			}
-
-			if err := writeU32BE(e.bw, uint32(len(res.bgVals))); err != nil {
-				return nil, err
-			}
-			if err := writeDeltaPackedBytes(e.bw, res.bgVals); err != nil {
+			if err := writeChannelResult(e.bw, res); err != nil {
 				return nil, err
 			}
 		}
@@ -1637,54 +2940,57 @@ func (e *Encoder) Encode(img image.Image, quality int, bwmode bool) ([]byte, err
 		for i := 0; i < chCount; i++ {
 			ch := channels[i]
 			scratch := &e.ch[ch.id]
-			blockCount, sizeBytes, typeBytes, patternBytes, fgVals, bgVals, err := e.encodeChannelReuse(ch.plane, w, w4, h4, fullW, fullH, useMacro, scratch)
-			if err != nil {
-				return nil, err
-			}
-
-			if err := writeU32BE(e.bw, blockCount); err != nil {
-				return nil, err
-			}
-			if err := writeU32BE(e.bw, uint32(len(sizeBytes))); err != nil {
-				return nil, err
-			}
-			if _, err := e.bw.Write(sizeBytes); err != nil {
-				return nil, err
-			}
-			if err := writeU32BE(e.bw, uint32(len(typeBytes))); err != nil {
-				return nil, err
-			}
-			if _, err := e.bw.Write(typeBytes); err != nil {
-				return nil, err
-			}
-			if err := writeU32BE(e.bw, uint32(len(patternBytes))); err != nil {
-				return nil, err
+			res := encodeChannelResult{tonesCoded: e.hdr.features&featPredict != 0}
+			res.blockCount, res.sizeBytes, res.typeBytes, res.patternBytes, res.fgVals, res.bgVals, res.err = e.encodeChannelReuse(ch.id, ch.plane, w4, w4, h4, fullW, fullH, useMacro, scratch)
+			if res.err != nil {
+				return nil, res.err
 			}
-			if _, err := e.bw.Write(patternBytes); err != nil {
+			res.copyBytes = e.copyStream(scratch)
+			if err := writeChannelResult(e.bw, &res); err != nil {
 				return nil, err
 			}
+		}
+	}
 
-			if err := writeU32BE(e.bw, uint32(len(fgVals))); err != nil {
-				return nil, err
-			}
-			if err := writeDeltaPackedBytes(e.bw, fgVals); err != nil {
-				return nil, err
-			}
+	if err := e.writeResidual(img, e.yPlane, w4); err != nil {
+		return nil, err
+	}
+	return e.finish()
+}
 
-			if err := writeU32BE(e.bw, uint32(len(bgVals))); err != nil {
-				return nil, err
-			}
-			if err := writeDeltaPackedBytes(e.bw, bgVals); err != nil {
-				return nil, err
-			}
+// treeDepth returns the tree depth for a channel with the given preset: the
+// root block is RootBlock, or the macro block (boundedRootBlock with an
+// error bound).
+func (e *Encoder) treeDepth(small, macro int) int {
+	root := e.RootBlock
+	if root <= 0 {
+		root = macro
+		if e.maxErr >= 0 {
+			root = boundedRootBlock
 		}
 	}
+	return treeDepthFor(root, small)
+}
 
+// finish flushes the raw stream and compresses it with zstd.
+func (e *Encoder) finish() ([]byte, error) {
 	if err := e.bw.Flush(); err != nil {
 		return nil, err
 	}
 
 	e.comp = e.zenc.EncodeAll(e.raw.Bytes(), e.comp[:0])
+	if e.Effort >= effortBestZstd {
+		if e.zencBest == nil {
+			e.zencBest = mustNewZstdEncoderLevel(zstd.SpeedBestCompression)
+		}
+		// The strongest level is not always smaller on small streams; keep
+		// whichever output is, so slower efforts never produce larger files.
+		best := e.zencBest.EncodeAll(e.raw.Bytes(), e.compBest[:0])
+		if len(best) < len(e.comp) {
+			e.comp, best = best, e.comp
+		}
+		e.compBest = best
+	}
 	return e.comp, nil
 }
 
@@ -1709,7 +3015,19 @@ func Encode(img image.Image, quality int, bwmode bool) ([]byte, error) {
 		return nil, err
 	}
 
-	yPlane, cbPlane, crPlane, w, h := extractYCbCrPlanes(img)
+	yPlane, cbPlane, crPlane, w, h := extractYCbCrPlanes(colorMatrixFor(ColorBT601), img)
+	if w == 0 || h == 0 {
+		return nil, fmt.Errorf("empty image: %dx%d", w, h)
+	}
+	w4 := paddedSize(w, smallBlock)
+	h4 := paddedSize(h, smallBlock)
+	padded := w4 != w || h4 != h
+	if padded {
+		for _, p := range [...]*[]uint8{&yPlane, &cbPlane, &crPlane} {
+			*p = append(*p, make([]uint8, w4*h4-w*h)...)
+			padPlane(*p, w, h, w4, h4)
+		}
+	}
 
 	// Decide which channels will be stored. Y is always present; Cb/Cr
 	// may be omitted in grayscale mode.
@@ -1721,11 +3039,6 @@ func Encode(img image.Image, quality int, bwmode bool) ([]byte, error) {
 	var raw bytes.Buffer
 	bw := bufio.NewWriter(&raw)
 
-	w4 := (w / smallBlock) * smallBlock
-	h4 := (h / smallBlock) * smallBlock
-	if w4 == 0 || h4 == 0 {
-		return nil, fmt.Errorf("image too small for %dx%d blocks: %dx%d", smallBlock, smallBlock, w, h)
-	}
 	fullW := (w4 / macroBlock) * macroBlock
 	fullH := (h4 / macroBlock) * macroBlock
 
@@ -1736,23 +3049,11 @@ func Encode(img image.Image, quality int, bwmode bool) ([]byte, error) {
 	useMacro := macroBlock > smallBlock
 
 	// --- Write header ---
-	if _, err := bw.WriteString(codec); err != nil {
-		return nil, err
-	}
-	if err := writeU16BE(bw, uint16(smallBlock)); err != nil {
-		return nil, err
+	hdr := streamHeader{small: smallBlock, macro: macroBlock, channels: channelsMask, w: w, h: h}
+	if padded {
+		hdr.features |= featPadded
 	}
-	if err := writeU16BE(bw, uint16(macroBlock)); err != nil {
-		return nil, err
-	}
-	// channels mask: which Y/Cb/Cr planes are stored.
-	if err := bw.WriteByte(channelsMask); err != nil {
-		return nil, err
-	}
-	if err := writeU32BE(bw, uint32(w)); err != nil {
-		return nil, err
-	}
-	if err := writeU32BE(bw, uint32(h)); err != nil {
+	if err := hdr.write(bw); err != nil {
 		return nil, err
 	}
 
@@ -1790,7 +3091,7 @@ func Encode(img image.Image, quality int, bwmode bool) ([]byte, error) {
 		go func(i int) {
 			defer wg.Done()
 			ch := channels[i]
-			blockCount, sizeBytes, typeBytes, patternBytes, fgVals, bgVals, err := encodeChannel(ch.plane, w, w4, h4, fullW, fullH, useMacro)
+			blockCount, sizeBytes, typeBytes, patternBytes, fgVals, bgVals, err := encodeChannel(ch.plane, w4, w4, h4, fullW, fullH, useMacro)
 			results[i] = channelResult{
 				blockCount:   blockCount,
 				sizeBytes:    sizeBytes,
@@ -2025,8 +3326,9 @@ func fillBlockPix(pix []byte, strideBytes int, x0, y0, bw, bh int, val uint8, ch
 
 // readChannelSegment returns a zero-copy slice of the next channel stream
 // (as written by Encode) from the decompressed payload. It advances *pos
-// to the byte immediately after this segment.
-func readChannelSegment(data []byte, pos *int) ([]byte, error) {
+// to the byte immediately after this segment. copies selects the copy stream
+// of featCopy.
+func readChannelSegment(data []byte, pos *int, copies bool) ([]byte, error) {
 	start := *pos
 
 	readU32 := func(label string) (uint32, error) {
@@ -2093,6 +3395,17 @@ func readChannelSegment(data []byte, pos *int) ([]byte, error) {
 	}
 	*pos += int(bgPackedLen)
 
+	if copies {
+		copyLen, err := readU32("copyLen")
+		if err != nil {
+			return nil, err
+		}
+		if uint32(len(data)-*pos) < copyLen {
+			return nil, fmt.Errorf("readChannelSegment: truncated copy stream")
+		}
+		*pos += int(copyLen)
+	}
+
 	end := *pos
 	if end < start || end > len(data) {
 		return nil, fmt.Errorf("readChannelSegment: invalid segment bounds")
@@ -2422,6 +3735,10 @@ func decodeChannel(data []byte, imgW, imgH int) ([]uint8, error) {
 type decoderChannelScratch struct {
 	plane    []uint8
 	macroBig []bool
+
+	// tree layout: the leaf decoder and its featPredict level map
+	leaf   channelLeafDecoder
+	levels levelMap
 }
 
 // Decoder reuses large scratch buffers across Decode calls to reduce allocations.
@@ -2432,7 +3749,17 @@ type Decoder struct {
 	// Set to false to reduce goroutine overhead and allocations.
 	Parallel bool
 
+	// SkipResidual ignores the residual layer of streams that carry one
+	// (see Encoder.ResidualStep) and returns the base image.
+	SkipResidual bool
+
+	// ToSRGB converts the output of streams that carry an ICC profile
+	// (see Encoder.Profile) to sRGB. Only matrix/TRC profiles are
+	// supported; others make Decode fail.
+	ToSRGB bool
+
 	payload []byte
+	profile []byte // ICC profile of the last stream
 	zdec    *zstd.Decoder
 
 	y  decoderChannelScratch
@@ -2441,6 +3768,20 @@ type Decoder struct {
 
 	neutral []uint8
 	dst     *image.RGBA
+	padPix  []byte // coded-size YCbCr buffer for padded streams
+
+	// outputs of DecodeImage and DecodeYCbCr
+	gray  *image.Gray
+	ycbcr *image.YCbCr
+
+	// header and per-channel errors of the stream being decoded, kept here
+	// so decoding does not allocate
+	hdr   streamHeader
+	chErr [3]error
+
+	joint jointDecodeScratch
+
+	scaled scaledPlanes // DecodeScaled
 }
 
 func NewDecoder() *Decoder {
@@ -3190,6 +4531,15 @@ func (d *Decoder) decodeChannelInto(data []byte, imgW, imgH int, scratch *decode
 }
 
 func (d *Decoder) Decode(compData []byte, postfilter bool) (*image.RGBA, error) {
+	payload, err := d.inflate(compData)
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeRGBA(payload, postfilter)
+}
+
+// inflate decompresses a stream into d.payload.
+func (d *Decoder) inflate(compData []byte) ([]byte, error) {
 	if d.zdec == nil {
 		d.zdec = mustNewZstdDecoder()
 	}
@@ -3198,148 +4548,242 @@ func (d *Decoder) Decode(compData []byte, postfilter bool) (*image.RGBA, error)
 		return nil, fmt.Errorf("zstd decode: %w", err)
 	}
 	d.payload = payload
+	return payload, nil
+}
 
-	if len(payload) < len(codec) {
-		return nil, fmt.Errorf("read header: short magic")
-	}
-	pos := 0
-
-	// magic
-	if string(payload[pos:pos+len(codec)]) != codec {
-		return nil, fmt.Errorf("bad magic: %q", string(payload[pos:pos+len(codec)]))
-	}
-	pos += len(codec)
-
-	readU16 := func(label string) (uint16, error) {
-		if len(payload)-pos < 2 {
-			return 0, fmt.Errorf("decode: truncated while reading %s", label)
-		}
-		v := binary.BigEndian.Uint16(payload[pos : pos+2])
-		pos += 2
-		return v, nil
+// decodeRGBA decodes a decompressed stream like Decode.
+func (d *Decoder) decodeRGBA(payload []byte, postfilter bool) (*image.RGBA, error) {
+	img, err := d.decodePayload(payload, postfilter, !d.SkipResidual)
+	if err != nil || !d.ToSRGB || d.profile == nil {
+		return img, err
 	}
-	readU32 := func(label string) (uint32, error) {
-		if len(payload)-pos < 4 {
-			return 0, fmt.Errorf("decode: truncated while reading %s", label)
-		}
-		v := binary.BigEndian.Uint32(payload[pos : pos+4])
-		pos += 4
-		return v, nil
+	p, err := ParseICC(d.profile)
+	if err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
 	}
+	p.ToSRGB(img)
+	return img, nil
+}
 
-	bwSize, err := readU16("block width")
+// DecodeInto decodes compData into dst with the image's top-left corner at
+// offset, which lets callers decode into pooled frames, upload buffers or
+// a part of a larger canvas; pixels of dst outside the image are left
+// alone. The image must fit inside dst.Bounds(). There is no postfilter.
+// With Parallel off, once the decoder's scratch buffers have grown to the
+// image size, it does not allocate (ToSRGB aside).
+func (d *Decoder) DecodeInto(dst *image.RGBA, offset image.Point, compData []byte) error {
+	payload, err := d.inflate(compData)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	bhSize, err := readU16("block height")
+	hdr, pos, err := d.readHeader(payload)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if bwSize == 0 || bhSize == 0 {
-		return nil, fmt.Errorf("invalid block sizes in header: %dx%d", bwSize, bhSize)
+	r := image.Rect(0, 0, hdr.w, hdr.h).Add(offset)
+	// An empty r is In any rectangle; the offset must still lie inside.
+	if dst == nil || !r.In(dst.Rect) || !offset.In(dst.Rect) {
+		var bounds image.Rectangle
+		if dst != nil {
+			bounds = dst.Rect
+		}
+		return fmt.Errorf("decode: %dx%d image at %v does not fit in %v", hdr.w, hdr.h, offset, bounds)
 	}
-	smallBlock = int(bwSize)
-	macroBlock = int(bhSize)
-
-	// channels mask: which Y/Cb/Cr planes are stored.
-	if len(payload)-pos < 1 {
-		return nil, fmt.Errorf("decode: truncated while reading channels mask")
+	sub := image.RGBA{
+		Pix:    dst.Pix[dst.PixOffset(r.Min.X, r.Min.Y):],
+		Stride: dst.Stride,
+		Rect:   image.Rect(0, 0, hdr.w, hdr.h),
 	}
-	channelsMask := payload[pos]
-	pos++
-	if channelsMask&channelFlagY == 0 {
-		return nil, fmt.Errorf("decode: Y channel missing in header")
+	if err := d.decodeRGBInto(payload, pos, hdr, &sub, !d.SkipResidual); err != nil {
+		return err
 	}
-
-	imgW32, err := readU32("image width")
-	if err != nil {
-		return nil, err
+	if !d.ToSRGB || d.profile == nil {
+		return nil
 	}
-	imgH32, err := readU32("image height")
+	p, err := ParseICC(d.profile)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("decode: %w", err)
 	}
-	imgW := int(imgW32)
-	imgH := int(imgH32)
+	p.ToSRGB(&sub)
+	return nil
+}
 
-	if macroBlock < smallBlock || macroBlock%smallBlock != 0 {
-		return nil, fmt.Errorf("macroBlock (%d) must be >= smallBlock (%d) and a multiple of it",
-			macroBlock, smallBlock)
-	}
+// Profile returns the ICC profile carried by the last decoded stream, or nil
+// when it has none. Like the image, it is only valid until the next Decode.
+func (d *Decoder) Profile() []byte {
+	return d.profile
+}
 
-	if d.dst == nil || d.dst.Bounds().Dx() != imgW || d.dst.Bounds().Dy() != imgH {
-		d.dst = image.NewRGBA(image.Rect(0, 0, imgW, imgH))
+// readHeader parses the header of a decompressed stream into d.hdr, records
+// its ICC profile and returns the position of the first channel segment.
+func (d *Decoder) readHeader(payload []byte) (*streamHeader, int, error) {
+	pos := 0
+	d.profile = nil
+	hdr, err := parseHeader(payload, &pos)
+	if err != nil {
+		return nil, 0, err
 	}
-	dst := d.dst
+	d.hdr = hdr
+	d.profile = hdr.icc
+	return &d.hdr, pos, nil
+}
+
+// decodeStored decodes the planes of the stream with header hdr, whose
+// channel segments start at pos, into dst (hdr.w x hdr.h pixels from the
+// start of dst.Pix), interleaved as Y, Cb and Cr at channel offsets 0, 1
+// and 2; the chroma bytes are undefined where the stream does not store
+// the channel. With residual set it also returns the residual layer of
+// streams that carry one.
+func (d *Decoder) decodeStored(payload []byte, pos int, hdr *streamHeader, dst *image.RGBA, residual bool) ([]byte, error) {
+	smallBlock = hdr.small
+	macroBlock = hdr.macro
+	channelsMask := hdr.channels
+	imgW := hdr.w
+	imgH := hdr.h
+
 	pix := dst.Pix
 	stride := dst.Stride
 
-	ySeg, err := readChannelSegment(payload, &pos)
+	// Padded streams cover whole blocks past the image edge: decode them
+	// at the coded size and clip while copying into dst.
+	codedW, codedH := hdr.codedSize()
+	padded := hdr.features&featPadded != 0
+	if padded {
+		n := codedW * 4 * codedH
+		if cap(d.padPix) < n {
+			d.padPix = make([]byte, n)
+		}
+		pix, stride = d.padPix[:n], codedW*4
+	}
+
+	copies := hdr.features&featCopy != 0
+	ySeg, err := readChannelSegment(payload, &pos, copies)
 	if err != nil {
 		return nil, err
 	}
 	hasCb := (channelsMask & channelFlagCb) != 0
 	hasCr := (channelsMask & channelFlagCr) != 0
+	joint := hdr.features&featJoint != 0
 
+	// A joint segment carries every channel.
 	var cbSeg, crSeg []byte
-	if hasCb {
-		cbSeg, err = readChannelSegment(payload, &pos)
+	if hasCb && !joint {
+		cbSeg, err = readChannelSegment(payload, &pos, copies)
 		if err != nil {
 			return nil, err
 		}
 	}
-	if hasCr {
-		crSeg, err = readChannelSegment(payload, &pos)
+	if hasCr && !joint {
+		crSeg, err = readChannelSegment(payload, &pos, copies)
 		if err != nil {
 			return nil, err
 		}
 	}
+	var resData []byte
+	if residual = residual && hdr.features&featResidual != 0; residual {
+		if resData, err = readResidualLayer(payload, &pos); err != nil {
+			return nil, err
+		}
+	}
 
-	w4 := (imgW / smallBlock) * smallBlock
-	h4 := (imgH / smallBlock) * smallBlock
-	if w4 != imgW || h4 != imgH {
-		for o := 0; o+3 < len(pix); o += 4 {
-			pix[o+0] = 0
-			pix[o+1] = 128
-			pix[o+2] = 128
-			pix[o+3] = 255
+	if !padded && (codedW != imgW || codedH != imgH) {
+		for y := range imgH {
+			row := pix[y*stride : y*stride+imgW*4]
+			for o := 0; o < len(row); o += 4 {
+				row[o+0] = 0
+				row[o+1] = 128
+				row[o+2] = 128
+				row[o+3] = 255
+			}
 		}
 	}
 
-	var errY, errCb, errCr error
-	if d.Parallel {
+	errs := &d.chErr
+	*errs = [3]error{}
+	if joint {
+		errs[0] = decodeJointToPix(hdr, ySeg, pix, stride, nil, &d.joint)
+	} else if d.Parallel {
 		var wg sync.WaitGroup
 		wg.Add(1)
-		go decodeChannelToPixWorker(ySeg, imgW, imgH, pix, stride, 0, &errY, &wg)
+		go decodeChannelToPixWorker(hdr, ySeg, pix, stride, 0, &d.y, &errs[0], &wg)
+		if hdr.features&featChromaFromLuma != 0 {
+			// Chroma leaves read the decoded luma.
+			wg.Wait()
+		}
 		if hasCb {
 			wg.Add(1)
-			go decodeChannelToPixWorker(cbSeg, imgW, imgH, pix, stride, 1, &errCb, &wg)
+			go decodeChannelToPixWorker(hdr, cbSeg, pix, stride, 1, &d.cb, &errs[1], &wg)
 		}
 		if hasCr {
 			wg.Add(1)
-			go decodeChannelToPixWorker(crSeg, imgW, imgH, pix, stride, 2, &errCr, &wg)
+			go decodeChannelToPixWorker(hdr, crSeg, pix, stride, 2, &d.cr, &errs[2], &wg)
 		}
 		wg.Wait()
 	} else {
-		errY = decodeChannelToPix(ySeg, imgW, imgH, pix, stride, 0)
+		errs[0] = decodeSegmentToPix(hdr, ySeg, pix, stride, 0, &d.y)
 		if hasCb {
-			errCb = decodeChannelToPix(cbSeg, imgW, imgH, pix, stride, 1)
+			errs[1] = decodeSegmentToPix(hdr, cbSeg, pix, stride, 1, &d.cb)
 		}
 		if hasCr {
-			errCr = decodeChannelToPix(crSeg, imgW, imgH, pix, stride, 2)
+			errs[2] = decodeSegmentToPix(hdr, crSeg, pix, stride, 2, &d.cr)
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if padded {
+		for y := range imgH {
+			copy(dst.Pix[y*dst.Stride:y*dst.Stride+imgW*4], pix[y*stride:])
 		}
 	}
+	return resData, nil
+}
 
-	if errY != nil {
-		return nil, errY
+// decodePayload decodes a decompressed stream, applying its residual layer
+// if residual is set. The postfilter only runs on base images.
+func (d *Decoder) decodePayload(payload []byte, postfilter, residual bool) (*image.RGBA, error) {
+	hdr, pos, err := d.readHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+	dst := d.storedImage(hdr)
+	if err := d.decodeRGBInto(payload, pos, hdr, dst, residual); err != nil {
+		return nil, err
 	}
-	if errCb != nil {
-		return nil, errCb
+	if postfilter && !(residual && hdr.features&featResidual != 0) {
+		return smoothBlocks(dst), nil
+	}
+	return dst, nil
+}
+
+// storedImage returns d.dst sized for hdr's image, to decode planes into.
+func (d *Decoder) storedImage(hdr *streamHeader) *image.RGBA {
+	if d.dst == nil || d.dst.Bounds().Dx() != hdr.w || d.dst.Bounds().Dy() != hdr.h {
+		d.dst = image.NewRGBA(image.Rect(0, 0, hdr.w, hdr.h))
 	}
-	if errCr != nil {
-		return nil, errCr
+	return d.dst
+}
+
+// decodeRGBInto decodes the stream with header hdr into dst like
+// decodeStored and converts it to RGB, applying the residual layer if
+// residual is set.
+func (d *Decoder) decodeRGBInto(payload []byte, pos int, hdr *streamHeader, dst *image.RGBA, residual bool) error {
+	resData, err := d.decodeStored(payload, pos, hdr, dst, residual)
+	if err != nil {
+		return err
 	}
+	pix, stride := dst.Pix, dst.Stride
+	imgW, imgH := hdr.w, hdr.h
+	hasCb := hdr.channels&channelFlagCb != 0
+	hasCr := hdr.channels&channelFlagCr != 0
 
+	toRGB, err := colorToRGB(hdr.color)
+	if err != nil {
+		return err
+	}
 	if d.Parallel {
 		workers := max(min(runtime.NumCPU(), imgH), 1)
 		rowsPerWorker := (imgH + workers - 1) / workers
@@ -3353,18 +4797,17 @@ func (d *Decoder) Decode(compData []byte, postfilter bool) (*image.RGBA, error)
 			y1 := min(y0+rowsPerWorker, imgH)
 
 			wgRGB.Add(1)
-			go ycbcrToRGBStripe(pix, stride, imgW, y0, y1, hasCb, hasCr, &wgRGB)
+			go toRGBStripe(toRGB, pix, stride, imgW, y0, y1, hasCb, hasCr, &wgRGB)
 		}
 		wgRGB.Wait()
 	} else {
-		ycbcrToRGB(pix, stride, imgW, 0, imgH, hasCb, hasCr)
+		toRGB(pix, stride, imgW, 0, imgH, hasCb, hasCr)
 	}
 
-	if postfilter {
-		return smoothBlocks(dst), nil
+	if residual && hdr.features&featResidual != 0 {
+		return applyResidual(dst, resData, int(hdr.residualStep), !hasCb)
 	}
-
-	return dst, nil
+	return nil
 }
 
 // DecodeFrom reads compressed data from r and decodes it.
@@ -3379,141 +4822,27 @@ func (d *Decoder) DecodeFrom(r io.Reader, postfilter bool) (*image.RGBA, error)
 	return d.Decode(compData, postfilter)
 }
 
-func decodeChannelToPixWorker(data []byte, imgW, imgH int, pix []byte, strideBytes int, channelOffset int, dstErr *error, wg *sync.WaitGroup) {
+func decodeChannelToPixWorker(hdr *streamHeader, data []byte, pix []byte, strideBytes int, channelOffset int, scratch *decoderChannelScratch, dstErr *error, wg *sync.WaitGroup) {
 	defer wg.Done()
-	*dstErr = decodeChannelToPix(data, imgW, imgH, pix, strideBytes, channelOffset)
-}
-
-func ycbcrToRGB(pix []byte, stride, imgW int, yStart, yEnd int, hasCb, hasCr bool) {
-	if hasCb && hasCr {
-		for y := yStart; y < yEnd; y++ {
-			rowOff := y * stride
-			for x := 0; x < imgW; x++ {
-				o := rowOff + x*4
-				Y := int32(pix[o+0])
-				Cb := int32(pix[o+1]) - 128
-				Cr := int32(pix[o+2]) - 128
-
-				R := Y + ((91881 * Cr) >> 16)
-				G := Y - ((22554*Cb + 46802*Cr) >> 16)
-				B := Y + ((116130 * Cb) >> 16)
-
-				if R < 0 {
-					R = 0
-				} else if R > 255 {
-					R = 255
-				}
-				if G < 0 {
-					G = 0
-				} else if G > 255 {
-					G = 255
-				}
-				if B < 0 {
-					B = 0
-				} else if B > 255 {
-					B = 255
-				}
-
-				pix[o+0] = uint8(R)
-				pix[o+1] = uint8(G)
-				pix[o+2] = uint8(B)
-				pix[o+3] = 255
-			}
-		}
-		return
-	}
-
-	if hasCb {
-		for y := yStart; y < yEnd; y++ {
-			rowOff := y * stride
-			for x := 0; x < imgW; x++ {
-				o := rowOff + x*4
-				Y := int32(pix[o+0])
-				Cb := int32(pix[o+1]) - 128
-
-				R := Y
-				G := Y - ((22554 * Cb) >> 16)
-				B := Y + ((116130 * Cb) >> 16)
-
-				if R < 0 {
-					R = 0
-				} else if R > 255 {
-					R = 255
-				}
-				if G < 0 {
-					G = 0
-				} else if G > 255 {
-					G = 255
-				}
-				if B < 0 {
-					B = 0
-				} else if B > 255 {
-					B = 255
-				}
-
-				pix[o+0] = uint8(R)
-				pix[o+1] = uint8(G)
-				pix[o+2] = uint8(B)
-				pix[o+3] = 255
-			}
-		}
-		return
-	}
-
-	if hasCr {
-		for y := yStart; y < yEnd; y++ {
-			rowOff := y * stride
-			for x := 0; x < imgW; x++ {
-				o := rowOff + x*4
-				Y := int32(pix[o+0])
-				Cr := int32(pix[o+2]) - 128
-
-				R := Y + ((91881 * Cr) >> 16)
-				G := Y - ((46802 * Cr) >> 16)
-				B := Y
-
-				if R < 0 {
-					R = 0
-				} else if R > 255 {
-					R = 255
-				}
-				if G < 0 {
-					G = 0
-				} else if G > 255 {
-					G = 255
-				}
-				if B < 0 {
-					B = 0
-				} else if B > 255 {
-					B = 255
-				}
-
-				pix[o+0] = uint8(R)
-				pix[o+1] = uint8(G)
-				pix[o+2] = uint8(B)
-				pix[o+3] = 255
-			}
-		}
-		return
-	}
+	*dstErr = decodeSegmentToPix(hdr, data, pix, strideBytes, channelOffset, scratch)
+}
 
-	// Y only.
-	for y := yStart; y < yEnd; y++ {
-		rowOff := y * stride
-		for x := 0; x < imgW; x++ {
-			o := rowOff + x*4
-			Y := pix[o+0]
-			pix[o+0] = Y
-			pix[o+1] = Y
-			pix[o+2] = Y
-			pix[o+3] = 255
-		}
+// decodeSegmentToPix decodes one channel segment with the block layout
+// selected by the header.
+func decodeSegmentToPix(hdr *streamHeader, data []byte, pix []byte, strideBytes int, channelOffset int, scratch *decoderChannelScratch) error {
+	if hdr.features&featTree != 0 {
+		return decodeChannelTreeToPix(hdr, data, pix, strideBytes, channelOffset, nil, scratch)
 	}
+	w, h := hdr.codedSize()
+	return decodeChannelToPix(data, w, h, pix, strideBytes, channelOffset)
 }
 
-func ycbcrToRGBStripe(pix []byte, stride, imgW int, yStart, yEnd int, hasCb, hasCr bool, wg *sync.WaitGroup) {
+// toRGBFunc converts rows [yStart, yEnd) of decoded planes in pix to RGBA.
+type toRGBFunc func(pix []byte, stride, imgW int, yStart, yEnd int, hasCb, hasCr bool)
+
+func toRGBStripe(toRGB toRGBFunc, pix []byte, stride, imgW int, yStart, yEnd int, hasCb, hasCr bool, wg *sync.WaitGroup) {
 	defer wg.Done()
-	ycbcrToRGB(pix, stride, imgW, yStart, yEnd, hasCb, hasCr)
+	toRGB(pix, stride, imgW, yStart, yEnd, hasCb, hasCr)
 }
 
 // Decode reads a BABE-compressed stream (Zstd + three independent Y/Cb/Cr streams)
@@ -3918,21 +5247,6 @@ func smoothBlocks(src *image.RGBA) *image.RGBA {
 	return smoothJunctions(smoothFlatAreas(src))
 }
 
-type yuv struct {
-	Y  int16
-	Cb int16
-	Cr int16
-}
-
-func rgbToYCbCr(r, g, b uint8) yuv {
-	rr, gg, bb := int32(r), int32(g), int32(b)
-	Y := (77*rr + 150*gg + 29*bb) >> 8 // ≈ 0.299 0.587 0.114
-	Cb := ((-43*rr - 85*gg + 128*bb) >> 8) + 128
-	Cr := ((128*rr - 107*gg - 21*bb) >> 8) + 128
-	return yuv{int16(Y), int16(Cb), int16(Cr)}
-}
-
-// delta‑coding of an 8‑bit value on a 0..255 ring into int8 [-128..127]
 func encodeDelta8(prev, curr uint8) int8 {
 	diff := int16(curr) - int16(prev)
 	if diff < -128 {
@@ -3950,10 +5264,14 @@ func decodeDelta8(prev uint8, d int8) uint8 {
 // --- ZSTD helpers ---
 
 func mustNewZstdEncoder() *zstd.Encoder {
+	return mustNewZstdEncoderLevel(zstd.SpeedBetterCompression)
+}
+
+func mustNewZstdEncoderLevel(level zstd.EncoderLevel) *zstd.Encoder {
 	enc, err := zstd.NewWriter(
 		nil,
 		zstd.WithEncoderConcurrency(1),
-		zstd.WithEncoderLevel(zstd.SpeedBetterCompression),
+		zstd.WithEncoderLevel(level),
 		zstd.WithLowerEncoderMem(true),
 	)
 	if err != nil {
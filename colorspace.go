@@ -0,0 +1,268 @@
+package main
+
+// Colour transforms of the stored planes (featColor).
+//
+// Lossy streams store luma and two chroma planes. BT.601, BT.709, BT.2020
+// and YCoCg are linear transforms, applied through one colorMatrix in 16.16
+// fixed point: the decoder's matrix is the inverse of the encoder's, so the
+// only round-trip error is the rounding to 8 bits. Each comes in full range
+// (0..255) or, with ColorLimited, studio range (Y 16..235, chroma 16..240).
+//
+// Near-lossless streams store R, G and B unchanged (ColorRGB), so an error
+// bound on the planes is the same bound on the decoded pixels. Lossless
+// streams use YCoCg-R, which decorrelates the channels.
+//
+// YCoCg-R is computed with lifting steps modulo 256, so every plane stays
+// 8 bits wide and the inverse reproduces R, G and B exactly:
+//
+//	Co = R - B        t = B + Co>>1
+//	Cg = G - t        Y = t + Cg>>1
+//
+// Co and Cg are stored as unsigned bytes; circular deltas and residuals
+// (encodeDelta8) keep small negative values cheap. The wrap-around does not
+// survive lossy coding, so lossy streams use YCoCg instead.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// Colour transforms for Encoder.ColorSpace, recorded with featColor.
+// ColorBT601 is the default and is implied when the feature is absent.
+const (
+	ColorBT601  = 0
+	ColorYCoCgR = 1
+	ColorRGB    = 2
+	ColorBT709  = 3
+	ColorBT2020 = 4
+	ColorYCoCg  = 5
+
+	// ColorLimited selects studio range for ColorBT601, ColorBT709,
+	// ColorBT2020 and ColorYCoCg.
+	ColorLimited = 0x80
+)
+
+// colorMatrix is a linear colour transform in 16.16 fixed point: the planes
+// are fwd*RGB + fwdOff and RGB is inv*planes + invOff, rounded and clamped.
+type colorMatrix struct {
+	fwd, inv       [3][3]int32
+	fwdOff, invOff [3]int32
+
+	planes toRGBFunc // planesToRGB, bound once so decoding does not allocate
+}
+
+// colorMatrices holds the matrix of every linear colour transform.
+var colorMatrices = buildColorMatrices()
+
+func buildColorMatrices() map[uint8]*colorMatrix {
+	ycbcr := func(kr, kb float64) [3][3]float64 {
+		kg := 1 - kr - kb
+		return [3][3]float64{
+			{kr, kg, kb},
+			{-kr / (2 - 2*kb), -kg / (2 - 2*kb), 0.5},
+			{0.5, -kg / (2 - 2*kr), -kb / (2 - 2*kr)},
+		}
+	}
+	bases := map[uint8][3][3]float64{
+		ColorBT601:  ycbcr(0.299, 0.114),
+		ColorBT709:  ycbcr(0.2126, 0.0722),
+		ColorBT2020: ycbcr(0.2627, 0.0593),
+		ColorYCoCg:  {{0.25, 0.5, 0.25}, {0.5, 0, -0.5}, {-0.25, 0.5, -0.25}},
+	}
+	ms := make(map[uint8]*colorMatrix)
+	for cs, m := range bases {
+		ms[cs] = newColorMatrix(m, [3]float64{1, 1, 1}, [3]int32{0, 128, 128})
+		ms[cs|ColorLimited] = newColorMatrix(m, [3]float64{219.0 / 255, 224.0 / 255, 224.0 / 255}, [3]int32{16, 128, 128})
+	}
+	return ms
+}
+
+// newColorMatrix builds the transform whose planes are scale*m*RGB + off.
+func newColorMatrix(m [3][3]float64, scale [3]float64, off [3]int32) *colorMatrix {
+	for i := range m {
+		for j := range m[i] {
+			m[i][j] *= scale[i]
+		}
+	}
+	inv := invert3(m)
+	c := &colorMatrix{}
+	for i := range 3 {
+		c.fwdOff[i] = off[i]<<16 + 1<<15
+		c.invOff[i] = 1 << 15
+		for j := range 3 {
+			c.fwd[i][j] = int32(math.Round(m[i][j] * 65536))
+			c.inv[i][j] = int32(math.Round(inv[i][j] * 65536))
+			c.invOff[i] -= c.inv[i][j] * off[j]
+		}
+	}
+	c.planes = c.planesToRGB
+	return c
+}
+
+// invert3 returns the inverse of a non-singular 3x3 matrix.
+func invert3(m [3][3]float64) [3][3]float64 {
+	var inv [3][3]float64
+	for i := range 3 {
+		for j := range 3 {
+			// Cofactor of m[j][i], by cyclic indices.
+			a, b := (j+1)%3, (j+2)%3
+			c, d := (i+1)%3, (i+2)%3
+			inv[i][j] = m[a][c]*m[b][d] - m[a][d]*m[b][c]
+		}
+	}
+	det := m[0][0]*inv[0][0] + m[0][1]*inv[1][0] + m[0][2]*inv[2][0]
+	for i := range 3 {
+		for j := range 3 {
+			inv[i][j] /= det
+		}
+	}
+	return inv
+}
+
+// colorMatrixFor returns the matrix of a linear colour transform, or nil.
+func colorMatrixFor(cs uint8) *colorMatrix {
+	return colorMatrices[cs]
+}
+
+// validColor reports whether cs is a known colour transform.
+func validColor(cs uint8) bool {
+	return cs == ColorYCoCgR || cs == ColorRGB || colorMatrixFor(cs) != nil
+}
+
+func clamp255(v int32) uint8 {
+	return uint8(min(max(v, 0), 255))
+}
+
+// fromRGB converts one pixel to the three planes.
+func (m *colorMatrix) fromRGB(r, g, b uint8) (uint8, uint8, uint8) {
+	rr, gg, bb := int32(r), int32(g), int32(b)
+	return clamp255((m.fwd[0][0]*rr + m.fwd[0][1]*gg + m.fwd[0][2]*bb + m.fwdOff[0]) >> 16),
+		clamp255((m.fwd[1][0]*rr + m.fwd[1][1]*gg + m.fwd[1][2]*bb + m.fwdOff[1]) >> 16),
+		clamp255((m.fwd[2][0]*rr + m.fwd[2][1]*gg + m.fwd[2][2]*bb + m.fwdOff[2]) >> 16)
+}
+
+// toRGB converts the three planes of one pixel back to RGB.
+func (m *colorMatrix) toRGB(c0, c1, c2 uint8) (uint8, uint8, uint8) {
+	a, b, c := int32(c0), int32(c1), int32(c2)
+	return clamp255((m.inv[0][0]*a + m.inv[0][1]*b + m.inv[0][2]*c + m.invOff[0]) >> 16),
+		clamp255((m.inv[1][0]*a + m.inv[1][1]*b + m.inv[1][2]*c + m.invOff[1]) >> 16),
+		clamp255((m.inv[2][0]*a + m.inv[2][1]*b + m.inv[2][2]*c + m.invOff[2]) >> 16)
+}
+
+// planesToRGB converts rows [yStart, yEnd) of pix from the planes to RGBA in
+// place (a toRGBFunc). Missing chroma planes are taken as neutral (128).
+func (m *colorMatrix) planesToRGB(pix []byte, stride, imgW int, yStart, yEnd int, hasC1, hasC2 bool) {
+	for y := yStart; y < yEnd; y++ {
+		row := pix[y*stride : y*stride+imgW*4]
+		for o := 0; o < len(row); o += 4 {
+			c1, c2 := uint8(128), uint8(128)
+			if hasC1 {
+				c1 = row[o+1]
+			}
+			if hasC2 {
+				c2 = row[o+2]
+			}
+			row[o], row[o+1], row[o+2] = m.toRGB(row[o], c1, c2)
+			row[o+3] = 255
+		}
+	}
+}
+
+// colorToRGB returns the conversion of decoded planes with transform cs.
+func colorToRGB(cs uint8) (toRGBFunc, error) {
+	switch cs {
+	case ColorYCoCgR:
+		return ycocgrToRGB, nil
+	case ColorRGB:
+		return rgbPlanesToRGB, nil
+	}
+	m := colorMatrixFor(cs)
+	if m == nil {
+		return nil, fmt.Errorf("decode: unsupported colour transform %d", cs)
+	}
+	return m.planes, nil
+}
+
+func rgbToYCoCgR(r, g, b uint8) (y, co, cg uint8) {
+	co = r - b
+	t := b + co>>1
+	cg = g - t
+	y = t + cg>>1
+	return y, co, cg
+}
+
+func ycocgrToRGBPixel(y, co, cg uint8) (r, g, b uint8) {
+	t := y - cg>>1
+	g = cg + t
+	b = t - co>>1
+	r = b + co
+	return r, g, b
+}
+
+func rgbIdentity(r, g, b uint8) (uint8, uint8, uint8) {
+	return r, g, b
+}
+
+// extractRGBPlanesInto converts img to three planes with stride
+// img.Bounds().Dx(), applying conv (rgbToYCoCgR or rgbIdentity) to every
+// pixel. Colours are taken as 8-bit premultiplied RGBA, the same values
+// color.RGBAModel yields.
+func extractRGBPlanesInto(img image.Image, p0, p1, p2 []uint8, conv func(r, g, b uint8) (uint8, uint8, uint8)) {
+	b := img.Bounds()
+	w := b.Dx()
+	if src, ok := img.(*image.RGBA); ok {
+		for y := 0; y < b.Dy(); y++ {
+			row := src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y):]
+			for x := 0; x < w; x++ {
+				i := y*w + x
+				p0[i], p1[i], p2[i] = conv(row[x*4], row[x*4+1], row[x*4+2])
+			}
+		}
+		return
+	}
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.RGBA)
+			i := y*w + x
+			p0[i], p1[i], p2[i] = conv(c.R, c.G, c.B)
+		}
+	}
+}
+
+// ycocgrToRGB converts rows [yStart, yEnd) of pix from YCoCg-R to RGBA in
+// place. Without chroma, Co and Cg are taken as zero.
+func ycocgrToRGB(pix []byte, stride, imgW int, yStart, yEnd int, hasCo, hasCg bool) {
+	for y := yStart; y < yEnd; y++ {
+		row := pix[y*stride : y*stride+imgW*4]
+		for o := 0; o < len(row); o += 4 {
+			var co, cg uint8
+			if hasCo {
+				co = row[o+1]
+			}
+			if hasCg {
+				cg = row[o+2]
+			}
+			row[o], row[o+1], row[o+2] = ycocgrToRGBPixel(row[o], co, cg)
+			row[o+3] = 255
+		}
+	}
+}
+
+// rgbPlanesToRGB completes rows [yStart, yEnd) of RGB planes in pix as RGBA.
+// Without the G and B planes the image is gray.
+func rgbPlanesToRGB(pix []byte, stride, imgW int, yStart, yEnd int, hasG, hasB bool) {
+	for y := yStart; y < yEnd; y++ {
+		row := pix[y*stride : y*stride+imgW*4]
+		for o := 0; o < len(row); o += 4 {
+			if !hasG {
+				row[o+1] = row[o]
+			}
+			if !hasB {
+				row[o+2] = row[o]
+			}
+			row[o+3] = 255
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+// Block copy (featCopy).
+//
+// A copy leaf repeats an earlier part of the decoded channel instead of
+// coding a pattern and levels, which pays off on screenshots, documents and
+// pixel art with repeated glyphs, icons and tiles. Leaves of at least
+// copyWindow x copyWindow pixels start with a copy bit in the type stream;
+// when it is set, the copy stream (a sixth stream after BG in the channel
+// segment) holds the displacement from the source block to the leaf as two
+// zigzag uvarints, dx then dy. The source may sit at any pixel position but
+// must lie in root blocks that precede the leaf's root block in coding
+// order, so it is fully decoded.
+//
+// The encoder finds candidates through a hash of the top-left
+// copyWindow x copyWindow pixels, with hash chains over every window of the
+// finished root blocks, and checks each against its reconstruction of the
+// decoded channel.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	copyWindow    = 4  // hashed window, and the smallest copied leaf side
+	copyHashBits  = 16 // hash table size
+	copyMaxChain  = 32 // candidates tried per leaf
+	copyBitsGuess = 16 // estimated coded size of a copy leaf
+)
+
+// copyIndex holds hash chains of the copyWindow x copyWindow windows of a
+// plane, keyed by their top-left pixel.
+type copyIndex struct {
+	head  []int32 // by hash: latest window, -1 when none
+	prev  []int32 // by window: previous window with the same hash
+	shift uint    // levels are hashed >> shift so near-identical blocks meet
+}
+
+func newCopyIndex(scratch *encoderChannelScratch, w, h int, shift uint) *copyIndex {
+	if cap(scratch.copyHead) < 1<<copyHashBits {
+		scratch.copyHead = make([]int32, 1<<copyHashBits)
+	}
+	if cap(scratch.copyPrev) < w*h {
+		scratch.copyPrev = make([]int32, w*h)
+	}
+	ix := &copyIndex{
+		head:  scratch.copyHead[:1<<copyHashBits],
+		prev:  scratch.copyPrev[:w*h],
+		shift: shift,
+	}
+	for i := range ix.head {
+		ix.head[i] = -1
+	}
+	return ix
+}
+
+// hash returns the hash of the window at (x, y) of plane.
+func (ix *copyIndex) hash(plane []uint8, stride, x, y int) uint32 {
+	h := uint32(2166136261)
+	for j := range copyWindow {
+		row := plane[(y+j)*stride+x:]
+		for _, v := range row[:copyWindow] {
+			h = (h ^ uint32(v>>ix.shift)) * 16777619
+		}
+	}
+	return h >> (32 - copyHashBits)
+}
+
+// addRoot indexes the windows whose bottom-right pixel lies in the root
+// block at (x, y): once that block is coded, they are fully decoded.
+func (ix *copyIndex) addRoot(g treeGeom, plane []uint8, stride, x, y int) {
+	x1, y1 := min(x+g.root, g.w), min(y+g.root, g.h)
+	for wy := max(y-copyWindow+1, 0); wy+copyWindow <= y1; wy++ {
+		for wx := max(x-copyWindow+1, 0); wx+copyWindow <= x1; wx++ {
+			h := ix.hash(plane, stride, wx, wy)
+			pos := int32(wy*g.w + wx)
+			ix.prev[pos] = ix.head[h]
+			ix.head[h] = pos
+		}
+	}
+}
+
+// rootIndex returns the coding order of the root block holding pixel (x, y).
+func (g treeGeom) rootIndex(x, y int) int {
+	return (y/g.root)*((g.w+g.root-1)/g.root) + x/g.root
+}
+
+// copySourceOK reports whether a bw x bh leaf at (x, y) may copy from
+// (sx, sy): the source lies in the coded area and is already decoded.
+func (g treeGeom) copySourceOK(x, y, sx, sy, bw, bh int) bool {
+	if sx < 0 || sy < 0 || sx > g.w-bw || sy > g.h-bh {
+		return false
+	}
+	return g.rootIndex(sx+bw-1, sy+bh-1) < g.rootIndex(x, y)
+}
+
+// canCopy reports whether a bw x bh leaf carries a copy bit.
+func (c *channelLeafCoder) canCopy(bw, bh int) bool {
+	return c.copies != nil && bw >= copyWindow && bh >= copyWindow
+}
+
+// findCopy returns the best copy of the leaf at (x, y) with values vals, and
+// whether one was found within the error bound.
+func (c *channelLeafCoder) findCopy(x, y, bw, bh int, vals []uint8) (leafModel, bool) {
+	if valueRange(vals) == 0 {
+		// A solid leaf is cheaper.
+		return leafModel{}, false
+	}
+	var key [copyWindow * copyWindow]uint8
+	for j := range copyWindow {
+		copy(key[j*copyWindow:], vals[j*bw:j*bw+copyWindow])
+	}
+	ix := c.copies
+	h := ix.hash(key[:], copyWindow, 0, 0)
+
+	best := leafModel{kind: leafCopy, cost: math.Inf(1)}
+	for pos, n := ix.head[h], 0; pos >= 0 && n < copyMaxChain; pos, n = ix.prev[pos], n+1 {
+		sx, sy := int(pos)%c.g.w, int(pos)/c.g.w
+		if !c.g.copySourceOK(x, y, sx, sy, bw, bh) {
+			continue
+		}
+		sse, worst := c.copyError(vals, sx, sy, bw, bh, best.cost)
+		if c.e.maxErr >= 0 && worst > c.e.maxErr {
+			continue
+		}
+		if sse < best.cost {
+			best.sx, best.sy, best.cost = sx, sy, sse
+			if sse == 0 {
+				break
+			}
+		}
+	}
+	if math.IsInf(best.cost, 1) {
+		return best, false
+	}
+	best.cost += c.lambda * copyBitsGuess
+	return best, true
+}
+
+// copyError returns the squared and largest absolute error of copying the
+// reconstruction at (sx, sy) over vals, stopping once the squared error
+// reaches limit.
+func (c *channelLeafCoder) copyError(vals []uint8, sx, sy, bw, bh int, limit float64) (float64, int) {
+	var sse float64
+	worst := 0
+	for j := range bh {
+		src := c.recon[(sy+j)*c.stride+sx:]
+		for i, v := range vals[j*bw : (j+1)*bw] {
+			d := int(v) - int(src[i])
+			sse += float64(d * d)
+			worst = max(worst, d, -d)
+		}
+		if sse >= limit {
+			break
+		}
+	}
+	return sse, worst
+}
+
+// copyLeaf stores the displacement of a copy leaf.
+func (c *channelLeafCoder) copyLeaf(x, y, bw, bh int, m leafModel) {
+	c.scratch.copyVals = binary.AppendUvarint(c.scratch.copyVals, zigzag(x-m.sx))
+	c.scratch.copyVals = binary.AppendUvarint(c.scratch.copyVals, zigzag(y-m.sy))
+	c.render(x, y, bw, bh, nil, m)
+	if c.levels != nil {
+		c.levels.setFrom(x, y, bw, bh, func(i, j int) uint8 {
+			return c.recon[(y+j)*c.stride+x+i]
+		})
+	}
+}
+
+// render writes the decoded form of a leaf into c.recon, the encoder's copy
+// of the decoded channel.
+func (c *channelLeafCoder) render(x, y, bw, bh int, vals []uint8, m leafModel) {
+	for j := range bh {
+		row := c.recon[(y+j)*c.stride+x : (y+j)*c.stride+x+bw]
+		switch m.kind {
+		case leafCopy:
+			copy(row, c.recon[(m.sy+j)*c.stride+m.sx:])
+			continue
+		case leafSolid:
+			for i := range row {
+				row[i] = m.fit.fg
+			}
+			continue
+		}
+		for i := range row {
+			switch m.kind {
+			case leafPattern:
+				row[i] = m.fit.bg
+				if vals[j*bw+i] >= m.fit.thr {
+					row[i] = m.fit.fg
+				}
+			case leafGradient:
+				row[i] = m.grad.at(i, j, bw, bh)
+			case leafMultiLevel:
+				row[i] = m.multi.levels[m.multi.index(vals[j*bw+i])]
+			case leafLuma:
+				row[i] = m.fit.bg
+				if c.luma[(y+j)*c.stride+x+i] >= m.fit.thr {
+					row[i] = m.fit.fg
+				}
+			}
+		}
+	}
+}
+
+// copyLeaf reads the displacement of a copy leaf and copies its pixels.
+func (d *channelLeafDecoder) copyLeaf(x, y, bw, bh int) error {
+	dx, n := binary.Uvarint(d.copies[d.copyPos:])
+	if n <= 0 {
+		return fmt.Errorf("decodeChannel: copy stream exhausted")
+	}
+	d.copyPos += n
+	dy, n := binary.Uvarint(d.copies[d.copyPos:])
+	if n <= 0 {
+		return fmt.Errorf("decodeChannel: copy stream exhausted")
+	}
+	d.copyPos += n
+	// Displacements past the coded area are invalid; rejecting them here
+	// keeps sx and sy far from overflow.
+	if dx > uint64(2*d.g.w) || dy > uint64(2*d.g.h) {
+		return fmt.Errorf("decodeChannel: copy displacement out of range for block at (%d,%d)", x, y)
+	}
+	sx, sy := x-unzigzag(dx), y-unzigzag(dy)
+	if !d.g.copySourceOK(x, y, sx, sy, bw, bh) {
+		return fmt.Errorf("decodeChannel: invalid copy source (%d,%d) for block at (%d,%d)", sx, sy, x, y)
+	}
+	for j := range bh {
+		dst := (y+j)*d.strideBytes + x*4 + d.channelOffset
+		src := (sy+j)*d.strideBytes + sx*4 + d.channelOffset
+		for i := 0; i < bw*4; i += 4 {
+			d.pix[dst+i] = d.pix[src+i]
+		}
+	}
+	if d.levels != nil {
+		d.levels.setFrom(x, y, bw, bh, func(i, j int) uint8 {
+			return d.pix[(y+j)*d.strideBytes+(x+i)*4+d.channelOffset]
+		})
+	}
+	return nil
+}
+
+func zigzag(v int) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func unzigzag(u uint64) int {
+	return int(u>>1) ^ -int(u&1)
+}
@@ -0,0 +1,101 @@
+package main
+
+// Gradient blocks (featGradient).
+//
+// A gradient leaf reproduces a bilinear ramp between four corner levels
+// instead of one or two flat tones, so smooth regions such as sky and skin
+// do not band. Its type code is given at writeLeafType. It stores the
+// top-left corner in the FG stream and the top-right, bottom-left and
+// bottom-right corners in the BG stream. With featPredict the top-left
+// corner is predicted as usual and the other corners from the top-left one.
+
+// gradientBits estimates the coded size of a gradient leaf.
+const gradientBits = 2 + 4*rdLevelBits
+
+// gradientFit is a bilinear block model given by its corner levels.
+type gradientFit struct {
+	tl, tr, bl, br uint8
+}
+
+// at returns the level of pixel (i, j) of a bw x bh gradient block. The
+// integer rounding is part of the format.
+func (g gradientFit) at(i, j, bw, bh int) uint8 {
+	w, h := max(bw-1, 1), max(bh-1, 1)
+	num := int(g.tl)*(w-i)*(h-j) + int(g.tr)*i*(h-j) + int(g.bl)*(w-i)*j + int(g.br)*i*j
+	den := w * h
+	return uint8((num + den/2) / den)
+}
+
+// fitGradient fits a least-squares plane to the block values (row-major,
+// bw x bh) and returns it as corner levels.
+func fitGradient(vals []uint8, bw, bh int) gradientFit {
+	n := float64(len(vals))
+	cx, cy := float64(bw-1)/2, float64(bh-1)/2
+	var mean, sxv, syv, sxx, syy float64
+	for j := range bh {
+		for i := range bw {
+			v := float64(vals[j*bw+i])
+			dx, dy := float64(i)-cx, float64(j)-cy
+			mean += v
+			sxv += dx * v
+			syv += dy * v
+			sxx += dx * dx
+			syy += dy * dy
+		}
+	}
+	mean /= n
+	var sx, sy float64
+	if sxx > 0 {
+		sx = sxv / sxx
+	}
+	if syy > 0 {
+		sy = syv / syy
+	}
+	corner := func(i, j int) uint8 {
+		return clampLevel(mean + sx*(float64(i)-cx) + sy*(float64(j)-cy))
+	}
+	return gradientFit{
+		tl: corner(0, 0),
+		tr: corner(bw-1, 0),
+		bl: corner(0, bh-1),
+		br: corner(bw-1, bh-1),
+	}
+}
+
+// errors returns the squared error and the largest absolute error of the
+// gradient against the block values.
+func (g gradientFit) errors(vals []uint8, bw, bh int) (float64, int) {
+	var sse float64
+	worst := 0
+	for j := range bh {
+		for i := range bw {
+			d := int(vals[j*bw+i]) - int(g.at(i, j, bw, bh))
+			sse += float64(d * d)
+			worst = max(worst, d, -d)
+		}
+	}
+	return sse, worst
+}
+
+// drawGradientPix writes a gradient block into one channel of pix.
+func drawGradientPix(pix []byte, strideBytes int, x0, y0, bw, bh int, g gradientFit, channelOffset int) {
+	for j := range bh {
+		row := (y0+j)*strideBytes + x0*4 + channelOffset
+		for i := range bw {
+			pix[row+i*4] = g.at(i, j, bw, bh)
+		}
+	}
+}
+
+// setGradient records a gradient leaf in the level map, each cell taking the
+// level of its top-left pixel.
+func (m *levelMap) setGradient(x, y, bw, bh int, g gradientFit) {
+	for j := 0; j < bh; j += m.small {
+		row := (y+j)/m.small*m.w + x/m.small
+		for i := 0; i < bw; i += m.small {
+			v := g.at(i, j, bw, bh)
+			m.fg[row+i/m.small] = v
+			m.bg[row+i/m.small] = v
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+// ICC colour management (featICC, Encoder.Profile, Decoder.ToSRGB).
+//
+// Planes are coded in the colour space of the source, and its ICC profile is
+// carried in the header as it was embedded, so wide-gamut images (Display P3
+// photos, for example) keep their gamut. Decoders can return the pixels
+// as stored along with the profile, or convert them to sRGB. Conversion
+// supports matrix/TRC profiles: RGB with three tone curves and colorants,
+// or gray with one curve, against the XYZ connection space. Pixels go
+// through the source curves to linear light, the colorant matrix to D50
+// XYZ, the inverse of the D50-adapted sRGB colorants to linear sRGB, and the
+// sRGB transfer function back to 8 bits. Gamut is clipped.
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+	"math"
+)
+
+// maxICCSize bounds the size of a profile carried in a stream.
+const maxICCSize = 1 << 24
+
+// iccHeaderSize is the size of the fixed ICC profile header.
+const iccHeaderSize = 128
+
+// srgbToXYZ holds the D50-adapted colorants of sRGB as columns, as in the
+// sRGB ICC profile.
+var srgbToXYZ = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// ICCProfile is a parsed matrix/TRC ICC profile.
+type ICCProfile struct {
+	toXYZ  [3][3]float64 // linear device values to D50 XYZ, colorants as columns
+	curves [3]iccCurve   // tone curves of R, G and B; all three alike for gray
+}
+
+// iccCurve is a tone curve (TRC): a sampled table, a parametric function, or
+// the identity when both are empty.
+type iccCurve struct {
+	table  []uint16
+	fn     int        // parametric function type, -1 when none
+	params [7]float64 // g, a, b, c, d, e, f
+}
+
+// checkICCHeader reports whether data starts like an ICC profile.
+func checkICCHeader(data []byte) error {
+	if len(data) < iccHeaderSize+4 || string(data[36:40]) != "acsp" {
+		return fmt.Errorf("icc: not an ICC profile")
+	}
+	if n := binary.BigEndian.Uint32(data); int64(n) > int64(len(data)) || n < iccHeaderSize+4 {
+		return fmt.Errorf("icc: invalid profile size %d", n)
+	}
+	return nil
+}
+
+// ParseICC parses an ICC profile. Only matrix/TRC profiles (RGB or gray
+// device space, XYZ connection space) are supported.
+func ParseICC(data []byte) (*ICCProfile, error) {
+	if err := checkICCHeader(data); err != nil {
+		return nil, err
+	}
+	data = data[:binary.BigEndian.Uint32(data)]
+	if pcs := string(data[20:24]); pcs != "XYZ " {
+		return nil, fmt.Errorf("icc: unsupported connection space %q", pcs)
+	}
+
+	tags := map[string][]byte{}
+	n := binary.BigEndian.Uint32(data[iccHeaderSize:])
+	if uint64(n)*12 > uint64(len(data)-iccHeaderSize-4) {
+		return nil, fmt.Errorf("icc: truncated tag table")
+	}
+	for i := range int(n) {
+		e := data[iccHeaderSize+4+12*i:]
+		off, size := binary.BigEndian.Uint32(e[4:]), binary.BigEndian.Uint32(e[8:])
+		if uint64(off)+uint64(size) > uint64(len(data)) {
+			return nil, fmt.Errorf("icc: tag %q out of range", e[:4])
+		}
+		tags[string(e[:4])] = data[off : off+size]
+	}
+
+	p := &ICCProfile{}
+	switch cs := string(data[16:20]); cs {
+	case "RGB ":
+		for i, sig := range [3]string{"rXYZ", "gXYZ", "bXYZ"} {
+			xyz, err := parseICCXYZ(tags[sig])
+			if err != nil {
+				return nil, fmt.Errorf("icc: %s: %w", sig, err)
+			}
+			for j := range xyz {
+				p.toXYZ[j][i] = xyz[j]
+			}
+		}
+		for i, sig := range [3]string{"rTRC", "gTRC", "bTRC"} {
+			c, err := parseICCCurve(tags[sig])
+			if err != nil {
+				return nil, fmt.Errorf("icc: %s: %w", sig, err)
+			}
+			p.curves[i] = c
+		}
+	case "GRAY":
+		// Gray maps to the neutral axis, which is where sRGB puts R=G=B.
+		c, err := parseICCCurve(tags["kTRC"])
+		if err != nil {
+			return nil, fmt.Errorf("icc: kTRC: %w", err)
+		}
+		p.toXYZ = srgbToXYZ
+		p.curves = [3]iccCurve{c, c, c}
+	default:
+		return nil, fmt.Errorf("icc: unsupported device colour space %q", cs)
+	}
+	return p, nil
+}
+
+func parseICCXYZ(b []byte) ([3]float64, error) {
+	var xyz [3]float64
+	if len(b) < 20 || string(b[:4]) != "XYZ " {
+		return xyz, fmt.Errorf("missing or invalid XYZ tag")
+	}
+	for i := range xyz {
+		xyz[i] = s15Fixed16(b[8+4*i:])
+	}
+	return xyz, nil
+}
+
+func parseICCCurve(b []byte) (iccCurve, error) {
+	c := iccCurve{fn: -1}
+	if len(b) < 12 {
+		return c, fmt.Errorf("missing or invalid curve tag")
+	}
+	switch string(b[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(b[8:]))
+		if n > (len(b)-12)/2 {
+			return c, fmt.Errorf("truncated curve")
+		}
+		if n == 0 {
+			return c, nil
+		}
+		if n == 1 {
+			c.fn = 0
+			c.params[0] = float64(binary.BigEndian.Uint16(b[12:])) / 256
+			return c, nil
+		}
+		c.table = make([]uint16, n)
+		for i := range c.table {
+			c.table[i] = binary.BigEndian.Uint16(b[12+2*i:])
+		}
+		return c, nil
+	case "para":
+		fn := int(binary.BigEndian.Uint16(b[8:]))
+		counts := [...]int{1, 3, 4, 5, 7}
+		if fn >= len(counts) {
+			return c, fmt.Errorf("unsupported parametric curve type %d", fn)
+		}
+		if len(b) < 12+4*counts[fn] {
+			return c, fmt.Errorf("truncated parametric curve")
+		}
+		c.fn = fn
+		for i := range counts[fn] {
+			c.params[i] = s15Fixed16(b[12+4*i:])
+		}
+		return c, nil
+	}
+	return c, fmt.Errorf("unsupported curve type %q", b[:4])
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// eval maps a device value in [0, 1] to linear light.
+func (c *iccCurve) eval(x float64) float64 {
+	if c.table != nil {
+		n := len(c.table)
+		if n == 1 {
+			return float64(c.table[0]) / 65535
+		}
+		f := x * float64(n-1)
+		i := min(int(f), n-2)
+		t := f - float64(i)
+		return (float64(c.table[i])*(1-t) + float64(c.table[i+1])*t) / 65535
+	}
+	g, a, b, cc, d, e, f := c.params[0], c.params[1], c.params[2], c.params[3], c.params[4], c.params[5], c.params[6]
+	pow := func(v float64) float64 { return math.Pow(max(v, 0), g) }
+	switch c.fn {
+	case 0:
+		return pow(x)
+	case 1:
+		if a != 0 && x >= -b/a {
+			return pow(a*x + b)
+		}
+		return 0
+	case 2:
+		if a != 0 && x >= -b/a {
+			return pow(a*x+b) + cc
+		}
+		return cc
+	case 3:
+		if x >= d {
+			return pow(a*x + b)
+		}
+		return cc * x
+	case 4:
+		if x >= d {
+			return pow(a*x+b) + e
+		}
+		return cc*x + f
+	}
+	return x
+}
+
+// srgbEncodeSteps is the resolution of the linear-to-sRGB table.
+const srgbEncodeSteps = 1 << 14
+
+var srgbEncode = func() *[srgbEncodeSteps + 1]uint8 {
+	var t [srgbEncodeSteps + 1]uint8
+	for i := range t {
+		l := float64(i) / srgbEncodeSteps
+		v := 12.92 * l
+		if l > 0.0031308 {
+			v = 1.055*math.Pow(l, 1/2.4) - 0.055
+		}
+		t[i] = uint8(math.Round(v * 255))
+	}
+	return &t
+}()
+
+// ToSRGB converts the pixels of img from the profile's colour space to
+// sRGB in place; colours outside the sRGB gamut are clipped.
+func (p *ICCProfile) ToSRGB(img *image.RGBA) {
+	var lin [3][256]float64
+	for ch := range lin {
+		for v := range lin[ch] {
+			lin[ch][v] = p.curves[ch].eval(float64(v) / 255)
+		}
+	}
+	m := mul3(invert3(srgbToXYZ), p.toXYZ)
+
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):]
+		for o := 0; o < b.Dx()*4; o += 4 {
+			r, g, bl := lin[0][row[o]], lin[1][row[o+1]], lin[2][row[o+2]]
+			for ch := range 3 {
+				l := m[ch][0]*r + m[ch][1]*g + m[ch][2]*bl
+				row[o+ch] = srgbEncode[int(min(max(l, 0), 1)*srgbEncodeSteps+0.5)]
+			}
+		}
+	}
+}
+
+func mul3(a, b [3][3]float64) [3][3]float64 {
+	var r [3][3]float64
+	for i := range 3 {
+		for j := range 3 {
+			for k := range 3 {
+				r[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return r
+}
+
+// ExtractICC returns the ICC profile embedded in a PNG (iCCP chunk) or JPEG
+// (APP2 ICC_PROFILE segments) file, or nil when there is none or the format
+// is not recognised.
+func ExtractICC(file []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(file, []byte(pngSignature)):
+		return extractPNGICC(file)
+	case bytes.HasPrefix(file, []byte{0xFF, 0xD8}):
+		return extractJPEGICC(file)
+	}
+	return nil, nil
+}
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+func extractPNGICC(file []byte) ([]byte, error) {
+	for pos := len(pngSignature); pos+8 <= len(file); {
+		n := int(binary.BigEndian.Uint32(file[pos:]))
+		typ := string(file[pos+4 : pos+8])
+		if n < 0 || pos+12+n > len(file) {
+			return nil, fmt.Errorf("icc: truncated PNG chunk %q", typ)
+		}
+		data := file[pos+8 : pos+8+n]
+		switch typ {
+		case "iCCP":
+			// profile name, NUL, compression method (0 = zlib), profile
+			name := bytes.IndexByte(data, 0)
+			if name < 0 || name+2 > len(data) || data[name+1] != 0 {
+				return nil, fmt.Errorf("icc: invalid iCCP chunk")
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(data[name+2:]))
+			if err != nil {
+				return nil, fmt.Errorf("icc: iCCP: %w", err)
+			}
+			defer zr.Close()
+			profile, err := io.ReadAll(io.LimitReader(zr, maxICCSize+1))
+			if err != nil {
+				return nil, fmt.Errorf("icc: iCCP: %w", err)
+			}
+			if len(profile) > maxICCSize {
+				return nil, fmt.Errorf("icc: profile too large")
+			}
+			return profile, nil
+		case "IDAT", "IEND":
+			// iCCP must precede the image data.
+			return nil, nil
+		}
+		pos += 12 + n
+	}
+	return nil, nil
+}
+
+func extractJPEGICC(file []byte) ([]byte, error) {
+	const tag = "ICC_PROFILE\x00"
+	var parts [][]byte
+	total := 0
+	for pos := 2; pos+4 <= len(file); {
+		if file[pos] != 0xFF {
+			return nil, fmt.Errorf("icc: invalid JPEG marker at %d", pos)
+		}
+		marker := file[pos+1]
+		if marker == 0xFF {
+			pos++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// start of scan or end of image: no more headers
+			break
+		}
+		n := int(binary.BigEndian.Uint16(file[pos+2:]))
+		if n < 2 || pos+2+n > len(file) {
+			return nil, fmt.Errorf("icc: truncated JPEG segment")
+		}
+		seg := file[pos+4 : pos+2+n]
+		if marker == 0xE2 && len(seg) >= len(tag)+2 && string(seg[:len(tag)]) == tag {
+			seq, count := int(seg[len(tag)]), int(seg[len(tag)+1])
+			if parts == nil {
+				parts = make([][]byte, count)
+			}
+			if seq < 1 || seq > len(parts) || count != len(parts) {
+				return nil, fmt.Errorf("icc: invalid ICC_PROFILE segment %d of %d", seq, count)
+			}
+			parts[seq-1] = seg[len(tag)+2:]
+			total += len(parts[seq-1])
+		}
+		pos += 2 + n
+	}
+	if parts == nil {
+		return nil, nil
+	}
+	profile := make([]byte, 0, total)
+	for i, p := range parts {
+		if p == nil {
+			return nil, fmt.Errorf("icc: missing ICC_PROFILE segment %d", i+1)
+		}
+		profile = append(profile, p...)
+	}
+	return profile, nil
+}
+
+// embedPNGICC inserts an iCCP chunk holding profile after the IHDR chunk of
+// the PNG file png.
+func embedPNGICC(png, profile []byte) ([]byte, error) {
+	const ihdrEnd = len(pngSignature) + 8 + 13 + 4
+	if len(png) < ihdrEnd || string(png[len(pngSignature)+4:len(pngSignature)+8]) != "IHDR" {
+		return nil, fmt.Errorf("icc: not a PNG file")
+	}
+	var data bytes.Buffer
+	data.WriteString("ICC profile\x00\x00")
+	zw := zlib.NewWriter(&data)
+	zw.Write(profile)
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(png)+data.Len()+12)
+	out = append(out, png[:ihdrEnd]...)
+	out = binary.BigEndian.AppendUint32(out, uint32(data.Len()))
+	chunk := len(out)
+	out = append(out, "iCCP"...)
+	out = append(out, data.Bytes()...)
+	out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[chunk:]))
+	return append(out, png[ihdrEnd:]...), nil
+}
@@ -0,0 +1,561 @@
+package main
+
+// Joint colour layout.
+//
+// All stored channels share one segment with a single block tree (tree.go).
+// Every leaf is a dual-tone block in colour: one type bit, one pattern bit
+// per pixel for pattern blocks, and a FG (and BG) tone holding one level per
+// channel. The pattern comes from 2-means clustering of the block colours, so
+// a two-colour region costs one pattern instead of one per channel.
+//
+// Tones are stored as palette indices (featPalette, see palette.go) or as raw
+// levels: the FG stream holds one delta-packed run of block FG levels per
+// channel, the BG stream one run of pattern-block BG levels per channel. With
+// featPredict the runs hold prediction residuals (predict.go) instead.
+
+import (
+	"fmt"
+)
+
+// jointTone is one colour, a level per stored channel (Y, Cb, Cr order).
+type jointTone [3]uint8
+
+// jointFit is a dual-tone colour model of a block: pixels whose class is set
+// take fg, the others bg. When pattern is false the block is solid fg.
+type jointFit struct {
+	fg, bg  jointTone
+	pattern bool
+	sse     float64
+}
+
+// bits estimates the coded size of the fit for a block of n pixels and nch
+// channels.
+func (f jointFit) bits(n, nch int) float64 {
+	bits := 1 + float64(nch)*rdLevelBits
+	if f.pattern {
+		bits += float64(nch)*rdLevelBits + float64(n)
+	}
+	return bits
+}
+
+// fitJointSolid returns the solid fit with the rounded mean colour.
+func fitJointSolid(vals [][]uint8) jointFit {
+	var f jointFit
+	n := uint64(len(vals[0]))
+	for c, v := range vals {
+		var sum uint64
+		for _, x := range v {
+			sum += uint64(x)
+		}
+		f.fg[c] = uint8((sum + n/2) / n)
+		for _, x := range v {
+			d := float64(int32(x) - int32(f.fg[c]))
+			f.sse += d * d
+		}
+	}
+	f.bg = f.fg
+	return f
+}
+
+// fitJointPattern clusters the block colours into two classes with 2-means,
+// starting from a mean split of the channel with the largest range. cls
+// receives the class of every pixel; ok is false when no split exists.
+func fitJointPattern(vals [][]uint8, cls []bool) (f jointFit, ok bool) {
+	n := len(vals[0])
+	cls = cls[:n]
+
+	split, bestRange := 0, int32(0)
+	for c, v := range vals {
+		if r := valueRange(v); r > bestRange {
+			split, bestRange = c, r
+		}
+	}
+	if bestRange == 0 {
+		return f, false
+	}
+	var sum uint64
+	for _, x := range vals[split] {
+		sum += uint64(x)
+	}
+	for i, x := range vals[split] {
+		cls[i] = uint64(x)*uint64(n) >= sum
+	}
+
+	var c1, c0 [3]float64
+	for range 8 {
+		var n1, n0 float64
+		c1, c0 = [3]float64{}, [3]float64{}
+		for i := range n {
+			for c, v := range vals {
+				if cls[i] {
+					c1[c] += float64(v[i])
+				} else {
+					c0[c] += float64(v[i])
+				}
+			}
+			if cls[i] {
+				n1++
+			} else {
+				n0++
+			}
+		}
+		if n1 == 0 || n0 == 0 {
+			return f, false
+		}
+		for c := range vals {
+			c1[c] /= n1
+			c0[c] /= n0
+		}
+
+		changed := false
+		for i := range n {
+			var d1, d0 float64
+			for c, v := range vals {
+				a := float64(v[i]) - c1[c]
+				b := float64(v[i]) - c0[c]
+				d1 += a * a
+				d0 += b * b
+			}
+			if in1 := d1 < d0 || (d1 == d0 && cls[i]); in1 != cls[i] {
+				cls[i] = in1
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	for c := range vals {
+		f.fg[c] = clampLevel(c1[c])
+		f.bg[c] = clampLevel(c0[c])
+	}
+	if f.fg == f.bg {
+		return f, false
+	}
+	f.pattern = true
+	f.sse = f.error(vals, cls)
+	return f, true
+}
+
+// error returns the squared error of the fit for the given pixel classes.
+func (f jointFit) error(vals [][]uint8, cls []bool) float64 {
+	var sse float64
+	for c, v := range vals {
+		for i, x := range v {
+			ref := f.bg[c]
+			if !f.pattern || cls[i] {
+				ref = f.fg[c]
+			}
+			d := float64(int32(x) - int32(ref))
+			sse += d * d
+		}
+	}
+	return sse
+}
+
+// jointLeafCoder codes the leaves of all stored channels together.
+type jointLeafCoder struct {
+	e        *Encoder
+	planes   [][]uint8
+	stride   int
+	typeW    bitWriter
+	patternW bitWriter
+
+	// RD multiplier of the image and of the current node (see Encoder.ROI)
+	baseLambda float64
+	lambda     float64
+
+	vals   [3][]uint8
+	cls    []bool
+	levels [3]*levelMap // non-nil with featPredict
+
+	// fg holds one tone per block, bg one per pattern block, in block order.
+	fg []jointTone
+	bg []jointTone
+}
+
+// encodeJoint codes planes (Y, or Y, Cb and Cr) as one joint segment and
+// completes e.hdr with the palette.
+func (e *Encoder) encodeJoint(planes [][]uint8, stride, w4, h4 int) encodeChannelResult {
+	scratch := &e.ch[chY]
+	scratch.sizeBuf.Reset()
+	scratch.typeBuf.Reset()
+	scratch.patternBuf.Reset()
+
+	g := newTreeGeom(&e.hdr, chY, w4, h4)
+	spread := e.treeSpread(chY)
+	lc := &jointLeafCoder{
+		e:        e,
+		planes:   planes,
+		stride:   stride,
+		typeW:    newBitWriter(&scratch.typeBuf),
+		patternW: newBitWriter(&scratch.patternBuf),
+		cls:      make([]bool, g.root*g.root),
+
+		baseLambda: e.lambda(spread, g.small),
+	}
+	for c := range planes {
+		lc.vals[c] = make([]uint8, g.root*g.root)
+		if e.hdr.features&featPredict != 0 {
+			lc.levels[c] = newLevelMap(g)
+		}
+	}
+	e.newTreeEncoder(g, spread, &scratch.sizeBuf, lc).encode()
+	lc.typeW.flush()
+	lc.patternW.flush()
+
+	res := encodeChannelResult{
+		blockCount:   uint32(len(lc.fg)),
+		sizeBytes:    scratch.sizeBuf.Bytes(),
+		typeBytes:    scratch.typeBuf.Bytes(),
+		patternBytes: scratch.patternBuf.Bytes(),
+		tonesCoded:   true,
+	}
+	if e.hdr.features&featPalette != 0 {
+		pal := buildPalette(append(lc.fg[:len(lc.fg):len(lc.fg)], lc.bg...), len(planes), e.PaletteSize)
+		e.hdr.palette = pal.flatten(len(planes))
+		res.fgVals = pal.appendIndices(scratch.fgVals[:0], lc.fg)
+		res.bgVals = pal.appendIndices(scratch.bgVals[:0], lc.bg)
+	} else {
+		delta := e.hdr.features&featPredict == 0
+		res.fgVals = appendToneRuns(scratch.fgVals[:0], lc.fg, len(planes), delta)
+		res.bgVals = appendToneRuns(scratch.bgVals[:0], lc.bg, len(planes), delta)
+	}
+	scratch.fgVals, scratch.bgVals = res.fgVals, res.bgVals
+	return res
+}
+
+// appendToneRuns appends one run of levels per channel, delta-packed if delta
+// is set.
+func appendToneRuns(dst []uint8, tones []jointTone, nch int, delta bool) []uint8 {
+	for c := range nch {
+		start := len(dst)
+		for _, t := range tones {
+			dst = append(dst, t[c])
+		}
+		if !delta {
+			continue
+		}
+		// Backwards, so every delta still sees the original previous level.
+		for i := len(dst) - 1; i > start; i-- {
+			dst[i] = byte(encodeDelta8(dst[i-1], dst[i]))
+		}
+	}
+	return dst
+}
+
+func (c *jointLeafCoder) load(x, y, bw, bh int) [][]uint8 {
+	vals := c.vals[:len(c.planes)]
+	for i, p := range c.planes {
+		vals[i] = readBlockValues(p, c.stride, x, y, bw, bh, c.vals[i][:cap(c.vals[i])])
+	}
+	return vals
+}
+
+func (c *jointLeafCoder) valueRange(x, y, bw, bh int) int32 {
+	var r int32
+	for _, v := range c.load(x, y, bw, bh) {
+		r = max(r, valueRange(v))
+	}
+	return r
+}
+
+// fit picks the solid or pattern model: the pattern whenever the tones
+// differ at EffortFastest, the lower RD cost otherwise.
+func (c *jointLeafCoder) fit(vals [][]uint8) jointFit {
+	solid := fitJointSolid(vals)
+	if len(vals[0]) == 1 {
+		return solid
+	}
+	pattern, ok := fitJointPattern(vals, c.cls)
+	if !ok {
+		return solid
+	}
+	if c.e.Effort < effortRD {
+		return pattern
+	}
+	n, nch := len(vals[0]), len(vals)
+	if pattern.sse+c.lambda*pattern.bits(n, nch) < solid.sse+c.lambda*solid.bits(n, nch) {
+		return pattern
+	}
+	return solid
+}
+
+func (c *jointLeafCoder) rootDone(x, y int) {}
+
+// fits always holds: the joint layout is not used with an error bound.
+func (c *jointLeafCoder) fits(x, y, bw, bh int) bool {
+	return true
+}
+
+func (c *jointLeafCoder) leafCost(x, y, bw, bh int) float64 {
+	c.lambda = c.e.nodeLambda(c.baseLambda, x, y, bw, bh)
+	vals := c.load(x, y, bw, bh)
+	f := c.fit(vals)
+	if len(vals[0]) == 1 {
+		return c.lambda * float64(len(vals)) * rdLevelBits
+	}
+	return f.sse + c.lambda*f.bits(len(vals[0]), len(vals))
+}
+
+func (c *jointLeafCoder) leaf(x, y, bw, bh int) {
+	c.lambda = c.e.nodeLambda(c.baseLambda, x, y, bw, bh)
+	vals := c.load(x, y, bw, bh)
+	f := c.fit(vals)
+	if len(vals[0]) > 1 {
+		c.typeW.writeBit(f.pattern)
+	}
+	fg, bg := f.fg, f.bg
+	if c.levels[0] != nil {
+		for ch, m := range c.levels[:len(vals)] {
+			fg[ch] = residual(m.predict(m.fg, x, y), f.fg[ch])
+			bg[ch] = residual(m.predict(m.bg, x, y), f.bg[ch])
+			m.set(x, y, bw, bh, f.fg[ch], f.bg[ch])
+		}
+	}
+	c.fg = append(c.fg, fg)
+	if !f.pattern {
+		return
+	}
+	c.bg = append(c.bg, bg)
+	for _, in1 := range c.cls[:len(vals[0])] {
+		c.patternW.writeBit(in1)
+	}
+}
+
+// jointLeafDecoder reconstructs the leaves of a joint segment into pix.
+type jointLeafDecoder struct {
+	ss          segmentStreams
+	offsets     []int
+	pix         []byte
+	strideBytes int
+
+	// palette tones
+	pal     palette
+	idxBits uint8
+	fgIdx   bitReader
+	bgIdx   bitReader
+
+	// raw tones, one run per channel
+	fgRuns [3]deltaStream
+	bgRuns [3]deltaStream
+
+	// predicted tones (featPredict), one run of residuals per channel
+	levels [3]*levelMap
+	fgRes  [3]residualStream
+	bgRes  [3]residualStream
+
+	bgCount  int
+	blockIdx int
+
+	// DecodeScaled: the reduced grid that takes the leaves instead of pix
+	out *scaledPlanes
+}
+
+// jointDecodeScratch keeps the state of decodeJointToPix across calls.
+type jointDecodeScratch struct {
+	leaf    jointLeafDecoder
+	offsets [3]int
+	levels  [3]levelMap
+	pal     palette
+}
+
+// decodeJointToPix decodes a joint segment into the stored channels of pix,
+// or into out at reduced resolution when out is set.
+func decodeJointToPix(hdr *streamHeader, data []byte, pix []byte, strideBytes int, out *scaledPlanes, scratch *jointDecodeScratch) error {
+	ss, err := parseSegmentStreams(data, false)
+	if err != nil {
+		return err
+	}
+	offsets := append(scratch.offsets[:0], 0)
+	if hdr.channels&channelFlagCb != 0 {
+		offsets = append(offsets, 1)
+	}
+	if hdr.channels&channelFlagCr != 0 {
+		offsets = append(offsets, 2)
+	}
+
+	d := &scratch.leaf
+	*d = jointLeafDecoder{
+		ss:          ss,
+		offsets:     offsets,
+		pix:         pix,
+		strideBytes: strideBytes,
+		out:         out,
+	}
+	nch := len(offsets)
+	w, h := hdr.codedSize()
+	g := newTreeGeom(hdr, chY, w, h)
+	if hdr.features&featPalette != 0 {
+		scratch.pal = unflattenPalette(scratch.pal, hdr.palette, nch)
+		d.pal = scratch.pal
+		d.idxBits = uint8(bitsNeeded(len(d.pal) - 1))
+		d.fgIdx = newBitReader(ss.fg)
+		d.bgIdx = newBitReader(ss.bg)
+		if want := (ss.blockCount*int(d.idxBits) + 7) / 8; len(ss.fg) != want {
+			return fmt.Errorf("decodeChannel: FG index stream has %d bytes, want %d", len(ss.fg), want)
+		}
+	} else {
+		if len(ss.fg) != nch*ss.blockCount {
+			return fmt.Errorf("decodeChannel: FG count %d does not match %d blocks x %d channels", len(ss.fg), ss.blockCount, nch)
+		}
+		if len(ss.bg)%nch != 0 || len(ss.bg)/nch > ss.blockCount {
+			return fmt.Errorf("decodeChannel: invalid BG length %d", len(ss.bg))
+		}
+		fgN, bgN := ss.blockCount, len(ss.bg)/nch
+		for c := range nch {
+			if hdr.features&featPredict != 0 {
+				scratch.levels[c].reset(g)
+				d.levels[c] = &scratch.levels[c]
+				d.fgRes[c] = residualStream{data: ss.fg[c*fgN : (c+1)*fgN]}
+				d.bgRes[c] = residualStream{data: ss.bg[c*bgN : (c+1)*bgN]}
+				continue
+			}
+			if d.fgRuns[c], err = newDeltaStream(ss.fg[c*fgN:(c+1)*fgN], fgN); err != nil {
+				return err
+			}
+			if d.bgRuns[c], err = newDeltaStream(ss.bg[c*bgN:(c+1)*bgN], bgN); err != nil {
+				return err
+			}
+		}
+	}
+	return decodeTree(g, &d.ss.size, d)
+}
+
+// tone reads the next FG (bg=false) or BG tone of the leaf at (x, y).
+func (d *jointLeafDecoder) tone(bg bool, x, y int) (jointTone, error) {
+	if d.levels[0] != nil {
+		res := &d.fgRes
+		if bg {
+			res = &d.bgRes
+		}
+		var t jointTone
+		for c, m := range d.levels[:len(d.offsets)] {
+			r, err := res[c].next()
+			if err != nil {
+				return t, fmt.Errorf("decodeChannel: tone stream exhausted")
+			}
+			levels := m.fg
+			if bg {
+				levels = m.bg
+			}
+			t[c] = unresidual(m.predict(levels, x, y), r)
+		}
+		return t, nil
+	}
+	if d.pal == nil {
+		runs := &d.fgRuns
+		if bg {
+			runs = &d.bgRuns
+		}
+		var t jointTone
+		for c := range d.offsets {
+			v, err := runs[c].next()
+			if err != nil {
+				return t, fmt.Errorf("decodeChannel: tone stream exhausted")
+			}
+			t[c] = v
+		}
+		return t, nil
+	}
+
+	br := &d.fgIdx
+	if bg {
+		br = &d.bgIdx
+	}
+	idx, err := br.readBits(d.idxBits)
+	if err != nil {
+		return jointTone{}, fmt.Errorf("decodeChannel: palette index stream too short")
+	}
+	if int(idx) >= len(d.pal) {
+		return jointTone{}, fmt.Errorf("decodeChannel: palette index %d out of range", idx)
+	}
+	return d.pal[idx], nil
+}
+
+func (d *jointLeafDecoder) leaf(x, y, bw, bh int) error {
+	if d.blockIdx >= d.ss.blockCount {
+		return fmt.Errorf("unexpected end of blocks in tree layout")
+	}
+	d.blockIdx++
+
+	isPattern := false
+	if bw*bh > 1 {
+		bit, err := d.ss.typ.readBit()
+		if err != nil {
+			return fmt.Errorf("decodeChannel: type stream too short")
+		}
+		isPattern = bit
+	}
+	fg, err := d.tone(false, x, y)
+	if err != nil {
+		return err
+	}
+	if !isPattern {
+		d.setLevels(x, y, bw, bh, fg, fg)
+		for c, off := range d.offsets {
+			if d.out != nil {
+				d.out.fill(off, x, y, bw, bh, fg[c])
+				continue
+			}
+			if err := fillBlockPix(d.pix, d.strideBytes, x, y, bw, bh, fg[c], off); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	bg, err := d.tone(true, x, y)
+	if err != nil {
+		return err
+	}
+	d.setLevels(x, y, bw, bh, fg, bg)
+	d.bgCount++
+	// Every channel replays the same pattern bits.
+	start := d.ss.pattern
+	for c, off := range d.offsets {
+		d.ss.pattern = start
+		if d.out != nil {
+			if err := d.out.pattern(off, x, y, bw, bh, &d.ss.pattern, fg[c], bg[c]); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := drawBlockPix(d.pix, d.strideBytes, x, y, bw, bh, &d.ss.pattern, fg[c], bg[c], off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setLevels updates the prediction context, if any.
+func (d *jointLeafDecoder) setLevels(x, y, bw, bh int, fg, bg jointTone) {
+	for c, m := range d.levels[:len(d.offsets)] {
+		if m != nil {
+			m.set(x, y, bw, bh, fg[c], bg[c])
+		}
+	}
+}
+
+func (d *jointLeafDecoder) finish() error {
+	if d.blockIdx != d.ss.blockCount {
+		return fmt.Errorf("block count mismatch: used %d of %d", d.blockIdx, d.ss.blockCount)
+	}
+	if d.levels[0] != nil {
+		if bgN := len(d.bgRes[0].data); d.bgCount != bgN {
+			return fmt.Errorf("color stream mismatch: bg used=%d expected=%d", d.bgCount, bgN)
+		}
+		return nil
+	}
+	if d.pal == nil {
+		if bgN := d.bgRuns[0].n; d.bgCount != bgN {
+			return fmt.Errorf("color stream mismatch: bg used=%d expected=%d", d.bgCount, bgN)
+		}
+		return nil
+	}
+	if want := (d.bgCount*int(d.idxBits) + 7) / 8; len(d.ss.bg) != want {
+		return fmt.Errorf("color stream mismatch: bg has %d bytes, want %d", len(d.ss.bg), want)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+// Linear-light block levels (Encoder.LinearLight).
+//
+// Levels are normally means of the gamma-encoded values, which darkens fine
+// high-contrast detail: thin black strokes on white average to a darker grey
+// than the eye sees, and edges between saturated colours shift. With
+// LinearLight the encoder keeps its thresholds and block decisions but sets
+// every solid and two-tone level to the mean of its pixels in linear light,
+// converted back with the sRGB transfer function. Luma, and all three planes
+// of ColorRGB, are taken as sRGB-encoded intensities; chroma planes hold
+// differences and keep plain means. The levels are stored as usual, so the
+// decoder is unchanged.
+
+import (
+	"math"
+	"sort"
+)
+
+// transferLUT maps stored values to linear light through the sRGB transfer
+// function.
+type transferLUT struct {
+	// lin is linear light scaled by 65535; the studio-range table extends
+	// the curve below black and above white so it stays strictly increasing.
+	lin [256]int32
+}
+
+var (
+	srgbFull    = newTransferLUT(0, 255)
+	srgbLimited = newTransferLUT(16, 235)
+)
+
+// newTransferLUT builds the table for values with black at lo and white at hi.
+func newTransferLUT(lo, hi int) *transferLUT {
+	t := &transferLUT{}
+	for v := range t.lin {
+		c := float64(v-lo) / float64(hi-lo)
+		l := srgbToLinear(math.Abs(c))
+		if c < 0 {
+			l = -l
+		}
+		t.lin[v] = int32(math.Round(l * 65535))
+	}
+	return t
+}
+
+// srgbToLinear is the sRGB transfer function for c >= 0.
+func srgbToLinear(c float64) float64 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// fromLinear returns the stored value closest to linear light l.
+func (t *transferLUT) fromLinear(l int32) uint8 {
+	i := sort.Search(len(t.lin), func(i int) bool { return t.lin[i] >= l })
+	if i == len(t.lin) {
+		return 255
+	}
+	if i > 0 && l-t.lin[i-1] < t.lin[i]-l {
+		i--
+	}
+	return uint8(i)
+}
+
+// levels replaces the levels of f with the linear-light means of the pixels
+// of vals they stand for. A pattern whose levels meet becomes solid.
+func (t *transferLUT) levels(f blockFit, vals []uint8) blockFit {
+	var sum [2]int64
+	var count [2]int64
+	for _, v := range vals {
+		k := 0
+		if f.pattern && v >= f.thr {
+			k = 1
+		}
+		sum[k] += int64(t.lin[v])
+		count[k]++
+	}
+	mean := func(k int, old uint8) uint8 {
+		if count[k] == 0 {
+			return old
+		}
+		return t.fromLinear(int32((sum[k] + count[k]/2) / count[k]))
+	}
+	if !f.pattern {
+		f.fg = mean(0, f.fg)
+		f.bg = f.fg
+		return f
+	}
+	f.fg, f.bg = mean(1, f.fg), mean(0, f.bg)
+	f.pattern = f.fg != f.bg
+	return f
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"image"
 	"image/color"
@@ -16,8 +17,8 @@ import (
 )
 
 func main() {
-	if len(os.Args) < 2 || len(os.Args) > 4 {
-		fmt.Fprint(os.Stderr, "Usage:\n  babe <input-image> [quality] [bw]\n  babe <input.babe> [-postfilter]\n  (bw flag can appear anywhere after the filename)\n")
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, "Usage:\n  babe <input-image> [quality] [bw] [-effort=N] [-lossless] [-linear] [-maxerr=N] [-residual=N] [-color=SPACE] [--roi mask.png]\n  babe <input.babe> [-postfilter] [-base] [-srgb] [-scale=N]\n  (options can appear anywhere after the filename; effort is 0 (fastest) to 4 (slowest);\n   colour spaces are bt601, bt709, bt2020, ycocg and rgb, with a -limited suffix for studio range)\n")
 		os.Exit(1)
 	}
 
@@ -27,14 +28,26 @@ func main() {
 
 	// If input is .babe → decode to PNG
 	if ext == ".babe" {
-		postfilter := false
-		for _, a := range os.Args[2:] {
-			if a == "-postfilter" {
+		postfilter, baseOnly, toSRGB, scale := false, false, false, 1
+		args := os.Args[2:]
+		for i := 0; i < len(args); i++ {
+			switch a := args[i]; {
+			case a == "-postfilter":
 				postfilter = true
-				break
+			case a == "-base":
+				baseOnly = true
+			case a == "-srgb":
+				toSRGB = true
+			case a == "-scale" || strings.HasPrefix(a, "-scale="):
+				n, err := strconv.Atoi(flagValue(args, &i, "-scale"))
+				if err != nil || n != 2 && n != 4 && n != 8 {
+					fmt.Fprintln(os.Stderr, "scale must be 2, 4 or 8")
+					os.Exit(1)
+				}
+				scale = n
 			}
 		}
-		if err := decodeBabe(inputPath, base+".png", false, postfilter); err != nil {
+		if err := decodeBabe(inputPath, base+".png", false, postfilter, baseOnly, toSRGB, scale); err != nil {
 			fmt.Fprintln(os.Stderr, "decode error:", err)
 			os.Exit(1)
 		}
@@ -43,54 +56,166 @@ func main() {
 
 	// Otherwise: encode image → .babe with default or provided quality
 	quality := 70
-	if len(os.Args) >= 3 {
-		q, err := strconv.Atoi(os.Args[2])
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "quality must be an integer between 0 and 100")
-			os.Exit(1)
-		}
-		if q < 0 || q > 100 {
-			fmt.Fprintln(os.Stderr, "quality must be between 0 and 100")
-			os.Exit(1)
-		}
-		quality = q
-	}
-
 	bwmode := false
-	for _, a := range os.Args[2:] {
-		if a == "bw" {
+	encoder := NewEncoder()
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "bw":
 			bwmode = true
-			break
+		case a == "-lossless":
+			encoder.Lossless = true
+		case a == "-linear":
+			encoder.LinearLight = true
+		case a == "-effort" || strings.HasPrefix(a, "-effort="):
+			n, err := strconv.Atoi(flagValue(args, &i, "-effort"))
+			if err != nil || n < EffortFastest || n > EffortSlowest {
+				fmt.Fprintf(os.Stderr, "effort must be an integer between %d and %d\n", EffortFastest, EffortSlowest)
+				os.Exit(1)
+			}
+			encoder.Effort = n
+		case a == "-maxerr" || strings.HasPrefix(a, "-maxerr="):
+			n, err := strconv.Atoi(flagValue(args, &i, "-maxerr"))
+			if err != nil || n < 1 || n > 255 {
+				fmt.Fprintln(os.Stderr, "maxerr must be an integer between 1 and 255")
+				os.Exit(1)
+			}
+			encoder.MaxError = n
+		case a == "-residual" || strings.HasPrefix(a, "-residual="):
+			n, err := strconv.Atoi(flagValue(args, &i, "-residual"))
+			if err != nil || n < 1 || n > 255 {
+				fmt.Fprintln(os.Stderr, "residual step must be an integer between 1 and 255")
+				os.Exit(1)
+			}
+			encoder.ResidualStep = n
+		case a == "-color" || strings.HasPrefix(a, "-color="):
+			cs, err := parseColorSpace(flagValue(args, &i, "-color"))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			encoder.ColorSpace = cs
+		case a == "-roi" || a == "--roi" || strings.HasPrefix(a, "-roi=") || strings.HasPrefix(a, "--roi="):
+			name, _, _ := strings.Cut(a, "=")
+			roi, err := loadGray(flagValue(args, &i, name))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "roi:", err)
+				os.Exit(1)
+			}
+			encoder.ROI = roi
+		default:
+			q, err := strconv.Atoi(a)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "quality must be an integer between 0 and 100")
+				os.Exit(1)
+			}
+			if q < 0 || q > 100 {
+				fmt.Fprintln(os.Stderr, "quality must be between 0 and 100")
+				os.Exit(1)
+			}
+			quality = q
 		}
 	}
 
 	outPath := base + ".babe"
-	if err := encodeToBabe(inputPath, outPath, quality, bwmode); err != nil {
+	if err := encodeToBabe(inputPath, outPath, quality, bwmode, encoder); err != nil {
 		fmt.Fprintln(os.Stderr, "encode error:", err)
 		os.Exit(1)
 	}
 }
 
-func encodeToBabe(inPath, outPath string, quality int, bwmode bool) error {
+// flagValue returns the value of the option name at args[*i], given either as
+// "name=value" or as the next argument, and advances *i past it.
+func flagValue(args []string, i *int, name string) string {
+	if v, ok := strings.CutPrefix(args[*i], name+"="); ok {
+		return v
+	}
+	if *i+1 >= len(args) {
+		fmt.Fprintln(os.Stderr, name, "requires a value")
+		os.Exit(1)
+	}
+	*i++
+	return args[*i]
+}
+
+// parseColorSpace parses a colour space name such as "bt709" or
+// "bt709-limited" into an Encoder.ColorSpace value.
+func parseColorSpace(name string) (int, error) {
+	base, limited := strings.CutSuffix(strings.ToLower(name), "-limited")
+	var cs int
+	switch base {
+	case "bt601":
+		cs = ColorBT601
+	case "bt709":
+		cs = ColorBT709
+	case "bt2020":
+		cs = ColorBT2020
+	case "ycocg":
+		cs = ColorYCoCg
+	case "rgb":
+		if limited {
+			return 0, fmt.Errorf("colour space %q has no limited range", name)
+		}
+		return ColorRGB, nil
+	default:
+		return 0, fmt.Errorf("unknown colour space %q", name)
+	}
+	if limited {
+		cs |= ColorLimited
+	}
+	return cs, nil
+}
+
+// loadGray reads an image file as grayscale.
+func loadGray(path string) (*image.Gray, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	gray := image.NewGray(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			gray.Set(x, y, img.At(x, y))
+		}
+	}
+	return gray, nil
+}
+
+func encodeToBabe(inPath, outPath string, quality int, bwmode bool, encoder *Encoder) error {
 	info, err := os.Stat(inPath)
 	if err != nil {
 		return err
 	}
 	inSize := info.Size()
 
-	in, err := os.Open(inPath)
+	data, err := os.ReadFile(inPath)
 	if err != nil {
 		return err
 	}
-	defer in.Close()
-
-	img, _, err := image.Decode(in)
+	img, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
+	// Carry an embedded colour profile through to the stream.
+	if profile, err := ExtractICC(data); err != nil {
+		fmt.Fprintln(os.Stderr, "warning: ignoring ICC profile:", err)
+	} else if profile != nil {
+		if err := checkICCHeader(profile); err != nil {
+			fmt.Fprintln(os.Stderr, "warning: ignoring ICC profile:", err)
+		} else {
+			encoder.Profile = profile
+		}
+	}
 
 	start := time.Now()
-	enc, err := Encode(img, quality, bwmode)
+	enc, err := encoder.Encode(img, quality, bwmode)
 	if err != nil {
 		return err
 	}
@@ -122,8 +247,9 @@ func encodeToBabe(inPath, outPath string, quality int, bwmode bool) error {
 		outPath,
 		formatSize(encSize),
 	)
-	fmt.Printf("quality=%d, ratio=%.3f, time=%s\n",
+	fmt.Printf("quality=%d, effort=%d, ratio=%.3f, time=%s\n",
 		quality,
+		encoder.Effort,
 		ratio,
 		finish,
 	)
@@ -131,7 +257,7 @@ func encodeToBabe(inPath, outPath string, quality int, bwmode bool) error {
 	return nil
 }
 
-func decodeBabe(inPath, outPath string, splitChannels, postfilter bool) error {
+func decodeBabe(inPath, outPath string, splitChannels, postfilter, baseOnly, toSRGB bool, scale int) error {
 
 	in, err := os.Open(inPath)
 	if err != nil {
@@ -147,7 +273,15 @@ func decodeBabe(inPath, outPath string, splitChannels, postfilter bool) error {
 	compSize := len(compData)
 
 	start := time.Now()
-	dec, err := Decode(compData, postfilter)
+	decoder := NewDecoder()
+	decoder.SkipResidual = baseOnly
+	decoder.ToSRGB = toSRGB
+	var dec image.Image
+	if scale > 1 {
+		dec, err = decoder.DecodeScaled(compData, scale)
+	} else {
+		dec, err = decoder.DecodeImage(compData, postfilter)
+	}
 	if err != nil {
 		return err
 	}
@@ -167,7 +301,18 @@ func decodeBabe(inPath, outPath string, splitChannels, postfilter bool) error {
 		}
 		defer out.Close()
 
-		if err := png.Encode(out, dec); err != nil {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, dec); err != nil {
+			return err
+		}
+		file := buf.Bytes()
+		if profile := decoder.Profile(); profile != nil && !toSRGB {
+			// Keep the source colour space.
+			if file, err = embedPNGICC(file, profile); err != nil {
+				return err
+			}
+		}
+		if _, err := out.Write(file); err != nil {
 			return err
 		}
 
@@ -0,0 +1,139 @@
+package main
+
+// Multi-level blocks (featMultiLevel).
+//
+// A multi-level leaf approximates its pixels with three or four levels and a
+// 2-bit index per pixel, which keeps antialiased edges and fine texture in
+// one block where a two-tone fit would split. After its type code the type
+// stream holds one bit: 0 for three levels, 1 for four. The highest level goes
+// to the FG stream, the lowest and then the middle levels to the BG stream;
+// with featPredict the middle levels are residuals from the lowest. The
+// pattern stream holds the indices, msb-first, into the levels in ascending
+// order.
+
+import "fmt"
+
+// multiFit is a block model of n (3 or 4) levels in ascending order.
+type multiFit struct {
+	n      int
+	levels [4]uint8
+}
+
+// index returns the position of the level nearest to v.
+func (f multiFit) index(v uint8) int {
+	best, bestD := 0, 256
+	for i, l := range f.levels[:f.n] {
+		if d := max(int(v)-int(l), int(l)-int(v)); d < bestD {
+			best, bestD = i, d
+		}
+	}
+	return best
+}
+
+// sse returns the squared error of the fit over vals.
+func (f multiFit) sse(vals []uint8) float64 {
+	var sse float64
+	for _, v := range vals {
+		d := float64(int(v) - int(f.levels[f.index(v)]))
+		sse += d * d
+	}
+	return sse
+}
+
+// bits estimates the coded size of the fit for a block of n pixels.
+func (f multiFit) bits(n int) float64 {
+	return 4 + float64(f.n)*rdLevelBits + 2*float64(n)
+}
+
+// fitMultiLevel fits n levels to vals with a few Lloyd iterations started
+// from evenly spaced levels.
+func fitMultiLevel(vals []uint8, n int) multiFit {
+	lo, hi := vals[0], vals[0]
+	for _, v := range vals[1:] {
+		lo = min(lo, v)
+		hi = max(hi, v)
+	}
+	var centers [4]float64
+	for i := range n {
+		centers[i] = float64(lo) + float64(hi-lo)*float64(2*i+1)/float64(2*n)
+	}
+	for range 6 {
+		var sum, count [4]float64
+		for _, v := range vals {
+			x := float64(v)
+			k := 0
+			for i := 1; i < n; i++ {
+				if x >= (centers[i-1]+centers[i])/2 {
+					k = i
+				}
+			}
+			sum[k] += x
+			count[k]++
+		}
+		for i := range n {
+			if count[i] > 0 {
+				centers[i] = sum[i] / count[i]
+			}
+		}
+	}
+	f := multiFit{n: n}
+	for i := range n {
+		f.levels[i] = clampLevel(centers[i])
+	}
+	return f
+}
+
+// fitMultiLevelBounded returns a fit whose per-pixel error is at most bound,
+// and whether one exists: the values, taken in ascending order, must form
+// three or four groups each within 2*bound levels.
+func fitMultiLevelBounded(vals []uint8, bound int) (multiFit, bool) {
+	var present [256]bool
+	for _, v := range vals {
+		present[v] = true
+	}
+	var f multiFit
+	start := -1
+	last := 0
+	for v := range 256 {
+		if !present[v] {
+			continue
+		}
+		if start >= 0 && v <= start+2*bound {
+			last = v
+			continue
+		}
+		if start >= 0 {
+			if f.n == 4 {
+				return multiFit{}, false
+			}
+			f.levels[f.n] = uint8((start + last) / 2)
+			f.n++
+		}
+		start, last = v, v
+	}
+	if f.n == 4 {
+		return multiFit{}, false
+	}
+	f.levels[f.n] = uint8((start + last) / 2)
+	f.n++
+	return f, f.n >= 3
+}
+
+// drawMultiLevelPix reads 2-bit indices from br and writes the levels of a
+// multi-level block into one channel of pix.
+func drawMultiLevelPix(pix []byte, strideBytes int, x0, y0, bw, bh int, br *bitReader, f multiFit, channelOffset int) error {
+	for j := range bh {
+		row := (y0+j)*strideBytes + x0*4 + channelOffset
+		for i := range bw {
+			k, err := br.readBits(2)
+			if err != nil {
+				return fmt.Errorf("decodeChannel: pattern stream too short")
+			}
+			if int(k) >= f.n {
+				return fmt.Errorf("decodeChannel: level index %d out of range", k)
+			}
+			pix[row+i*4] = f.levels[k]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+// Native output types (Decoder.DecodeImage, Decoder.DecodeYCbCr).
+//
+// Decode always returns RGBA. Luma-only streams (bw mode) can come out as
+// *image.Gray instead, and callers that work on planar YCbCr can take the
+// decoded planes as 4:4:4 *image.YCbCr. Both skip the conversion to RGB
+// where the stored planes already are the output: any luma-only stream, and
+// BT.601 full-range streams for YCbCr. Residual layers, the postfilter and
+// ToSRGB work on RGB, so with them the image is decoded to RGBA and
+// converted. Streams carry no alpha channel, so decoded images are always
+// opaque and there is no *image.NRGBA form.
+
+import (
+	"image"
+)
+
+// DecodeImage decodes like Decode but returns *image.Gray for streams that
+// only store luma (bw mode), and *image.RGBA otherwise. The returned image
+// is reused by the next call.
+func (d *Decoder) DecodeImage(compData []byte, postfilter bool) (image.Image, error) {
+	payload, err := d.inflate(compData)
+	if err != nil {
+		return nil, err
+	}
+	hdr, pos, err := d.readHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.channels&(channelFlagCb|channelFlagCr) != 0 {
+		return d.decodeRGBA(payload, postfilter)
+	}
+
+	rect := image.Rect(0, 0, hdr.w, hdr.h)
+	if d.gray == nil || d.gray.Rect != rect {
+		d.gray = image.NewGray(rect)
+	}
+	dst := d.gray
+	if postfilter || d.rgbOnly(hdr) {
+		img, err := d.decodeRGBA(payload, postfilter)
+		if err != nil {
+			return nil, err
+		}
+		for y := range hdr.h {
+			src := img.Pix[y*img.Stride:]
+			row := dst.Pix[y*dst.Stride : y*dst.Stride+hdr.w]
+			for x := range row {
+				row[x] = src[x*4]
+			}
+		}
+		return dst, nil
+	}
+
+	src := d.storedImage(hdr)
+	if _, err := d.decodeStored(payload, pos, hdr, src, false); err != nil {
+		return nil, err
+	}
+	// The gray level of each luma value, as the RGB conversion would give it.
+	toRGB, err := colorToRGB(hdr.color)
+	if err != nil {
+		return nil, err
+	}
+	var lut [256 * 4]uint8
+	for i := range 256 {
+		lut[i*4] = uint8(i)
+	}
+	toRGB(lut[:], len(lut), 256, 0, 1, false, false)
+
+	for y := range hdr.h {
+		s := src.Pix[y*src.Stride:]
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+hdr.w]
+		for x := range row {
+			row[x] = lut[int(s[x*4])*4]
+		}
+	}
+	return dst, nil
+}
+
+// DecodeYCbCr decodes a stream into a 4:4:4 *image.YCbCr (BT.601 full
+// range, as image/color defines it), without the postfilter. Chroma of
+// luma-only streams is neutral. The returned image is reused by the next
+// call.
+func (d *Decoder) DecodeYCbCr(compData []byte) (*image.YCbCr, error) {
+	payload, err := d.inflate(compData)
+	if err != nil {
+		return nil, err
+	}
+	hdr, pos, err := d.readHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	rect := image.Rect(0, 0, hdr.w, hdr.h)
+	if d.ycbcr == nil || d.ycbcr.Rect != rect {
+		d.ycbcr = image.NewYCbCr(rect, image.YCbCrSubsampleRatio444)
+	}
+	dst := d.ycbcr
+	if hdr.color != ColorBT601 || d.rgbOnly(hdr) {
+		img, err := d.decodeRGBA(payload, false)
+		if err != nil {
+			return nil, err
+		}
+		m := colorMatrixFor(ColorBT601)
+		for y := range hdr.h {
+			src := img.Pix[y*img.Stride:]
+			o := y * dst.YStride
+			for x := range hdr.w {
+				dst.Y[o+x], dst.Cb[o+x], dst.Cr[o+x] = m.fromRGB(src[x*4], src[x*4+1], src[x*4+2])
+			}
+		}
+		return dst, nil
+	}
+
+	src := d.storedImage(hdr)
+	if _, err := d.decodeStored(payload, pos, hdr, src, false); err != nil {
+		return nil, err
+	}
+	hasCb := hdr.channels&channelFlagCb != 0
+	hasCr := hdr.channels&channelFlagCr != 0
+	for y := range hdr.h {
+		s := src.Pix[y*src.Stride:]
+		o := y * dst.YStride
+		for x := range hdr.w {
+			dst.Y[o+x], dst.Cb[o+x], dst.Cr[o+x] = s[x*4], 128, 128
+			if hasCb {
+				dst.Cb[o+x] = s[x*4+1]
+			}
+			if hasCr {
+				dst.Cr[o+x] = s[x*4+2]
+			}
+		}
+	}
+	return dst, nil
+}
+
+// rgbOnly reports whether decoding hdr's stream involves a step that works
+// on RGB: a residual layer, or conversion of its ICC profile to sRGB.
+func (d *Decoder) rgbOnly(hdr *streamHeader) bool {
+	return !d.SkipResidual && hdr.features&featResidual != 0 || d.ToSRGB && hdr.icc != nil
+}
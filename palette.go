@@ -0,0 +1,218 @@
+package main
+
+// Palette stage.
+//
+// The tones of a joint segment (joint.go) are clustered into one global
+// palette of YCbCr colours stored in the header. Blocks then store palette
+// indices of bitsNeeded(len(palette)-1) bits each, msb-first: one per block in
+// the FG stream and one per pattern block in the BG stream. Images with few
+// distinct tones (flat illustrations, UI) keep them exactly.
+
+import (
+	"bytes"
+	"slices"
+)
+
+// maxPaletteSize bounds the palette so indices fit in one byte.
+const maxPaletteSize = 256
+
+// palette is a list of colours, one level per stored channel.
+type palette []jointTone
+
+type toneCount struct {
+	tone  jointTone
+	count int
+}
+
+// toneDist returns the squared distance between two tones.
+func toneDist(a, b jointTone) int {
+	d := 0
+	for c := range a {
+		x := int(a[c]) - int(b[c])
+		d += x * x
+	}
+	return d
+}
+
+// buildPalette reduces tones to at most size colours: the distinct tones
+// themselves when they fit, otherwise median cut refined by a few weighted
+// k-means passes.
+func buildPalette(tones []jointTone, nch, size int) palette {
+	size = min(max(size, 1), maxPaletteSize)
+
+	counts := make(map[jointTone]int)
+	for _, t := range tones {
+		counts[t]++
+	}
+	colors := make([]toneCount, 0, len(counts))
+	for t, n := range counts {
+		colors = append(colors, toneCount{t, n})
+	}
+	// Most frequent first; ties by value to keep the output deterministic.
+	slices.SortFunc(colors, func(a, b toneCount) int {
+		if a.count != b.count {
+			return b.count - a.count
+		}
+		return slices.Compare(a.tone[:], b.tone[:])
+	})
+	if len(colors) == 0 {
+		return palette{{}}
+	}
+	if len(colors) <= size {
+		pal := make(palette, len(colors))
+		for i, c := range colors {
+			pal[i] = c.tone
+		}
+		return pal
+	}
+
+	pal := medianCut(colors, nch, size)
+	for range 4 {
+		refinePalette(pal, colors)
+	}
+	return pal
+}
+
+// medianCut splits the colours into size boxes, always cutting the box with
+// the widest channel range at its weighted median, and returns the weighted
+// box means.
+func medianCut(colors []toneCount, nch, size int) palette {
+	boxes := [][]toneCount{colors}
+	for len(boxes) < size {
+		bi, bc, br := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			for c := range nch {
+				lo, hi := box[0].tone[c], box[0].tone[c]
+				for _, t := range box {
+					lo = min(lo, t.tone[c])
+					hi = max(hi, t.tone[c])
+				}
+				if r := int(hi) - int(lo); r > br {
+					bi, bc, br = i, c, r
+				}
+			}
+		}
+		if bi < 0 {
+			break
+		}
+
+		box := boxes[bi]
+		slices.SortFunc(box, func(a, b toneCount) int {
+			return int(a.tone[bc]) - int(b.tone[bc])
+		})
+		total := 0
+		for _, t := range box {
+			total += t.count
+		}
+		cut, acc := 1, 0
+		for i, t := range box[:len(box)-1] {
+			acc += t.count
+			cut = i + 1
+			if 2*acc >= total {
+				break
+			}
+		}
+		boxes[bi] = box[:cut]
+		boxes = append(boxes, box[cut:])
+	}
+
+	pal := make(palette, len(boxes))
+	for i, box := range boxes {
+		pal[i] = weightedMean(box)
+	}
+	return pal
+}
+
+func weightedMean(colors []toneCount) jointTone {
+	var sum [3]int
+	n := 0
+	for _, t := range colors {
+		for c := range sum {
+			sum[c] += int(t.tone[c]) * t.count
+		}
+		n += t.count
+	}
+	var m jointTone
+	for c := range sum {
+		m[c] = uint8((sum[c] + n/2) / n)
+	}
+	return m
+}
+
+// refinePalette runs one weighted k-means pass over colors.
+func refinePalette(pal palette, colors []toneCount) {
+	sums := make([][4]int, len(pal))
+	for _, t := range colors {
+		s := &sums[pal.nearest(t.tone)]
+		for c := range 3 {
+			s[c] += int(t.tone[c]) * t.count
+		}
+		s[3] += t.count
+	}
+	for i, s := range sums {
+		if s[3] == 0 {
+			continue
+		}
+		for c := range 3 {
+			pal[i][c] = uint8((s[c] + s[3]/2) / s[3])
+		}
+	}
+}
+
+// nearest returns the index of the closest palette entry.
+func (p palette) nearest(t jointTone) int {
+	best, bestDist := 0, -1
+	for i, e := range p {
+		if d := toneDist(t, e); bestDist < 0 || d < bestDist {
+			best, bestDist = i, d
+			if d == 0 {
+				break
+			}
+		}
+	}
+	return best
+}
+
+// appendIndices appends the bit-packed palette indices of tones to dst.
+func (p palette) appendIndices(dst []byte, tones []jointTone) []byte {
+	width := uint8(bitsNeeded(len(p) - 1))
+	cache := make(map[jointTone]int)
+	var buf bytes.Buffer
+	bw := newBitWriter(&buf)
+	for _, t := range tones {
+		idx, ok := cache[t]
+		if !ok {
+			idx = p.nearest(t)
+			cache[t] = idx
+		}
+		bw.writeBits(uint64(idx), width)
+	}
+	bw.flush()
+	return append(dst, buf.Bytes()...)
+}
+
+// flatten returns the header form of the palette: nch levels per entry.
+func (p palette) flatten(nch int) []uint8 {
+	out := make([]uint8, 0, len(p)*nch)
+	for _, t := range p {
+		out = append(out, t[:nch]...)
+	}
+	return out
+}
+
+// unflattenPalette unpacks the header palette b into dst, growing it when
+// needed.
+func unflattenPalette(dst palette, b []uint8, nch int) palette {
+	n := len(b) / nch
+	if cap(dst) < n {
+		dst = make(palette, n)
+	}
+	p := dst[:n]
+	for i := range p {
+		copy(p[i][:nch], b[i*nch:])
+	}
+	return p
+}
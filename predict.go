@@ -0,0 +1,120 @@
+package main
+
+// Spatial prediction of block levels (featPredict).
+//
+// Instead of a delta from the previously emitted level, every FG and BG
+// level of the tree layout is stored as a circular residual (encodeDelta8)
+// from a MED/LOCO-I prediction out of the blocks to the left, above and
+// above-left. The context is a level map at smallBlock granularity: every
+// leaf writes its levels into all cells it covers, solid blocks writing the
+// same level to both maps. Leaves are visited in an order where those three
+// neighbours of a leaf's top-left cell are always known.
+
+import "io"
+
+// levelMap holds the last coded FG and BG level of every small-block cell of
+// one channel.
+type levelMap struct {
+	small  int
+	w, h   int // in cells
+	fg, bg []uint8
+}
+
+func newLevelMap(g treeGeom) *levelMap {
+	m := &levelMap{}
+	m.reset(g)
+	return m
+}
+
+// reset sizes m for the channel geometry g and clears it, reusing its
+// buffers.
+func (m *levelMap) reset(g treeGeom) {
+	m.small, m.w, m.h = g.small, g.w/g.small, g.h/g.small
+	n := m.w * m.h
+	if cap(m.fg) < n {
+		m.fg, m.bg = make([]uint8, n), make([]uint8, n)
+	}
+	m.fg, m.bg = m.fg[:n], m.bg[:n]
+	clear(m.fg)
+	clear(m.bg)
+}
+
+// predict returns the MED prediction for the block whose top-left pixel is
+// (x, y) from the levels in m.fg or m.bg.
+func (m *levelMap) predict(levels []uint8, x, y int) uint8 {
+	cx, cy := x/m.small, y/m.small
+	switch {
+	case cx == 0 && cy == 0:
+		return 128
+	case cy == 0:
+		return levels[cx-1]
+	case cx == 0:
+		return levels[(cy-1)*m.w]
+	}
+	i := cy*m.w + cx
+	return medPredict(levels[i-1], levels[i-m.w], levels[i-m.w-1])
+}
+
+// set records the levels of a leaf in every cell it covers.
+func (m *levelMap) set(x, y, bw, bh int, fg, bg uint8) {
+	cx, cy := x/m.small, y/m.small
+	cw, ch := bw/m.small, bh/m.small
+	for row := cy; row < cy+ch; row++ {
+		i := row*m.w + cx
+		for j := i; j < i+cw; j++ {
+			m.fg[j] = fg
+			m.bg[j] = bg
+		}
+	}
+}
+
+// setFrom records a leaf whose pixels are given by at: each cell takes the
+// level of its top-left pixel.
+func (m *levelMap) setFrom(x, y, bw, bh int, at func(i, j int) uint8) {
+	for j := 0; j < bh; j += m.small {
+		row := (y+j)/m.small*m.w + x/m.small
+		for i := 0; i < bw; i += m.small {
+			v := at(i, j)
+			m.fg[row+i/m.small] = v
+			m.bg[row+i/m.small] = v
+		}
+	}
+}
+
+// medPredict is the median edge detector of LOCO-I: the smaller of the left
+// (a) and top (b) levels above a rising edge, the larger below a falling one,
+// and the planar a+b-c otherwise.
+func medPredict(a, b, c uint8) uint8 {
+	lo, hi := min(a, b), max(a, b)
+	switch {
+	case c >= hi:
+		return lo
+	case c <= lo:
+		return hi
+	}
+	return uint8(int(a) + int(b) - int(c))
+}
+
+// residual returns the coded form of v predicted as pred.
+func residual(pred, v uint8) uint8 {
+	return uint8(encodeDelta8(pred, v))
+}
+
+// unresidual inverts residual.
+func unresidual(pred, r uint8) uint8 {
+	return decodeDelta8(pred, int8(r))
+}
+
+// residualStream reads stored residuals one at a time.
+type residualStream struct {
+	data []byte
+	i    int
+}
+
+func (s *residualStream) next() (uint8, error) {
+	if s.i >= len(s.data) {
+		return 0, io.EOF
+	}
+	s.i++
+	return s.data[s.i-1], nil
+}
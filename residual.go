@@ -0,0 +1,136 @@
+package main
+
+// Residual enhancement layer (featResidual).
+//
+// The layer follows the channel segments as a u32 length and the residual
+// bytes: the difference between the source and the decoded base image,
+// quantized with the step from the header, one plane per colour channel
+// (R, G, B; a single gray plane in grayscale mode), row-major over the image.
+// With step 1 residuals are stored modulo 256 and restore the source
+// exactly; larger steps store round(d/step) as a signed byte. Decoders may
+// skip the layer and show the base image.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// quantizeResidual returns the stored form of the difference d.
+func quantizeResidual(d, step int) uint8 {
+	if step == 1 {
+		return uint8(d)
+	}
+	k := d / step
+	if r := d % step; 2*r >= step {
+		k++
+	} else if 2*r <= -step {
+		k--
+	}
+	return uint8(int8(min(max(k, -128), 127)))
+}
+
+// applyResidualLevel returns base corrected by the stored residual r.
+func applyResidualLevel(base, r uint8, step int) uint8 {
+	if step == 1 {
+		return base + r
+	}
+	return uint8(min(max(int(base)+int(int8(r))*step, 0), 255))
+}
+
+// writeResidual appends the residual layer of img to the base stream in
+// e.raw. gray is the source of the single plane in grayscale mode, with
+// stride grayStride.
+func (e *Encoder) writeResidual(img image.Image, gray []uint8, grayStride int) error {
+	if e.hdr.features&featResidual == 0 {
+		return nil
+	}
+	if err := e.bw.Flush(); err != nil {
+		return err
+	}
+	if e.trialDec == nil {
+		e.trialDec = NewDecoder()
+	}
+	base, err := e.trialDec.decodePayload(e.raw.Bytes(), false, false)
+	if err != nil {
+		return err
+	}
+
+	step := int(e.hdr.residualStep)
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	out := e.residual[:0]
+	if encodeBW {
+		for y := range h {
+			for x := range w {
+				d := int(gray[y*grayStride+x]) - int(base.Pix[y*base.Stride+x*4])
+				out = append(out, quantizeResidual(d, step))
+			}
+		}
+	} else {
+		n := w * h
+		out = append(out, make([]uint8, 3*n)...)
+		for y := range h {
+			for x := range w {
+				c := color.RGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.RGBA)
+				o := y*base.Stride + x*4
+				i := y*w + x
+				out[i] = quantizeResidual(int(c.R)-int(base.Pix[o]), step)
+				out[n+i] = quantizeResidual(int(c.G)-int(base.Pix[o+1]), step)
+				out[2*n+i] = quantizeResidual(int(c.B)-int(base.Pix[o+2]), step)
+			}
+		}
+	}
+	e.residual = out
+
+	if err := writeU32BE(e.bw, uint32(len(out))); err != nil {
+		return err
+	}
+	_, err = e.bw.Write(out)
+	return err
+}
+
+// readResidualLayer returns the residual bytes at *pos and advances past them.
+func readResidualLayer(payload []byte, pos *int) ([]byte, error) {
+	if len(payload)-*pos < 4 {
+		return nil, fmt.Errorf("decode: truncated while reading residual length")
+	}
+	n := binary.BigEndian.Uint32(payload[*pos:])
+	*pos += 4
+	if n > uint32(len(payload)-*pos) {
+		return nil, fmt.Errorf("decode: truncated residual layer")
+	}
+	data := payload[*pos : *pos+int(n)]
+	*pos += int(n)
+	return data, nil
+}
+
+// applyResidual adds the residual layer data to the decoded image dst.
+func applyResidual(dst *image.RGBA, data []byte, step int, gray bool) error {
+	w, h := dst.Rect.Dx(), dst.Rect.Dy()
+	n := w * h
+	planes := 3
+	if gray {
+		planes = 1
+	}
+	if len(data) != planes*n {
+		return fmt.Errorf("decode: residual layer has %d bytes, want %d", len(data), planes*n)
+	}
+	for y := range h {
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+w*4]
+		for x := range w {
+			i := y*w + x
+			o := x * 4
+			if gray {
+				v := applyResidualLevel(row[o], data[i], step)
+				row[o], row[o+1], row[o+2] = v, v, v
+				continue
+			}
+			for c := range 3 {
+				row[o+c] = applyResidualLevel(row[o+c], data[c*n+i], step)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+// Region-of-interest quality map (Encoder.ROI).
+//
+// The importance map is stretched over the coded area and summed into an
+// integral image, so the mean importance of any tree node costs four
+// lookups. Important nodes get a smaller spread threshold and RD multiplier,
+// unimportant ones a larger threshold and coarser levels. Decoders need no
+// side information: only the encoder's choices change.
+
+import (
+	"image"
+	"math"
+)
+
+// roiMap is the integral image of the importance map over the coded area.
+type roiMap struct {
+	w   int      // coded width
+	sum []uint32 // (w+1) x (h+1), row-major
+}
+
+// newROIMap samples roi (nearest neighbour) over an image of w x h pixels
+// coded as w4 x h4; the padding repeats the edge.
+func newROIMap(roi *image.Gray, w, h, w4, h4 int, buf []uint32) roiMap {
+	n := (w4 + 1) * (h4 + 1)
+	if cap(buf) < n {
+		buf = make([]uint32, n)
+	}
+	m := roiMap{w: w4, sum: buf[:n]}
+	clear(m.sum[:w4+1])
+	rb := roi.Bounds()
+	rw, rh := rb.Dx(), rb.Dy()
+	for y := range h4 {
+		ry := rb.Min.Y + min(y, h-1)*rh/h
+		row := roi.Pix[roi.PixOffset(rb.Min.X, ry):]
+		var acc uint32
+		m.sum[(y+1)*(w4+1)] = 0
+		for x := range w4 {
+			acc += uint32(row[min(x, w-1)*rw/w])
+			m.sum[(y+1)*(w4+1)+x+1] = m.sum[y*(w4+1)+x+1] + acc
+		}
+	}
+	return m
+}
+
+// mean returns the mean importance of a bw x bh node at (x, y).
+func (m roiMap) mean(x, y, bw, bh int) int {
+	s := m.w + 1
+	t := m.sum[(y+bh)*s+x+bw] + m.sum[y*s+x] - m.sum[y*s+x+bw] - m.sum[(y+bh)*s+x]
+	return int(t) / (bw * bh)
+}
+
+// nodeScale returns the factor applied to the spread threshold of a node:
+// 2 for importance 0, 1 for 128 and 1/2 for 255, times the activity scale
+// with Encoder.Adaptive (activity.go). It is 1 without either.
+func (e *Encoder) nodeScale(x, y, bw, bh int) float64 {
+	var l float64
+	if len(e.roi.sum) > 0 {
+		l = 1 - float64(e.roi.mean(x, y, bw, bh))/127.5
+	}
+	if len(e.activity.logs) > 0 {
+		l += e.activity.log2Scale(x, y, bw, bh)
+	}
+	if l == 0 {
+		return 1
+	}
+	return math.Exp2(l)
+}
+
+// nodeLevelStep returns the precision of the levels of a leaf: unimportant
+// leaves round their levels to a multiple of 2 or 4, which the level deltas
+// compress better.
+func (e *Encoder) nodeLevelStep(x, y, bw, bh int) int {
+	if len(e.roi.sum) == 0 {
+		return 1
+	}
+	switch m := e.roi.mean(x, y, bw, bh); {
+	case m < 32:
+		return 4
+	case m < 96:
+		return 2
+	}
+	return 1
+}
+
+// roundLevel rounds v to the nearest multiple of step.
+func roundLevel(v uint8, step int) uint8 {
+	return uint8(min((int(v)+step/2)/step*step, 255))
+}
+
+// nodeLambda returns the RD multiplier of a node from the image-wide lambda;
+// it scales with the square of the spread threshold.
+func (e *Encoder) nodeLambda(lambda float64, x, y, bw, bh int) float64 {
+	s := e.nodeScale(x, y, bw, bh)
+	return lambda * s * s
+}
@@ -0,0 +1,519 @@
+package main
+
+// Scaled decoding (Decoder.DecodeScaled).
+//
+// Thumbnails need a fraction of the pixels, and most of a full decode is
+// spent writing them: expanding every block, converting every pixel to RGB.
+// DecodeScaled reads the block streams as usual but adds each leaf to the
+// cells of a grid at 1/2, 1/4 or 1/8 resolution instead. A solid block adds
+// its level times its overlap with each cell; a pattern reads the bits of
+// each cell's part of a row at once and adds fg and bg by their counts, so
+// only gradients and multi-level blocks are expanded pixel by pixel. The
+// planes are averaged per cell and converted to RGB at the reduced size.
+// The colour matrices are linear, so this is a box filter over the decoded
+// image up to rounding and clipping of out-of-gamut colours.
+//
+// Streams whose blocks need decoded pixels (block copies, chroma from
+// luma), whose residual layer is applied, or whose transform is not linear
+// (ColorYCoCgR) are decoded in full and box-filtered, which gives the same
+// result at the usual cost.
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+)
+
+// scaledPlanes accumulates the three planes of an image over cells of
+// 1<<shift pixels square. Cells on the right and bottom edges only cover
+// the pixels inside the image.
+type scaledPlanes struct {
+	shift      int
+	w, h       int // cells
+	imgW, imgH int
+	sum        [3][]uint32
+	dst        *image.RGBA
+}
+
+// reset clears the grid for an imgW x imgH image.
+func (s *scaledPlanes) reset(imgW, imgH, shift int) {
+	s.shift = shift
+	s.imgW, s.imgH = imgW, imgH
+	s.w = (imgW + 1<<shift - 1) >> shift
+	s.h = (imgH + 1<<shift - 1) >> shift
+	n := s.w * s.h
+	for c := range s.sum {
+		if cap(s.sum[c]) < n {
+			s.sum[c] = make([]uint32, n)
+		}
+		s.sum[c] = s.sum[c][:n]
+		clear(s.sum[c])
+	}
+}
+
+// fill adds a solid block of level v to plane c.
+func (s *scaledPlanes) fill(c, x, y, bw, bh int, v uint8) {
+	x1, y1 := min(x+bw, s.imgW), min(y+bh, s.imgH)
+	if x1 <= x || y1 <= y {
+		return
+	}
+	if (x^(x1-1))>>s.shift == 0 && (y^(y1-1))>>s.shift == 0 {
+		// The common case: the block lies in one cell.
+		s.sum[c][(y>>s.shift)*s.w+x>>s.shift] += uint32(v) * uint32((x1-x)*(y1-y))
+		return
+	}
+	for cy0 := y; cy0 < y1; {
+		cy1 := min((cy0>>s.shift+1)<<s.shift, y1)
+		row := (cy0 >> s.shift) * s.w
+		for cx0 := x; cx0 < x1; {
+			cx1 := min((cx0>>s.shift+1)<<s.shift, x1)
+			s.sum[c][row+cx0>>s.shift] += uint32(v) * uint32((cx1-cx0)*(cy1-cy0))
+			cx0 = cx1
+		}
+		cy0 = cy1
+	}
+}
+
+// pattern reads the bits of a pattern block from br and adds it to plane c.
+// Bits of pixels past the image edge are read and dropped.
+func (s *scaledPlanes) pattern(c, x, y, bw, bh int, br *bitReader, fg, bg uint8) error {
+	cell := 1 << s.shift
+	for j := range bh {
+		yy := y + j
+		row := (yy >> s.shift) * s.w
+		for i := 0; i < bw; {
+			xx := x + i
+			n := min(bw-i, cell-xx&(cell-1))
+			b, err := br.readBits(uint8(n))
+			if err != nil {
+				return fmt.Errorf("decodeChannel: pattern stream too short")
+			}
+			i += n
+			if yy >= s.imgH || xx >= s.imgW {
+				continue
+			}
+			m := min(n, s.imgW-xx)
+			ones := bits.OnesCount8(b >> (n - m))
+			s.sum[c][row+xx>>s.shift] += uint32(ones)*uint32(fg) + uint32(m-ones)*uint32(bg)
+		}
+	}
+	return nil
+}
+
+// patternRowRep has bit j*b set for every row j of a b x b pattern, so that
+// a mask of columns within one row times patternRowRep[b] selects those
+// columns in every row.
+var patternRowRep = func() (rep [9]uint64) {
+	for b := 1; b <= 8; b++ {
+		for j := range b {
+			rep[b] |= 1 << (j * b)
+		}
+	}
+	return rep
+}()
+
+// patternFast is pattern for a b x b block inside the image, b <= 8, with at
+// least b*b bits left in br. It reads the whole pattern at once and counts
+// the bits of each cell's part of the block with a mask.
+func (s *scaledPlanes) patternFast(c, x, y, b int, br *bitReader, fg, bg uint8) {
+	v := br.readWideFast(b * b)
+	sum := s.sum[c]
+	if ((x^(x+b-1))|(y^(y+b-1)))>>s.shift == 0 {
+		ones := uint32(bits.OnesCount64(v))
+		sum[(y>>s.shift)*s.w+x>>s.shift] += ones*uint32(fg) + (uint32(b*b)-ones)*uint32(bg)
+		return
+	}
+	cell := 1 << s.shift
+	for j := 0; j < b; {
+		rows := min(b-j, cell-(y+j)&(cell-1))
+		rowMask := (uint64(1)<<(rows*b) - 1) << ((b - j - rows) * b)
+		row := ((y + j) >> s.shift) * s.w
+		for i := 0; i < b; {
+			cols := min(b-i, cell-(x+i)&(cell-1))
+			colMask := (uint64(1)<<cols - 1) << (b - i - cols) * patternRowRep[b]
+			ones := bits.OnesCount64(v & rowMask & colMask)
+			n := rows * cols
+			sum[row+(x+i)>>s.shift] += uint32(ones)*uint32(fg) + uint32(n-ones)*uint32(bg)
+			i += cols
+		}
+		j += rows
+	}
+}
+
+// multiLevel reads the 2-bit indices of a multi-level block from br and adds
+// it to plane c.
+func (s *scaledPlanes) multiLevel(c, x, y, bw, bh int, br *bitReader, f multiFit) error {
+	for j := range bh {
+		for i := range bw {
+			k, err := br.readBits(2)
+			if err != nil {
+				return fmt.Errorf("decodeChannel: pattern stream too short")
+			}
+			if int(k) >= f.n {
+				return fmt.Errorf("decodeChannel: level index %d out of range", k)
+			}
+			s.add(c, x+i, y+j, f.levels[k])
+		}
+	}
+	return nil
+}
+
+// gradient adds a gradient block to plane c.
+func (s *scaledPlanes) gradient(c, x, y, bw, bh int, g gradientFit) {
+	for j := range min(bh, s.imgH-y) {
+		for i := range min(bw, s.imgW-x) {
+			s.add(c, x+i, y+j, g.at(i, j, bw, bh))
+		}
+	}
+}
+
+// add adds one pixel to plane c, if it lies inside the image.
+func (s *scaledPlanes) add(c, x, y int, v uint8) {
+	if x < s.imgW && y < s.imgH {
+		s.sum[c][(y>>s.shift)*s.w+x>>s.shift] += uint32(v)
+	}
+}
+
+// addImage adds the RGB channels of img, which must be imgW x imgH, to the
+// three planes.
+func (s *scaledPlanes) addImage(img *image.RGBA) {
+	for y := range s.imgH {
+		src := img.Pix[y*img.Stride : y*img.Stride+s.imgW*4]
+		row := (y >> s.shift) * s.w
+		for x := range s.imgW {
+			o := row + x>>s.shift
+			s.sum[0][o] += uint32(src[x*4])
+			s.sum[1][o] += uint32(src[x*4+1])
+			s.sum[2][o] += uint32(src[x*4+2])
+		}
+	}
+}
+
+// image returns the cell means as an opaque RGBA image, with the planes at
+// channel offsets 0, 1 and 2. The image is reused by the next reset.
+func (s *scaledPlanes) image() *image.RGBA {
+	rect := image.Rect(0, 0, s.w, s.h)
+	if s.dst == nil || s.dst.Rect != rect {
+		s.dst = image.NewRGBA(rect)
+	}
+	pix := s.dst.Pix
+	for cy := range s.h {
+		ch := min((cy+1)<<s.shift, s.imgH) - cy<<s.shift
+		for cx := range s.w {
+			cw := min((cx+1)<<s.shift, s.imgW) - cx<<s.shift
+			n := uint32(cw * ch)
+			i := cy*s.w + cx
+			o := cy*s.dst.Stride + cx*4
+			pix[o+0] = uint8((s.sum[0][i] + n/2) / n)
+			pix[o+1] = uint8((s.sum[1][i] + n/2) / n)
+			pix[o+2] = uint8((s.sum[2][i] + n/2) / n)
+			pix[o+3] = 255
+		}
+	}
+	return s.dst
+}
+
+// DecodeScaled decodes compData at 1/factor of its size, for factor 2, 4 or
+// 8: each output pixel is the mean of a factor x factor square of the image
+// (edge pixels cover what is left of the image), so a w x h image comes out
+// as ceil(w/factor) x ceil(h/factor). Most streams are reduced block by
+// block without being expanded, which makes it much cheaper than Decode
+// followed by a resize. There is no postfilter. The returned image is
+// reused by the next call.
+func (d *Decoder) DecodeScaled(compData []byte, factor int) (*image.RGBA, error) {
+	shift := bits.TrailingZeros(uint(factor))
+	if factor < 2 || factor > 8 || factor != 1<<shift {
+		return nil, fmt.Errorf("decode: scale factor %d is not 2, 4 or 8", factor)
+	}
+	payload, err := d.inflate(compData)
+	if err != nil {
+		return nil, err
+	}
+	hdr, pos, err := d.readHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+	s := &d.scaled
+	s.reset(hdr.w, hdr.h, shift)
+
+	if hdr.features&(featCopy|featChromaFromLuma) != 0 || hdr.color == ColorYCoCgR ||
+		!d.SkipResidual && hdr.features&featResidual != 0 {
+		img, err := d.decodeRGBA(payload, false)
+		if err != nil {
+			return nil, err
+		}
+		s.addImage(img)
+		return s.image(), nil
+	}
+
+	if err := d.decodeScaledPlanes(payload, pos, hdr); err != nil {
+		return nil, err
+	}
+	toRGB, err := colorToRGB(hdr.color)
+	if err != nil {
+		return nil, err
+	}
+	dst := s.image()
+	toRGB(dst.Pix, dst.Stride, s.w, 0, s.h, hdr.channels&channelFlagCb != 0, hdr.channels&channelFlagCr != 0)
+	if !d.ToSRGB || d.profile == nil {
+		return dst, nil
+	}
+	p, err := ParseICC(d.profile)
+	if err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	p.ToSRGB(dst)
+	return dst, nil
+}
+
+// decodeScaledPlanes decodes the channel segments of the stream with header
+// hdr, starting at pos, into d.scaled.
+func (d *Decoder) decodeScaledPlanes(payload []byte, pos int, hdr *streamHeader) error {
+	smallBlock = hdr.small
+	macroBlock = hdr.macro
+	s := &d.scaled
+
+	// Like decodeStored, pixels outside the coded area of unpadded
+	// streams are black.
+	codedW, codedH := hdr.codedSize()
+	if hdr.features&featPadded == 0 {
+		for c, v := range [3]uint8{0, 128, 128} {
+			s.fill(c, codedW, 0, hdr.w-codedW, hdr.h, v)
+			s.fill(c, 0, codedH, codedW, hdr.h-codedH, v)
+		}
+	}
+
+	seg, err := readChannelSegment(payload, &pos, false)
+	if err != nil {
+		return err
+	}
+	if hdr.features&featJoint != 0 {
+		return decodeJointToPix(hdr, seg, nil, 0, s, &d.joint)
+	}
+	scratch := [3]*decoderChannelScratch{&d.y, &d.cb, &d.cr}
+	for c := range scratch {
+		if hdr.channels&(channelFlagY<<c) == 0 {
+			continue
+		}
+		if c > 0 {
+			if seg, err = readChannelSegment(payload, &pos, false); err != nil {
+				return err
+			}
+		}
+		if hdr.features&featTree != 0 {
+			err = decodeChannelTreeToPix(hdr, seg, nil, 0, c, s, scratch[c])
+		} else {
+			err = decodeChannelScaled(seg, codedW, codedH, c, s)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeChannelScaled decodes a channel with the fixed macro/small block
+// layout of decodeChannelToPix into plane c of out.
+func decodeChannelScaled(data []byte, imgW, imgH, c int, out *scaledPlanes) error {
+	ss, err := parseSegmentStreams(data, false)
+	if err != nil {
+		return err
+	}
+	if ss.blockCount > 0 && len(ss.fg) < ss.blockCount {
+		return fmt.Errorf("decodeChannel: FG packed data too short")
+	}
+	if len(ss.bg) > ss.blockCount {
+		return fmt.Errorf("decodeChannel: BG packed data too long")
+	}
+	fgStream, err := newDeltaStream(ss.fg, ss.blockCount)
+	if err != nil {
+		return err
+	}
+	bgStream, err := newDeltaStream(ss.bg, len(ss.bg))
+	if err != nil {
+		return err
+	}
+
+	blockIndex := 0
+	// BG is stored only for pattern blocks (type bit = 1).
+	block := func(x, y, size int) error {
+		if blockIndex >= ss.blockCount {
+			return fmt.Errorf("unexpected end of blocks")
+		}
+		blockIndex++
+		bitType, err := ss.typ.readBit()
+		if err != nil {
+			return err
+		}
+		fg, err := fgStream.next()
+		if err != nil {
+			return err
+		}
+		if !bitType {
+			out.fill(c, x, y, size, size, fg)
+			return nil
+		}
+		bg, err := bgStream.next()
+		if err != nil {
+			return fmt.Errorf("decodeChannel: BG stream truncated")
+		}
+		return out.pattern(c, x, y, size, size, &ss.pattern, fg, bg)
+	}
+
+	w4 := (imgW / smallBlock) * smallBlock
+	h4 := (imgH / smallBlock) * smallBlock
+	fullW := (w4 / macroBlock) * macroBlock
+	fullH := (h4 / macroBlock) * macroBlock
+	useMacro := macroBlock > smallBlock
+
+	hot := useMacro && smallBlock == 1 && macroBlock == 2 && fullW <= out.imgW && fullH <= out.imgH
+	if hot {
+		// Hot path for quality >= 80, as in decodeChannelToPix: every 2x2
+		// macro block lies in one cell and adds a single sum to it.
+		if len(ss.size.data)*8 < fullW/2*fullH/2 {
+			return fmt.Errorf("decodeChannel: size stream too short")
+		}
+		if len(ss.typ.data)*8 < ss.blockCount {
+			return fmt.Errorf("decodeChannel: type stream too short")
+		}
+		sum := out.sum[c]
+		for my := 0; my < fullH; my += 2 {
+			// Consecutive blocks share a cell: add their sum once.
+			row := (my >> out.shift) * out.w
+			cell, acc := row, uint32(0)
+			for mx := 0; mx < fullW; mx += 2 {
+				var v uint32
+				if ss.size.readBitFast() {
+					if blockIndex >= ss.blockCount {
+						return fmt.Errorf("unexpected end of blocks in main area")
+					}
+					blockIndex++
+					bitType := ss.typ.readBitFast()
+					fg := uint32(fgStream.nextFast())
+					v = 4 * fg
+					if bitType {
+						if bgStream.i >= bgStream.n {
+							return fmt.Errorf("decodeChannel: BG stream truncated")
+						}
+						bg := uint32(bgStream.nextFast())
+						b, err := ss.pattern.readBits(4)
+						if err != nil {
+							return err
+						}
+						ones := uint32(bits.OnesCount8(b))
+						v = ones*fg + (4-ones)*bg
+					}
+				} else {
+					if blockIndex+4 > ss.blockCount {
+						return fmt.Errorf("unexpected end of blocks in macro grid")
+					}
+					blockIndex += 4
+					_ = ss.typ.readBitsFast(4) // four 1x1 blocks; type bits are all 0
+					v = uint32(fgStream.nextFast()) + uint32(fgStream.nextFast()) +
+						uint32(fgStream.nextFast()) + uint32(fgStream.nextFast())
+				}
+				if i := row + mx>>out.shift; i != cell {
+					sum[cell] += acc
+					cell, acc = i, 0
+				}
+				acc += v
+			}
+			sum[cell] += acc
+		}
+	}
+	macro := func(mx, my int) error {
+		macroIsBig, err := ss.size.readBit()
+		if err != nil {
+			return err
+		}
+		if useMacro && macroIsBig {
+			return block(mx, my, macroBlock)
+		}
+		for by := 0; by < macroBlock; by += smallBlock {
+			for bx := 0; bx < macroBlock; bx += smallBlock {
+				if err := block(mx+bx, my+by, smallBlock); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	// The other presets: macro blocks inside the image whose streams hold
+	// enough for the whole block are read without per-bit checks, each
+	// pattern in one go, and reduced straight into the cells; the rest go
+	// through block.
+	fast := !hot && useMacro && macroBlock <= 8
+	perMacro := (macroBlock / smallBlock) * (macroBlock / smallBlock)
+	sum := out.sum[c]
+	for my := 0; my < fullH && !hot; my += macroBlock {
+		for mx := 0; mx < fullW; mx += macroBlock {
+			// Macro blocks on the edge of the image are clipped by block.
+			// The type stream needs up to 9 bits, whole bytes to spare.
+			if !fast || mx+macroBlock > out.imgW || my+macroBlock > out.imgH ||
+				ss.size.idx >= len(ss.size.data) || ss.typ.idx+3 > len(ss.typ.data) ||
+				fgStream.n-fgStream.i < perMacro || blockIndex+perMacro > ss.blockCount {
+				if err := macro(mx, my); err != nil {
+					return err
+				}
+				continue
+			}
+			b, n := smallBlock, macroBlock/smallBlock
+			if ss.size.readBitFast() {
+				b, n = macroBlock, 1
+			}
+			blockIndex += n * n
+			for y := my; y < my+n*b; y += b {
+				for x := mx; x < mx+n*b; x += b {
+					isPattern := ss.typ.readBitFast()
+					fg := fgStream.nextFast()
+					if !isPattern {
+						if ((x^(x+b-1))|(y^(y+b-1)))>>out.shift == 0 {
+							sum[(y>>out.shift)*out.w+x>>out.shift] += uint32(fg) * uint32(b*b)
+						} else {
+							out.fill(c, x, y, b, b, fg)
+						}
+						continue
+					}
+					if bgStream.i >= bgStream.n {
+						return fmt.Errorf("decodeChannel: BG stream truncated")
+					}
+					bg := bgStream.nextFast()
+					if ss.pattern.idx+9 > len(ss.pattern.data) {
+						// Too close to the end for up to 64 unchecked bits.
+						if err := out.pattern(c, x, y, b, b, &ss.pattern, fg, bg); err != nil {
+							return err
+						}
+						continue
+					}
+					out.patternFast(c, x, y, b, &ss.pattern, fg, bg)
+				}
+			}
+		}
+	}
+	// right stripe, then bottom stripe: small blocks only
+	for my := 0; my < fullH; my += smallBlock {
+		for mx := fullW; mx < w4; mx += smallBlock {
+			if err := block(mx, my, smallBlock); err != nil {
+				return err
+			}
+		}
+	}
+	for my := fullH; my < h4; my += smallBlock {
+		for mx := 0; mx < w4; mx += smallBlock {
+			if err := block(mx, my, smallBlock); err != nil {
+				return err
+			}
+		}
+	}
+
+	if blockIndex != ss.blockCount {
+		return fmt.Errorf("block count mismatch: used %d of %d", blockIndex, ss.blockCount)
+	}
+	if fgStream.i != fgStream.n {
+		return fmt.Errorf("color stream mismatch: fg used=%d expected=%d", fgStream.i, fgStream.n)
+	}
+	if bgStream.i != bgStream.n {
+		return fmt.Errorf("color stream mismatch: bg used=%d expected=%d", bgStream.i, bgStream.n)
+	}
+	return nil
+}
@@ -0,0 +1,1117 @@
+package main
+
+// Recursive (quadtree) block layout.
+//
+// The coded area is tiled with root blocks of smallBlock<<depth pixels. Each
+// node is either a leaf, coded as one dual-tone block, or split into its four
+// quadrants. Nodes are visited depth-first with children in raster order, and
+// every node that could go either way stores a split symbol in the size
+// stream (see splitBits). Nodes of smallBlock size are always leaves, and
+// nodes that cross the edge of the coded area are split without a symbol.
+//
+// The rectangular layout (featRect) adds splits into two halves, so leaves
+// can also be rectangles such as 2x1, 1x2, 4x2 or 2x4 small blocks.
+//
+// In a channel segment, leaves use the usual streams: a type bit (omitted for
+// 1x1 leaves, which are always solid), one FG level, and a BG level plus one
+// pattern bit per pixel for pattern blocks. With featChannelGeom the chroma
+// channels have their own small block and depth, so their trees are coarser
+// than the luma tree. The joint layout (joint.go) shares one tree between all
+// channels.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// treeDepthFor returns the largest depth whose root block smallBlock<<depth
+// still fits in root, capped at maxTreeDepth.
+func treeDepthFor(root, small int) int {
+	depth := 0
+	for depth < maxTreeDepth && small<<(depth+1) <= root {
+		depth++
+	}
+	return depth
+}
+
+// treeGeom describes the tree layout of one channel.
+type treeGeom struct {
+	small int
+	root  int
+	w, h  int  // coded area, a multiple of small in both directions
+	rect  bool // rectangular layout: nodes may also split into two halves
+}
+
+// newTreeGeom returns the layout of channel ch (chY for joint segments) over
+// a w x h coded area.
+func newTreeGeom(hdr *streamHeader, ch, w, h int) treeGeom {
+	small, depth := hdr.channelGeom(ch)
+	return treeGeom{
+		small: small,
+		root:  small << depth,
+		w:     (w / small) * small,
+		h:     (h / small) * small,
+		rect:  hdr.features&featRect != 0,
+	}
+}
+
+// forcedSplit returns the child size of a node that crosses the coded area,
+// or ok=false when the node lies inside it.
+func (g treeGeom) forcedSplit(x, y, bw, bh int) (cw, ch int, ok bool) {
+	cw, ch = bw, bh
+	if x+bw > g.w {
+		cw = bw / 2
+		ok = true
+	}
+	if y+bh > g.h {
+		ch = bh / 2
+		ok = true
+	}
+	return cw, ch, ok
+}
+
+// Split kinds of a tree node.
+const (
+	splitNone = iota // leaf
+	splitHalf        // every side longer than the small block is halved
+	splitRows        // top and bottom halves (rectangular layout only)
+	splitCols        // left and right halves (rectangular layout only)
+)
+
+// childSize returns the child size for a split kind. Nodes made rectangular by
+// a forced or directional split keep halving their long side once the short
+// side reaches the small block size.
+func (g treeGeom) childSize(kind, bw, bh int) (int, int) {
+	switch kind {
+	case splitRows:
+		return bw, bh / 2
+	case splitCols:
+		return bw / 2, bh
+	}
+	if bw > g.small {
+		bw /= 2
+	}
+	if bh > g.small {
+		bh /= 2
+	}
+	return bw, bh
+}
+
+// directional reports whether a node may use splitRows/splitCols: both sides
+// must be longer than the small block, otherwise splitHalf already is one.
+func (g treeGeom) directional(bw, bh int) bool {
+	return g.rect && bw > g.small && bh > g.small
+}
+
+// splitBits returns the size of the split symbol of a node that is not at
+// the small size: 0 = leaf, 1 = half, and in the rectangular layout
+// 10 = half, 110 = rows, 111 = cols.
+func (g treeGeom) splitBits(kind, bw, bh int) int {
+	switch {
+	case kind == splitNone:
+		return 1
+	case !g.directional(bw, bh):
+		return 1
+	case kind == splitHalf:
+		return 2
+	}
+	return 3
+}
+
+func (g treeGeom) writeSplit(w *bitWriter, kind, bw, bh int) {
+	w.writeBit(kind != splitNone)
+	if kind == splitNone || !g.directional(bw, bh) {
+		return
+	}
+	w.writeBit(kind != splitHalf)
+	if kind != splitHalf {
+		w.writeBit(kind == splitCols)
+	}
+}
+
+func (g treeGeom) readSplit(br *bitReader, bw, bh int) (int, error) {
+	split, err := br.readBit()
+	if err != nil || !split {
+		return splitNone, err
+	}
+	if !g.directional(bw, bh) {
+		return splitHalf, nil
+	}
+	if directional, err := br.readBit(); err != nil || !directional {
+		return splitHalf, err
+	}
+	cols, err := br.readBit()
+	if err != nil {
+		return splitNone, err
+	}
+	if cols {
+		return splitCols, nil
+	}
+	return splitRows, nil
+}
+
+// treeKey identifies a node within the current root block.
+type treeKey struct {
+	x, y, bw, bh int32
+}
+
+// treeChoice is the memoized RD decision for a node.
+type treeChoice struct {
+	kind int
+	cost float64
+}
+
+// treeLeafCoder models and codes the leaves of a tree layout.
+type treeLeafCoder interface {
+	// valueRange returns the largest max-min of the block over the coded planes.
+	valueRange(x, y, bw, bh int) int32
+	// fits reports whether the block can be coded as one leaf within the
+	// encoder's error bound (see Encoder.maxErr); it drives the greedy split
+	// of chooseSplitBounded.
+	fits(x, y, bw, bh int) bool
+	// leafCost returns the RD cost of coding the block as one leaf, +Inf when
+	// it cannot be coded within the error bound.
+	leafCost(x, y, bw, bh int) float64
+	// leaf codes the block as one leaf.
+	leaf(x, y, bw, bh int)
+	// rootDone is called after the root block at (x, y) is coded.
+	rootDone(x, y int)
+}
+
+// treeEncoder walks the tree layout, deciding and writing the split symbols;
+// leaves are handed to a treeLeafCoder.
+type treeEncoder struct {
+	e      *Encoder
+	g      treeGeom
+	spread int32
+	lambda float64
+	sizeW  bitWriter
+	leaves treeLeafCoder
+	// bounded restricts leaves to blocks that fit the error bound.
+	bounded bool
+
+	// memo holds RD decisions for the nodes of the current root block.
+	memo map[treeKey]treeChoice
+}
+
+func (e *Encoder) newTreeEncoder(g treeGeom, spread int32, sizeBuf *bytes.Buffer, leaves treeLeafCoder) *treeEncoder {
+	t := &treeEncoder{
+		e:       e,
+		g:       g,
+		spread:  spread,
+		lambda:  e.lambda(spread, g.small),
+		sizeW:   newBitWriter(sizeBuf),
+		leaves:  leaves,
+		bounded: e.maxErr >= 0,
+	}
+	if e.Effort >= effortRD {
+		t.memo = make(map[treeKey]treeChoice)
+	}
+	return t
+}
+
+// encode codes every root block and flushes the size stream.
+func (t *treeEncoder) encode() {
+	for y := 0; y < t.g.h; y += t.g.root {
+		for x := 0; x < t.g.w; x += t.g.root {
+			clear(t.memo)
+			t.node(x, y, t.g.root, t.g.root)
+			t.leaves.rootDone(x, y)
+		}
+	}
+	t.sizeW.flush()
+}
+
+func (t *treeEncoder) node(x, y, bw, bh int) {
+	if x >= t.g.w || y >= t.g.h {
+		return
+	}
+	if cw, ch, ok := t.g.forcedSplit(x, y, bw, bh); ok {
+		t.children(x, y, bw, bh, cw, ch)
+		return
+	}
+	if bw == t.g.small && bh == t.g.small {
+		t.leaves.leaf(x, y, bw, bh)
+		return
+	}
+
+	kind := t.chooseSplit(x, y, bw, bh)
+	t.g.writeSplit(&t.sizeW, kind, bw, bh)
+	if kind == splitNone {
+		t.leaves.leaf(x, y, bw, bh)
+		return
+	}
+	cw, ch := t.g.childSize(kind, bw, bh)
+	t.children(x, y, bw, bh, cw, ch)
+}
+
+func (t *treeEncoder) children(x, y, bw, bh, cw, ch int) {
+	for cy := y; cy < y+bh; cy += ch {
+		for cx := x; cx < x+bw; cx += cw {
+			t.node(cx, cy, cw, ch)
+		}
+	}
+}
+
+// chooseSplit decides a node inside the coded area: by the spread heuristic
+// (or the error bound) at EffortFastest, by comparing RD costs otherwise.
+func (t *treeEncoder) chooseSplit(x, y, bw, bh int) int {
+	if t.e.Effort >= effortRD {
+		return t.best(x, y, bw, bh).kind
+	}
+	if t.bounded {
+		return t.chooseSplitBounded(x, y, bw, bh)
+	}
+
+	spread := int32(float64(t.spread) * t.e.nodeScale(x, y, bw, bh))
+	if t.leaves.valueRange(x, y, bw, bh) < spread {
+		return splitNone
+	}
+	if !t.g.directional(bw, bh) {
+		return splitHalf
+	}
+	// Prefer a directional split when both halves become flat enough,
+	// picking the orientation with the smaller remaining ranges.
+	rows := max(t.leaves.valueRange(x, y, bw, bh/2), t.leaves.valueRange(x, y+bh/2, bw, bh/2))
+	cols := max(t.leaves.valueRange(x, y, bw/2, bh), t.leaves.valueRange(x+bw/2, y, bw/2, bh))
+	switch {
+	case rows < spread && rows <= cols:
+		return splitRows
+	case cols < spread:
+		return splitCols
+	}
+	return splitHalf
+}
+
+// chooseSplitBounded keeps the largest blocks that fit the error bound.
+func (t *treeEncoder) chooseSplitBounded(x, y, bw, bh int) int {
+	l := t.leaves
+	switch {
+	case l.fits(x, y, bw, bh):
+		return splitNone
+	case !t.g.directional(bw, bh):
+		return splitHalf
+	case l.fits(x, y, bw, bh/2) && l.fits(x, y+bh/2, bw, bh/2):
+		return splitRows
+	case l.fits(x, y, bw/2, bh) && l.fits(x+bw/2, y, bw/2, bh):
+		return splitCols
+	}
+	return splitHalf
+}
+
+// best returns the lowest-cost coding of a node inside the coded area,
+// trying a leaf and every split kind allowed for its size.
+func (t *treeEncoder) best(x, y, bw, bh int) treeChoice {
+	key := treeKey{int32(x), int32(y), int32(bw), int32(bh)}
+	if c, ok := t.memo[key]; ok {
+		return c
+	}
+
+	choice := treeChoice{kind: splitNone, cost: t.leaves.leafCost(x, y, bw, bh)}
+	if bw > t.g.small || bh > t.g.small {
+		lambda := t.e.nodeLambda(t.lambda, x, y, bw, bh)
+		choice.cost += lambda * float64(t.g.splitBits(splitNone, bw, bh))
+		kinds := []int{splitHalf}
+		if t.g.directional(bw, bh) {
+			kinds = append(kinds, splitRows, splitCols)
+		}
+		for _, kind := range kinds {
+			cost := lambda * float64(t.g.splitBits(kind, bw, bh))
+			cw, ch := t.g.childSize(kind, bw, bh)
+		children:
+			for cy := y; cy < y+bh; cy += ch {
+				for cx := x; cx < x+bw; cx += cw {
+					cost += t.best(cx, cy, cw, ch).cost
+					if cost >= choice.cost {
+						break children
+					}
+				}
+			}
+			if cost < choice.cost {
+				choice = treeChoice{kind: kind, cost: cost}
+			}
+		}
+	}
+
+	t.memo[key] = choice
+	return choice
+}
+
+// treeSpread returns the spread threshold that drives the tree decisions of
+// channel ch. With an error bound (MaxError) the bound already caps the
+// error, so the threshold grows with it and RD decisions mostly minimise the
+// rate.
+func (e *Encoder) treeSpread(ch int) int32 {
+	if e.maxErr > 0 {
+		return int32(16 * e.maxErr)
+	}
+	return allowedMacroSpreadForQuality(e.quality[ch])
+}
+
+// channelLeafCoder codes the leaves of one channel plane.
+type channelLeafCoder struct {
+	e        *Encoder
+	plane    []uint8
+	stride   int
+	typeW    bitWriter
+	patternW bitWriter
+	scratch  *encoderChannelScratch
+	levels   *levelMap // non-nil with featPredict
+	g        treeGeom
+
+	// RD multiplier and level precision of the current node (see node)
+	baseLambda float64
+	lambda     float64
+	levelStep  int
+
+	// featCopy: the hash chains; with featCopy, and for luma with
+	// featChromaFromLuma, the decoded channel as the decoder will see it
+	copies *copyIndex
+	recon  []uint8
+
+	gradients  bool // featGradient
+	multiLevel bool // featMultiLevel
+
+	// featChromaFromLuma: the decoded luma, nil when coding luma itself
+	luma []uint8
+
+	// Encoder.LinearLight: the transfer table of the channel, or nil
+	linear *transferLUT
+
+	blockCount uint32
+}
+
+func (e *Encoder) encodeChannelTree(ch int, plane []uint8, stride, w4, h4 int, scratch *encoderChannelScratch) (uint32, []byte, []byte, []byte, []uint8, []uint8, error) {
+	scratch.sizeBuf.Reset()
+	scratch.typeBuf.Reset()
+	scratch.patternBuf.Reset()
+	scratch.fgVals = scratch.fgVals[:0]
+	scratch.bgVals = scratch.bgVals[:0]
+	scratch.copyVals = scratch.copyVals[:0]
+
+	g := newTreeGeom(&e.hdr, ch, w4, h4)
+	if n := g.root * g.root; cap(scratch.blockVals) < n {
+		scratch.blockVals = make([]uint8, n)
+	}
+
+	spread := e.treeSpread(ch)
+	lc := &channelLeafCoder{
+		e:        e,
+		plane:    plane,
+		stride:   stride,
+		typeW:    newBitWriter(&scratch.typeBuf),
+		patternW: newBitWriter(&scratch.patternBuf),
+		scratch:  scratch,
+		g:        g,
+
+		baseLambda: e.lambda(spread, g.small),
+		linear:     e.linear[ch],
+	}
+	if e.hdr.features&featPredict != 0 {
+		lc.levels = newLevelMap(g)
+	}
+	lc.gradients = e.hdr.features&featGradient != 0
+	lc.multiLevel = e.hdr.features&featMultiLevel != 0
+	cfl := e.hdr.features&featChromaFromLuma != 0
+	if e.hdr.features&featCopy != 0 {
+		shift := uint(2)
+		if e.maxErr == 0 {
+			shift = 0
+		}
+		lc.copies = newCopyIndex(scratch, g.w, g.h, shift)
+	}
+	if lc.copies != nil || cfl && ch == chY {
+		if cap(scratch.recon) < len(plane) {
+			scratch.recon = make([]uint8, len(plane))
+		}
+		lc.recon = scratch.recon[:len(plane)]
+	}
+	if cfl && ch != chY {
+		lc.luma = e.ch[chY].recon[:len(plane)]
+	}
+	e.newTreeEncoder(g, spread, &scratch.sizeBuf, lc).encode()
+
+	lc.typeW.flush()
+	lc.patternW.flush()
+	return lc.blockCount, scratch.sizeBuf.Bytes(), scratch.typeBuf.Bytes(), scratch.patternBuf.Bytes(), scratch.fgVals, scratch.bgVals, nil
+}
+
+func (c *channelLeafCoder) values(x, y, bw, bh int) []uint8 {
+	return readBlockValues(c.plane, c.stride, x, y, bw, bh, c.scratch.blockVals)
+}
+
+// node returns the values of the block at (x, y) and sets the RD multiplier
+// and level precision for coding it (see Encoder.ROI).
+func (c *channelLeafCoder) node(x, y, bw, bh int) []uint8 {
+	c.lambda = c.e.nodeLambda(c.baseLambda, x, y, bw, bh)
+	c.levelStep = c.e.nodeLevelStep(x, y, bw, bh)
+	return c.values(x, y, bw, bh)
+}
+
+// valueRange returns the range of the block, or with gradients twice the
+// largest deviation from its gradient if that is smaller.
+func (c *channelLeafCoder) valueRange(x, y, bw, bh int) int32 {
+	vals := c.values(x, y, bw, bh)
+	r := valueRange(vals)
+	if c.gradients && len(vals) > 1 {
+		_, worst := fitGradient(vals, bw, bh).errors(vals, bw, bh)
+		r = min(r, int32(2*worst))
+	}
+	return r
+}
+
+// fits ignores multi-level leaves: they keep blocks whole at two bits per
+// pixel, which the greedy bounded split would take wherever they fit.
+func (c *channelLeafCoder) fits(x, y, bw, bh int) bool {
+	vals := c.node(x, y, bw, bh)
+	if !math.IsInf(c.baseModel(vals, bw, bh).cost, 1) {
+		return true
+	}
+	if thr, ok := c.lumaThreshold(x, y, bw, bh); ok && !math.IsInf(c.lumaModel(x, y, bw, bh, thr, vals).cost, 1) {
+		return true
+	}
+	if c.canCopy(bw, bh) {
+		_, ok := c.findCopy(x, y, bw, bh, vals)
+		return ok
+	}
+	return false
+}
+
+func (c *channelLeafCoder) leafCost(x, y, bw, bh int) float64 {
+	return c.choose(x, y, bw, bh, c.node(x, y, bw, bh)).cost
+}
+
+func (c *channelLeafCoder) rootDone(x, y int) {
+	if c.copies != nil {
+		c.copies.addRoot(c.g, c.plane, c.stride, x, y)
+	}
+}
+
+// Leaf kinds of a channel segment in the tree layout.
+const (
+	leafSolid = iota
+	leafPattern
+	leafGradient   // featGradient
+	leafMultiLevel // featMultiLevel
+	leafCopy       // featCopy
+	leafLuma       // featChromaFromLuma
+)
+
+// leafModel is the coding chosen for one leaf of a channel.
+type leafModel struct {
+	kind   int
+	fit    blockFit    // leafSolid, leafPattern, leafLuma (thr is the luma threshold)
+	grad   gradientFit // leafGradient
+	multi  multiFit    // leafMultiLevel
+	sx, sy int         // leafCopy: source position
+	// cost is the RD cost, +Inf when the block does not fit the error bound.
+	cost float64
+}
+
+// choose picks the cheapest coding of the leaf at (x, y) with values vals,
+// including the luma pattern and a copy of an earlier block.
+func (c *channelLeafCoder) choose(x, y, bw, bh int, vals []uint8) leafModel {
+	m := c.model(vals, bw, bh)
+	if thr, ok := c.lumaThreshold(x, y, bw, bh); ok {
+		if m.kind != leafSolid {
+			m.cost += c.lambda // luma-pattern bit
+		}
+		if lm := c.lumaModel(x, y, bw, bh, thr, vals); lm.cost < m.cost {
+			m = lm
+		}
+	}
+	if !c.canCopy(bw, bh) {
+		return m
+	}
+	m.cost += c.lambda // copy bit
+	if cm, ok := c.findCopy(x, y, bw, bh, vals); ok && cm.cost < m.cost {
+		return cm
+	}
+	return m
+}
+
+// model picks the cheapest coding of a bw x bh leaf with values vals.
+func (c *channelLeafCoder) model(vals []uint8, bw, bh int) leafModel {
+	m := c.baseModel(vals, bw, bh)
+	if !c.multiLevel || len(vals) == 1 || m.fit.sse(vals) == 0 {
+		return m
+	}
+	var fits []multiFit
+	if c.e.maxErr >= 0 {
+		if f, ok := fitMultiLevelBounded(vals, c.e.maxErr); ok {
+			fits = append(fits, f)
+		}
+	} else {
+		fits = append(fits, fitMultiLevel(vals, 3), fitMultiLevel(vals, 4))
+	}
+	for _, f := range fits {
+		if cost := f.sse(vals) + c.lambda*f.bits(len(vals)); cost < m.cost {
+			m = leafModel{kind: leafMultiLevel, multi: f, cost: cost}
+		}
+	}
+	return m
+}
+
+// baseModel is model without multi-level leaves.
+func (c *channelLeafCoder) baseModel(vals []uint8, bw, bh int) leafModel {
+	if len(vals) == 1 {
+		return leafModel{
+			fit:  blockFit{thr: vals[0], fg: vals[0], bg: vals[0]},
+			cost: c.lambda * rdLevelBits,
+		}
+	}
+
+	bounded := c.e.maxErr >= 0
+	m := leafModel{fit: c.e.fitBlock(vals, c.lambda)}
+	if c.linear != nil {
+		m.fit = c.linear.levels(m.fit, vals)
+	}
+	if c.levelStep > 1 {
+		m.fit.fg = roundLevel(m.fit.fg, c.levelStep)
+		m.fit.bg = roundLevel(m.fit.bg, c.levelStep)
+	}
+	if m.fit.pattern {
+		m.kind = leafPattern
+	}
+	m.cost = m.fit.sse(vals) + c.lambda*m.fit.bits(len(vals))
+	if bounded {
+		if _, ok := fitBlockBounded(vals, c.e.maxErr); !ok {
+			m.cost = math.Inf(1)
+		}
+	}
+	if c.gradients {
+		g := fitGradient(vals, bw, bh)
+		sse, worst := g.errors(vals, bw, bh)
+		cost := sse + c.lambda*gradientBits
+		if (!bounded || worst <= c.e.maxErr) && cost < m.cost {
+			m.kind, m.grad, m.cost = leafGradient, g, cost
+		}
+	}
+	return m
+}
+
+// writeLeafType writes the type code of a leaf of more than one pixel: 0 for
+// solid and 1 for any other kind. Where the luma pattern is available (luma)
+// the next bit is 1 for leafLuma. With featGradient or featMultiLevel a
+// further bit follows, 0 for a pattern and 1 for the extra kind; with both
+// features a last bit picks leafGradient (0) or leafMultiLevel (1).
+func (c *channelLeafCoder) writeLeafType(kind int, luma bool) {
+	c.typeW.writeBit(kind != leafSolid)
+	if kind == leafSolid {
+		return
+	}
+	if luma {
+		c.typeW.writeBit(kind == leafLuma)
+		if kind == leafLuma {
+			return
+		}
+	}
+	if !(c.gradients || c.multiLevel) {
+		return
+	}
+	c.typeW.writeBit(kind != leafPattern)
+	if kind != leafPattern && c.gradients && c.multiLevel {
+		c.typeW.writeBit(kind == leafMultiLevel)
+	}
+}
+
+func (c *channelLeafCoder) leaf(x, y, bw, bh int) {
+	vals := c.node(x, y, bw, bh)
+	c.blockCount++
+	m := c.choose(x, y, bw, bh, vals)
+	if c.canCopy(bw, bh) {
+		c.typeW.writeBit(m.kind == leafCopy)
+		if m.kind == leafCopy {
+			c.copyLeaf(x, y, bw, bh, m)
+			return
+		}
+	}
+	if c.recon != nil {
+		c.render(x, y, bw, bh, vals, m)
+	}
+	if len(vals) > 1 {
+		_, luma := c.lumaThreshold(x, y, bw, bh)
+		c.writeLeafType(m.kind, luma)
+	}
+	switch m.kind {
+	case leafGradient:
+		c.gradientLeaf(x, y, bw, bh, m.grad)
+		return
+	case leafMultiLevel:
+		c.multiLevelLeaf(x, y, bw, bh, vals, m.multi)
+		return
+	}
+	f := m.fit
+	if !f.pattern {
+		f.bg = f.fg
+	}
+
+	fg, bg := f.fg, f.bg
+	if c.levels != nil {
+		fg = residual(c.levels.predict(c.levels.fg, x, y), f.fg)
+		bg = residual(c.levels.predict(c.levels.bg, x, y), f.bg)
+		c.levels.set(x, y, bw, bh, f.fg, f.bg)
+	}
+	c.scratch.fgVals = append(c.scratch.fgVals, fg)
+	if !f.pattern {
+		return
+	}
+	c.scratch.bgVals = append(c.scratch.bgVals, bg)
+	if m.kind == leafLuma {
+		return
+	}
+	for _, v := range vals {
+		c.patternW.writeBit(v >= f.thr)
+	}
+}
+
+// multiLevelLeaf stores the level count, levels and indices of a
+// multi-level leaf.
+func (c *channelLeafCoder) multiLevelLeaf(x, y, bw, bh int, vals []uint8, f multiFit) {
+	c.typeW.writeBit(f.n == 4)
+	hi, lo := f.levels[f.n-1], f.levels[0]
+	mid := f.levels[1 : f.n-1]
+	fg, bg := hi, lo
+	if c.levels != nil {
+		fg = residual(c.levels.predict(c.levels.fg, x, y), hi)
+		bg = residual(c.levels.predict(c.levels.bg, x, y), lo)
+		c.levels.set(x, y, bw, bh, hi, lo)
+	}
+	c.scratch.fgVals = append(c.scratch.fgVals, fg)
+	c.scratch.bgVals = append(c.scratch.bgVals, bg)
+	for _, v := range mid {
+		if c.levels != nil {
+			v = residual(lo, v)
+		}
+		c.scratch.bgVals = append(c.scratch.bgVals, v)
+	}
+	for _, v := range vals {
+		c.patternW.writeBits(uint64(f.index(v)), 2)
+	}
+}
+
+// gradientLeaf stores the corners of a gradient leaf.
+func (c *channelLeafCoder) gradientLeaf(x, y, bw, bh int, g gradientFit) {
+	tl := g.tl
+	others := [3]uint8{g.tr, g.bl, g.br}
+	if c.levels != nil {
+		tl = residual(c.levels.predict(c.levels.fg, x, y), g.tl)
+		for i, v := range others {
+			others[i] = residual(g.tl, v)
+		}
+		c.levels.setGradient(x, y, bw, bh, g)
+	}
+	c.scratch.fgVals = append(c.scratch.fgVals, tl)
+	c.scratch.bgVals = append(c.scratch.bgVals, others[:]...)
+}
+
+// valueRange returns max-min of vals.
+func valueRange(vals []uint8) int32 {
+	minV, maxV := vals[0], vals[0]
+	for _, v := range vals[1:] {
+		minV = min(minV, v)
+		maxV = max(maxV, v)
+	}
+	return int32(maxV) - int32(minV)
+}
+
+// segmentStreams are the streams of one channel segment (see
+// readChannelSegment). The meaning of the FG/BG payloads depends on the
+// layout: delta-packed levels per channel, runs of joint tones, or palette
+// indices.
+type segmentStreams struct {
+	blockCount int
+	size       bitReader
+	typ        bitReader
+	pattern    bitReader
+	fg         []byte
+	bg         []byte
+	copies     []byte // featCopy
+}
+
+// parseSegmentStreams splits a channel segment into its streams; copies
+// selects the copy stream of featCopy.
+func parseSegmentStreams(data []byte, copies bool) (segmentStreams, error) {
+	var ss segmentStreams
+	pos := 0
+	next := func(label string) ([]byte, error) {
+		if len(data)-pos < 4 {
+			return nil, fmt.Errorf("decodeChannel: truncated while reading %s length", label)
+		}
+		n := binary.BigEndian.Uint32(data[pos : pos+4])
+		pos += 4
+		if n > uint32(len(data)-pos) {
+			return nil, fmt.Errorf("decodeChannel: truncated while reading %s", label)
+		}
+		s := data[pos : pos+int(n)]
+		pos += int(n)
+		return s, nil
+	}
+
+	if len(data) < 4 {
+		return ss, fmt.Errorf("decodeChannel: truncated while reading blockCount")
+	}
+	ss.blockCount = int(binary.BigEndian.Uint32(data[:4]))
+	pos = 4
+
+	var streams [5][]byte
+	for i, label := range [...]string{"sizeStream", "typeStream", "patternStream", "FG packed data", "BG packed data"} {
+		s, err := next(label)
+		if err != nil {
+			return ss, err
+		}
+		streams[i] = s
+	}
+	ss.size = newBitReader(streams[0])
+	ss.typ = newBitReader(streams[1])
+	ss.pattern = newBitReader(streams[2])
+	ss.fg = streams[3]
+	ss.bg = streams[4]
+	if copies {
+		s, err := next("copy stream")
+		if err != nil {
+			return ss, err
+		}
+		ss.copies = s
+	}
+	return ss, nil
+}
+
+// treeLeafDecoder reconstructs the leaves of a tree layout.
+type treeLeafDecoder interface {
+	leaf(x, y, bw, bh int) error
+	// finish checks that every stream was consumed.
+	finish() error
+}
+
+// decodeTree walks the tree layout, reading split symbols from size and
+// handing leaves to leaves.
+func decodeTree(g treeGeom, size *bitReader, leaves treeLeafDecoder) error {
+	var node func(x, y, bw, bh int) error
+	node = func(x, y, bw, bh int) error {
+		if x >= g.w || y >= g.h {
+			return nil
+		}
+		cw, ch, forced := g.forcedSplit(x, y, bw, bh)
+		if !forced {
+			if bw == g.small && bh == g.small {
+				return leaves.leaf(x, y, bw, bh)
+			}
+			kind, err := g.readSplit(size, bw, bh)
+			if err != nil {
+				return fmt.Errorf("decodeChannel: size stream too short")
+			}
+			if kind == splitNone {
+				return leaves.leaf(x, y, bw, bh)
+			}
+			cw, ch = g.childSize(kind, bw, bh)
+		}
+
+		for cy := y; cy < y+bh; cy += ch {
+			for cx := x; cx < x+bw; cx += cw {
+				if err := node(cx, cy, cw, ch); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	for y := 0; y < g.h; y += g.root {
+		for x := 0; x < g.w; x += g.root {
+			if err := node(x, y, g.root, g.root); err != nil {
+				return err
+			}
+		}
+	}
+	return leaves.finish()
+}
+
+// channelLeafDecoder reconstructs the leaves of one channel into pix.
+type channelLeafDecoder struct {
+	ss            segmentStreams
+	fg            deltaStream
+	bg            deltaStream
+	pix           []byte
+	strideBytes   int
+	channelOffset int
+	blockIndex    int
+
+	// featPredict: residuals and their context instead of fg/bg
+	levels *levelMap
+	fgRes  residualStream
+	bgRes  residualStream
+
+	gradients  bool // featGradient
+	multiLevel bool // featMultiLevel
+	luma       bool // featChromaFromLuma, for a chroma channel
+
+	// featCopy: the copy stream and the geometry to check sources against
+	copyOn  bool
+	copies  []byte
+	copyPos int
+	g       treeGeom
+
+	// DecodeScaled: the reduced grid that takes the leaves instead of pix
+	out *scaledPlanes
+}
+
+// decodeChannelTreeToPix decodes a tree-layout channel into pix, or into
+// out at reduced resolution when out is set.
+func decodeChannelTreeToPix(hdr *streamHeader, data []byte, pix []byte, strideBytes int, channelOffset int, out *scaledPlanes, scratch *decoderChannelScratch) error {
+	copyOn := hdr.features&featCopy != 0
+	ss, err := parseSegmentStreams(data, copyOn)
+	if err != nil {
+		return err
+	}
+	// Copy leaves have no FG level.
+	if len(ss.fg) > ss.blockCount || !copyOn && len(ss.fg) != ss.blockCount {
+		return fmt.Errorf("decodeChannel: FG count %d does not match block count %d", len(ss.fg), ss.blockCount)
+	}
+	maxBG := ss.blockCount
+	if hdr.features&(featGradient|featMultiLevel) != 0 {
+		maxBG *= 3
+	}
+	if len(ss.bg) > maxBG {
+		return fmt.Errorf("decodeChannel: BG packed data too long")
+	}
+	d := &scratch.leaf
+	*d = channelLeafDecoder{
+		ss:            ss,
+		pix:           pix,
+		strideBytes:   strideBytes,
+		channelOffset: channelOffset,
+		gradients:     hdr.features&featGradient != 0,
+		multiLevel:    hdr.features&featMultiLevel != 0,
+		luma:          hdr.features&featChromaFromLuma != 0 && channelOffset != 0,
+		copyOn:        copyOn,
+		copies:        ss.copies,
+		out:           out,
+	}
+	w, h := hdr.codedSize()
+	g := newTreeGeom(hdr, channelOffset, w, h)
+	d.g = g
+	if hdr.features&featPredict != 0 {
+		scratch.levels.reset(g)
+		d.levels = &scratch.levels
+		d.fgRes = residualStream{data: ss.fg}
+		d.bgRes = residualStream{data: ss.bg}
+	} else {
+		if d.fg, err = newDeltaStream(ss.fg, len(ss.fg)); err != nil {
+			return err
+		}
+		if d.bg, err = newDeltaStream(ss.bg, len(ss.bg)); err != nil {
+			return err
+		}
+	}
+	return decodeTree(g, &d.ss.size, d)
+}
+
+// level reads the next FG (bg=false) or BG level of the leaf at (x, y).
+func (d *channelLeafDecoder) level(bg bool, x, y int) (uint8, error) {
+	if d.levels == nil {
+		if bg {
+			return d.bg.next()
+		}
+		return d.fg.next()
+	}
+	s, levels := &d.fgRes, d.levels.fg
+	if bg {
+		s, levels = &d.bgRes, d.levels.bg
+	}
+	r, err := s.next()
+	if err != nil {
+		return 0, err
+	}
+	return unresidual(d.levels.predict(levels, x, y), r), nil
+}
+
+// readLeafType reads a type code written by writeLeafType.
+func (d *channelLeafDecoder) readLeafType(luma bool) (int, error) {
+	bit, err := d.ss.typ.readBit()
+	if err != nil || !bit {
+		return leafSolid, err
+	}
+	if luma {
+		if bit, err = d.ss.typ.readBit(); err != nil || bit {
+			return leafLuma, err
+		}
+	}
+	if !(d.gradients || d.multiLevel) {
+		return leafPattern, nil
+	}
+	if bit, err = d.ss.typ.readBit(); err != nil || !bit {
+		return leafPattern, err
+	}
+	if !d.multiLevel {
+		return leafGradient, nil
+	}
+	if !d.gradients {
+		return leafMultiLevel, nil
+	}
+	if bit, err = d.ss.typ.readBit(); err != nil || !bit {
+		return leafGradient, err
+	}
+	return leafMultiLevel, nil
+}
+
+func (d *channelLeafDecoder) leaf(x, y, bw, bh int) error {
+	if d.blockIndex >= d.ss.blockCount {
+		return fmt.Errorf("unexpected end of blocks in tree layout")
+	}
+	d.blockIndex++
+
+	if d.copyOn && bw >= copyWindow && bh >= copyWindow {
+		isCopy, err := d.ss.typ.readBit()
+		if err != nil {
+			return fmt.Errorf("decodeChannel: type stream too short")
+		}
+		if isCopy {
+			return d.copyLeaf(x, y, bw, bh)
+		}
+	}
+	kind := leafSolid
+	var thr uint8
+	if bw*bh > 1 {
+		luma := false
+		if d.luma {
+			thr, luma = lumaThreshold(d.pix, y*d.strideBytes+x*4, d.strideBytes, 4, bw, bh)
+		}
+		var err error
+		if kind, err = d.readLeafType(luma); err != nil {
+			return fmt.Errorf("decodeChannel: type stream too short")
+		}
+	}
+	n := 0
+	if kind == leafMultiLevel {
+		four, err := d.ss.typ.readBit()
+		if err != nil {
+			return fmt.Errorf("decodeChannel: type stream too short")
+		}
+		n = 3
+		if four {
+			n = 4
+		}
+	}
+	fg, err := d.level(false, x, y)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case leafGradient:
+		return d.gradientLeaf(x, y, bw, bh, fg)
+	case leafMultiLevel:
+		return d.multiLevelLeaf(x, y, bw, bh, n, fg)
+	case leafSolid:
+		if d.levels != nil {
+			d.levels.set(x, y, bw, bh, fg, fg)
+		}
+		if d.out != nil {
+			d.out.fill(d.channelOffset, x, y, bw, bh, fg)
+			return nil
+		}
+		return fillBlockPix(d.pix, d.strideBytes, x, y, bw, bh, fg, d.channelOffset)
+	}
+	bg, err := d.level(true, x, y)
+	if err != nil {
+		return fmt.Errorf("decodeChannel: BG stream exhausted")
+	}
+	if d.levels != nil {
+		d.levels.set(x, y, bw, bh, fg, bg)
+	}
+	if kind == leafLuma {
+		drawLumaPatternPix(d.pix, d.strideBytes, x, y, bw, bh, thr, fg, bg, d.channelOffset)
+		return nil
+	}
+	if d.out != nil {
+		return d.out.pattern(d.channelOffset, x, y, bw, bh, &d.ss.pattern, fg, bg)
+	}
+	return drawBlockPix(d.pix, d.strideBytes, x, y, bw, bh, &d.ss.pattern, fg, bg, d.channelOffset)
+}
+
+// multiLevelLeaf reads the remaining levels of an n-level leaf with highest
+// level hi and draws it.
+func (d *channelLeafDecoder) multiLevelLeaf(x, y, bw, bh, n int, hi uint8) error {
+	f := multiFit{n: n}
+	f.levels[n-1] = hi
+	lo, err := d.level(true, x, y)
+	if err != nil {
+		return fmt.Errorf("decodeChannel: BG stream exhausted")
+	}
+	f.levels[0] = lo
+	for i := 1; i < n-1; i++ {
+		if d.levels != nil {
+			var r uint8
+			r, err = d.bgRes.next()
+			f.levels[i] = unresidual(lo, r)
+		} else {
+			f.levels[i], err = d.bg.next()
+		}
+		if err != nil {
+			return fmt.Errorf("decodeChannel: BG stream exhausted")
+		}
+	}
+	if d.levels != nil {
+		d.levels.set(x, y, bw, bh, hi, lo)
+	}
+	if d.out != nil {
+		return d.out.multiLevel(d.channelOffset, x, y, bw, bh, &d.ss.pattern, f)
+	}
+	return drawMultiLevelPix(d.pix, d.strideBytes, x, y, bw, bh, &d.ss.pattern, f, d.channelOffset)
+}
+
+// gradientLeaf reads the remaining corners of a gradient leaf with top-left
+// corner tl and draws it.
+func (d *channelLeafDecoder) gradientLeaf(x, y, bw, bh int, tl uint8) error {
+	var corners [3]uint8
+	for i := range corners {
+		var err error
+		if d.levels != nil {
+			var r uint8
+			r, err = d.bgRes.next()
+			corners[i] = unresidual(tl, r)
+		} else {
+			corners[i], err = d.bg.next()
+		}
+		if err != nil {
+			return fmt.Errorf("decodeChannel: BG stream exhausted")
+		}
+	}
+	g := gradientFit{tl: tl, tr: corners[0], bl: corners[1], br: corners[2]}
+	if d.levels != nil {
+		d.levels.setGradient(x, y, bw, bh, g)
+	}
+	if d.out != nil {
+		d.out.gradient(d.channelOffset, x, y, bw, bh, g)
+		return nil
+	}
+	drawGradientPix(d.pix, d.strideBytes, x, y, bw, bh, g, d.channelOffset)
+	return nil
+}
+
+func (d *channelLeafDecoder) finish() error {
+	if d.blockIndex != d.ss.blockCount {
+		return fmt.Errorf("block count mismatch: used %d of %d", d.blockIndex, d.ss.blockCount)
+	}
+	if d.copyPos != len(d.copies) {
+		return fmt.Errorf("copy stream mismatch: used %d of %d bytes", d.copyPos, len(d.copies))
+	}
+	if d.levels != nil {
+		if d.fgRes.i != len(d.fgRes.data) {
+			return fmt.Errorf("color stream mismatch: fg used=%d expected=%d", d.fgRes.i, len(d.fgRes.data))
+		}
+		if d.bgRes.i != len(d.bgRes.data) {
+			return fmt.Errorf("color stream mismatch: bg used=%d expected=%d", d.bgRes.i, len(d.bgRes.data))
+		}
+		return nil
+	}
+	if d.fg.i != d.fg.n {
+		return fmt.Errorf("color stream mismatch: fg used=%d expected=%d", d.fg.i, d.fg.n)
+	}
+	if d.bg.i != d.bg.n {
+		return fmt.Errorf("color stream mismatch: bg used=%d expected=%d", d.bg.i, d.bg.n)
+	}
+	return nil
+}